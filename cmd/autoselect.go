@@ -0,0 +1,100 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/AlexSSD7/linsk/vm"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// autoSelectMountDevice opens LUKS and LVM layers on the passed-through disks
+// and picks the device to mount. If there is more than one mountable file system,
+// the user is asked to pick one, the largest being the default.
+func autoSelectMountDevice(ctx context.Context, fm *vm.FileManager) (string, error) {
+	disks, err := fm.OpenPassthroughLayers(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "open passthrough layers")
+	}
+
+	candidates := vm.GetMountCandidates(disks)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no mountable file systems found on the passed-through disks")
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Size > candidates[j].Size
+	})
+
+	if len(candidates) == 1 {
+		return candidates[0].DevName(), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		slog.Warn("Found several mountable file systems but stdin is not a terminal, picking the largest one", "dev", candidates[0].DevName())
+		return candidates[0].DevName(), nil
+	}
+
+	return pickMountDevice(candidates)
+}
+
+func pickMountDevice(candidates []vm.BlockDevice) (string, error) {
+	fmt.Fprintf(os.Stderr, "Found several mountable file systems:\n")
+
+	for i, dev := range candidates {
+		line := fmt.Sprintf("  %v) %v, %v, %v", i+1, dev.DevName(), humanize.IBytes(dev.Size), dev.FSType)
+		if dev.Label != "" {
+			line += ", label '" + utils.ClearUnprintableChars(dev.Label, false) + "'"
+		}
+
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Fprintf(os.Stderr, "Which one to mount? [1] > ")
+
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return "", errors.Wrap(err, "read answer")
+		}
+
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return candidates[0].DevName(), nil
+		}
+
+		n, err := strconv.Atoi(answer)
+		if err == nil && n >= 1 && n <= len(candidates) {
+			return candidates[n-1].DevName(), nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Please enter a number from 1 to %v.\n", len(candidates))
+	}
+}
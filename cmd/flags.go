@@ -17,58 +17,173 @@
 package cmd
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 
+	"github.com/AlexSSD7/linsk/vm"
 	"github.com/spf13/pflag"
 )
 
 const defaultVMMountDevName = "vdb"
 
-func getLUKSContainerDevice() string {
-	var luksContainerDevice string
+func getLUKSContainers() []vm.LUKSContainer {
+	var containers []vm.LUKSContainer
 
-	if vmRuntimeLUKSContainerFlag != "" {
-		if vmRuntimeLUKSContainerEntireDriveFlag {
-			slog.Error("--luks-container and --luks-container-entire-drive (-c) cannot be both specified at once")
+	if vmRuntimeLUKSContainerEntireDriveFlag {
+		containers = append(containers, vm.LUKSContainer{DevName: defaultVMMountDevName})
+	}
+
+	for _, val := range vmRuntimeLUKSContainerFlag {
+		c, err := parseLUKSContainerSpec(val)
+		if err != nil {
+			slog.Error("Failed to parse LUKS container", "value", val, "error", err.Error())
 			os.Exit(1)
 		}
 
-		luksContainerDevice = vmRuntimeLUKSContainerFlag
-	} else if vmRuntimeLUKSContainerEntireDriveFlag {
-		luksContainerDevice = defaultVMMountDevName
+		containers = append(containers, c)
+	}
+
+	return containers
+}
+
+var luksContainerSpecOptionKeys = []string{"mapper"}
+
+// parseLUKSContainerSpec parses the value of the --luks-container flag. The syntax
+// is "<vm dev>[:mapper=<mapper name>]", where the device can also be a "uuid=",
+// "label=" or "partlabel=" selector. The colons are handled as in --mount.
+func parseLUKSContainerSpec(val string) (vm.LUKSContainer, error) {
+	split := splitSpec(val, luksContainerSpecOptionKeys)
+
+	c := vm.LUKSContainer{
+		DevName: split[0],
+	}
+
+	err := checkSpecDevName(c.DevName)
+	if err != nil {
+		return vm.LUKSContainer{}, err
+	}
+
+	for _, item := range split[1:] {
+		key, value, _ := strings.Cut(item, "=")
+
+		switch key {
+		case "mapper":
+			if value == "" {
+				return vm.LUKSContainer{}, fmt.Errorf("empty mapper name")
+			}
+
+			c.MapperName = value
+		default:
+			return vm.LUKSContainer{}, fmt.Errorf("unknown option '%v'", key)
+		}
 	}
 
-	return luksContainerDevice
+	return c, nil
 }
 
 var (
-	vmRuntimeLUKSContainerFlag            string
+	vmRuntimeLUKSContainerFlag            []string
 	vmRuntimeLUKSContainerEntireDriveFlag bool
 
-	// These are for internal use by the initVMRuntimeFlags and configureVMRuntimeFlags functions.
+	vmRuntimeLUKSKeyfileFlag         string
+	vmRuntimeLUKSPassphraseFileFlag  string
+	vmRuntimeLUKSPassphraseEnvFlag   string
+	vmRuntimeLUKSPassphraseStdinFlag bool
+	vmRuntimeLUKSAskpassFlag         string
+	vmRuntimeLUKSAttemptsFlag        uint
+
+	vmRuntimeLVMActivateFlag         []string
+	vmRuntimeLVMRenameDuplicatesFlag bool
+
+	// Deprecated, has no effect. The VM memory is grown automatically when LUKS devices need it.
 	vmRuntimeInternalAllowLUKSLowMemoryFlag bool
 
 	// These are to be initialized (set) by the initVMRuntimeFlags function.
-	vmRuntimeLUKSContainerDevice string
+	vmRuntimeLUKSContainers   []vm.LUKSContainer
+	vmRuntimeLUKSSecretSource vm.LUKSSecretSource
+	vmRuntimeMemoryMax        uint32
+
+	readOnlyFlag      bool
+	overlayActionFlag string
 )
 
+func initPassthroughFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&readOnlyFlag, "read-only", false, "Guarantees that passed-through devices are never written to. Devices are attached to the VM as read-only, file systems are mounted without journal replay, and file shares are not writable. USB passthrough is not supported in this mode.")
+	flags.StringVar(&overlayActionFlag, "overlay-action", overlayActionAsk, `Specifies what to do with the overlays of devices passed through with the "overlay" option once the session is over. (available "ask", "discard", "keep", "commit")`)
+}
+
 func initVMRuntimeFlags(flags *pflag.FlagSet) {
-	flags.StringVar(&vmRuntimeLUKSContainerFlag, "luks-container", "", `Specifies a device path (without "dev/" prefix) to preopen as a LUKS container (password will be prompted). Useful for accessing LVM partitions behind LUKS.`)
+	flags.StringArrayVar(&vmRuntimeLUKSContainerFlag, "luks-container", nil, `Specifies a device path (without "dev/" prefix) or a "uuid=", "label=" or "partlabel=" selector to preopen as a LUKS container (password will be prompted). Useful for accessing LVM partitions behind LUKS. Can be specified multiple times. The mapper name can be chosen by appending ":mapper=<name>", otherwise "cryptcontainer", "cryptcontainer2" and so on are used.`)
 	flags.BoolVarP(&vmRuntimeLUKSContainerEntireDriveFlag, "luks-container-entire-drive", "c", false, `Similar to --luks-container, but this assumes that the entire passed-through volume is a LUKS container (password will be prompted).`)
+
+	flags.StringArrayVar(&vmRuntimeLVMActivateFlag, "lvm-activate", nil, `Activates only the specified LVM volume group ("<vg>") or logical volume ("<vg>/<lv>") instead of all of them. The volume group can also be specified by UUID ("uuid=<vg uuid>"), which is needed to pick one of the volume groups with the same name. Can be specified multiple times.`)
+	flags.BoolVar(&vmRuntimeLVMRenameDuplicatesFlag, "lvm-rename-duplicates", false, `Activates LVM volume groups with the same name as another one under a different name, which is the old one with a number appended, so that all of them can be used. Only the device names in the VM change, nothing is written to the devices.`)
+
+	initLUKSSecretFlags(flags)
+	initPassthroughFlags(flags)
+}
+
+func initLUKSSecretFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&vmRuntimeLUKSKeyfileFlag, "luks-keyfile", "", "Open LUKS devices with the specified keyfile instead of prompting for the password. The keyfile is copied to a tmpfs in the VM and wiped right after use.")
+	flags.StringVar(&vmRuntimeLUKSPassphraseFileFlag, "luks-passphrase-file", "", "Read the LUKS password from the specified file instead of prompting for it. A trailing newline is ignored.")
+	flags.StringVar(&vmRuntimeLUKSPassphraseEnvFlag, "luks-passphrase-env", "", "Read the LUKS password from the specified environment variable instead of prompting for it.")
+	flags.BoolVar(&vmRuntimeLUKSPassphraseStdinFlag, "luks-passphrase-stdin", false, "Read LUKS passwords from stdin, one per line, instead of prompting for them. Useful when stdin is piped.")
+	flags.StringVar(&vmRuntimeLUKSAskpassFlag, "luks-askpass", "", "Run the specified program to get the LUKS password, similar to SSH_ASKPASS. The program gets the prompt as the first argument and is expected to print the password to stdout.")
+	flags.UintVar(&vmRuntimeLUKSAttemptsFlag, "luks-attempts", 3, "Specifies how many times to ask for the LUKS password if the entered one is wrong.")
 	flags.BoolVar(&vmRuntimeInternalAllowLUKSLowMemoryFlag, "allow-luks-low-memory", false, "Allow VM memory allocation lower than 2048 MiB when LUKS is enabled.")
+
+	_ = flags.MarkDeprecated("allow-luks-low-memory", "the VM memory is now grown automatically when LUKS devices need it, see --vm-mem-max")
 }
 
-func configureVMRuntimeFlags() {
-	vmRuntimeLUKSContainerDevice = getLUKSContainerDevice()
+func getLUKSSecretSource() vm.LUKSSecretSource {
+	var sources []vm.LUKSSecretSource
 
-	if (luksFlag || vmRuntimeLUKSContainerDevice != "") && !vmRuntimeInternalAllowLUKSLowMemoryFlag {
-		if vmMemAllocFlag < defaultMemAllocLUKS {
-			if vmMemAllocFlag != defaultMemAlloc {
-				slog.Warn("Enforcing minimum LUKS memory allocation. Please add --allow-luks-low-memory to disable this.", "min", vmMemAllocFlag, "specified", vmMemAllocFlag)
-			}
+	if vmRuntimeLUKSKeyfileFlag != "" {
+		sources = append(sources, vm.KeyfileLUKSSecretSource{Path: vmRuntimeLUKSKeyfileFlag})
+	}
 
-			vmMemAllocFlag = defaultMemAllocLUKS
-		}
+	if vmRuntimeLUKSPassphraseFileFlag != "" {
+		sources = append(sources, vm.PassphraseFileLUKSSecretSource{Path: vmRuntimeLUKSPassphraseFileFlag})
+	}
+
+	if vmRuntimeLUKSPassphraseEnvFlag != "" {
+		sources = append(sources, vm.EnvLUKSSecretSource{Name: vmRuntimeLUKSPassphraseEnvFlag})
+	}
+
+	if vmRuntimeLUKSPassphraseStdinFlag {
+		sources = append(sources, vm.NewReaderLUKSSecretSource(os.Stdin))
+	}
+
+	if vmRuntimeLUKSAskpassFlag != "" {
+		sources = append(sources, vm.AskpassLUKSSecretSource{Program: vmRuntimeLUKSAskpassFlag})
 	}
+
+	if len(sources) > 1 {
+		slog.Error("Only one of --luks-keyfile, --luks-passphrase-file, --luks-passphrase-env, --luks-passphrase-stdin and --luks-askpass can be specified at once")
+		os.Exit(1)
+	}
+
+	if len(sources) == 0 {
+		// The File Manager will prompt in the terminal.
+		return nil
+	}
+
+	return sources[0]
+}
+
+func configureVMRuntimeFlags() {
+	vmRuntimeLUKSContainers = getLUKSContainers()
+	vmRuntimeLUKSSecretSource = getLUKSSecretSource()
+
+	if luksFlag || encryptionFlag != "" || len(vmRuntimeLUKSContainers) != 0 {
+		enableLUKSMemoryGrowth()
+	}
+}
+
+// LUKS2 key derivation may need a lot of memory. Instead of allocating it
+// upfront, the VM is grown with the memory balloon only when needed.
+func enableLUKSMemoryGrowth() {
+	vmRuntimeMemoryMax = vmMemMaxFlag
 }
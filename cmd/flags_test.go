@@ -0,0 +1,86 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/AlexSSD7/linsk/vm"
+)
+
+func TestParseLUKSContainerSpec(t *testing.T) {
+	for _, tc := range []struct {
+		val     string
+		want    vm.LUKSContainer
+		wantErr bool
+	}{
+		{
+			val:  "vdb3",
+			want: vm.LUKSContainer{DevName: "vdb3"},
+		},
+		{
+			val:  "vdb1:mapper=cryptA",
+			want: vm.LUKSContainer{DevName: "vdb1", MapperName: "cryptA"},
+		},
+		{
+			val:  "label=backup:2023",
+			want: vm.LUKSContainer{DevName: "label=backup:2023"},
+		},
+		{
+			val:  "label=backup:2023:mapper=backup",
+			want: vm.LUKSContainer{DevName: "label=backup:2023", MapperName: "backup"},
+		},
+		{
+			val:  "partlabel=disk:mappers:mapper=crypt",
+			want: vm.LUKSContainer{DevName: "partlabel=disk:mappers", MapperName: "crypt"},
+		},
+		{
+			val:     "vdb1:cryptA",
+			wantErr: true,
+		},
+		{
+			val:     "vdb1:mapper",
+			wantErr: true,
+		},
+		{
+			val:     ":mapper=cryptA",
+			wantErr: true,
+		},
+		{
+			val:     "",
+			wantErr: true,
+		},
+	} {
+		have, err := parseLUKSContainerSpec(tc.val)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: want an error, have %+v", tc.val, have)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: parse: %v", tc.val, err)
+			continue
+		}
+
+		if have != tc.want {
+			t.Errorf("%q: want %+v, have %+v", tc.val, tc.want, have)
+		}
+	}
+}
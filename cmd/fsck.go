@@ -0,0 +1,142 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AlexSSD7/linsk/share"
+	"github.com/AlexSSD7/linsk/vm"
+	"github.com/spf13/cobra"
+)
+
+// The exit code used when the file system has errors left, following the fsck convention.
+const fsckErrorsExitCode = 4
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck <passthrough> <vm device> [fs type]",
+	Short: "Check a file system for errors, and optionally repair them. Nothing is written to the device unless --repair is specified.",
+	Args:  cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		if fsckRepairFlag && readOnlyFlag {
+			slog.Error("Repairing file systems is not allowed in read-only mode")
+			os.Exit(1)
+		}
+
+		var fsTypeOverride string
+		if len(args) > 2 {
+			fsTypeOverride = args[2]
+		}
+
+		if fsckRepairFlag {
+			confirmOrExit("Will attempt to repair the file system on '"+args[1]+"'. Repairs may lead to data loss, it is advised to back up the device first.", fsckYesFlag)
+		}
+
+		configureVMRuntimeFlags()
+
+		// The report goes to stdout in the JSON mode, so the checker output can't.
+		var checkerOutput io.Writer = os.Stdout
+		if fsckJSONFlag {
+			checkerOutput = os.Stderr
+		}
+
+		os.Exit(runVM(args[:1], func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
+			fm.SetLUKSSecretSource(vmRuntimeLUKSSecretSource)
+			fm.SetLUKSMaxAttempts(int(vmRuntimeLUKSAttemptsFlag))
+
+			if len(vmRuntimeLUKSContainers) != 0 {
+				err := fm.PreopenLUKSContainers(vmRuntimeLUKSContainers)
+				if err != nil {
+					slog.Error("Failed to preopen LUKS containers", "error", err.Error())
+					return 1
+				}
+			}
+
+			start := time.Now()
+
+			report, err := fm.Fsck(args[1], vm.FsckConfig{
+				Repair:         fsckRepairFlag,
+				FSTypeOverride: fsTypeOverride,
+				Output:         checkerOutput,
+			})
+			if err != nil {
+				slog.Error("Failed to check file system", "error", err.Error())
+				return 1
+			}
+
+			if fsckJSONFlag {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+
+				err = enc.Encode(report)
+				if err != nil {
+					slog.Error("Failed to encode fsck report", "error", err.Error())
+					return 1
+				}
+			} else {
+				printFsckReport(os.Stdout, report, time.Since(start))
+			}
+
+			switch {
+			case report.OK():
+				return 0
+			case report.Status == vm.FsckStatusFailed:
+				return 1
+			default:
+				return fsckErrorsExitCode
+			}
+		}, nil, false, false))
+	},
+}
+
+var (
+	fsckRepairFlag bool
+	fsckYesFlag    bool
+	fsckJSONFlag   bool
+)
+
+func init() {
+	fsckCmd.Flags().BoolVar(&fsckRepairFlag, "repair", false, "Repair the errors found. By default, the file system is only checked and nothing is written to the device. Not allowed in read-only mode.")
+	fsckCmd.Flags().BoolVarP(&fsckYesFlag, "yes", "y", false, "Do not ask for confirmation before repairing.")
+	fsckCmd.Flags().BoolVar(&fsckJSONFlag, "json", false, "Print the report in the JSON format. The output of the checker is printed to stderr instead of stdout.")
+
+	initVMRuntimeFlags(fsckCmd.Flags())
+}
+
+func printFsckReport(w io.Writer, report vm.FsckReport, took time.Duration) {
+	var sb strings.Builder
+
+	sb.WriteString("Device: /dev/" + report.DevName + "\n")
+	sb.WriteString("File system: " + report.FSType + "\n")
+	sb.WriteString("Command: " + report.Command + "\n")
+	sb.WriteString("Exit code: " + fmt.Sprint(report.ExitCode) + "\n")
+	sb.WriteString("Status: " + string(report.Status) + "\n")
+	sb.WriteString("Took: " + took.Round(time.Second).String() + "\n")
+
+	if report.Hint != "" {
+		sb.WriteString("\n" + report.Hint + "\n")
+	}
+
+	fmt.Fprintf(w, "===========================\n[File System Check Report]\n%v===========================\n", sb.String())
+}
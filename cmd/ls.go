@@ -18,41 +18,109 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/AlexSSD7/linsk/share"
 	"github.com/AlexSSD7/linsk/vm"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 var lsCmd = &cobra.Command{
 	Use:   "ls",
 	Short: "Start a VM and list all user drives within the VM. Uses lsblk command under the hood.",
-	Args:  cobra.ExactArgs(1),
+	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		configureVMRuntimeFlags()
 
-		os.Exit(runVM(args[0], func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
-			if vmRuntimeLUKSContainerDevice != "" {
-				err := fm.PreopenLUKSContainer(vmRuntimeLUKSContainerDevice)
+		os.Exit(runVM(args, func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
+			fm.SetLUKSSecretSource(vmRuntimeLUKSSecretSource)
+			fm.SetLUKSMaxAttempts(int(vmRuntimeLUKSAttemptsFlag))
+
+			if len(vmRuntimeLUKSContainers) != 0 {
+				err := fm.PreopenLUKSContainers(vmRuntimeLUKSContainers)
 				if err != nil {
-					slog.Error("Failed to preopen LUKS container", "error", err.Error())
+					slog.Error("Failed to preopen LUKS containers", "error", err.Error())
 					return 1
 				}
 			}
 
-			lsblkOut, err := fm.Lsblk()
+			devs, err := fm.Lsblk()
 			if err != nil {
 				slog.Error("Failed to list block devices in the VM", "error", err.Error())
 				return 1
 			}
 
-			if len(lsblkOut) == 0 {
-				fmt.Printf("<empty lsblk output>\n")
-			} else {
-				fmt.Print(string(lsblkOut))
+			var zfsPools []zfsPoolListing
+			if lsZFSFlag {
+				zfsPools, err = listZFSPools(fm)
+				if err != nil {
+					slog.Error("Failed to list ZFS pools in the VM", "error", err.Error())
+					return 1
+				}
+			}
+
+			var btrfsFilesystems []btrfsListing
+			if lsBtrfsFlag {
+				btrfsFilesystems, err = listBtrfsSubvolumes(fm, devs)
+				if err != nil {
+					slog.Error("Failed to list Btrfs subvolumes in the VM", "error", err.Error())
+					return 1
+				}
+			}
+
+			var lvmVGs []vm.LVMVolumeGroup
+			if lsLVMFlag {
+				lvmVGs, err = fm.LVMVolumeGroups()
+				if err != nil {
+					slog.Error("Failed to list LVM volume groups in the VM", "error", err.Error())
+					return 1
+				}
+			}
+
+			raidArrays, err := fm.RAIDArrays()
+			if err != nil {
+				slog.Error("Failed to list RAID arrays in the VM", "error", err.Error())
+				return 1
+			}
+
+			if lsJSONFlag {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+
+				err = enc.Encode(newLsJSONOutput(devs, raidArrays, zfsPools, btrfsFilesystems, lvmVGs))
+				if err != nil {
+					slog.Error("Failed to encode block devices", "error", err.Error())
+					return 1
+				}
+
+				return 0
+			}
+
+			if len(devs) == 0 {
+				fmt.Printf("<no block devices found>\n")
+				return 0
+			}
+
+			printBlockDeviceTree(os.Stdout, devs, raidArrays)
+
+			if lsZFSFlag {
+				printZFSPools(os.Stdout, zfsPools)
+			}
+
+			if lsBtrfsFlag {
+				printBtrfsSubvolumes(os.Stdout, btrfsFilesystems)
+			}
+
+			if lsLVMFlag {
+				printLVMVolumeGroups(os.Stdout, lvmVGs)
 			}
 
 			return 0
@@ -60,6 +128,376 @@ var lsCmd = &cobra.Command{
 	},
 }
 
+var (
+	lsJSONFlag  bool
+	lsZFSFlag   bool
+	lsBtrfsFlag bool
+	lsLVMFlag   bool
+)
+
 func init() {
+	lsCmd.Flags().BoolVar(&lsJSONFlag, "json", false, `Print the output in the JSON format. It is an object with "devices" and "raid" lists, and "zfs", "btrfs" and "lvm" lists which are null unless the corresponding flag is specified.`)
+	lsCmd.Flags().BoolVar(&lsZFSFlag, "zfs", false, "Import the ZFS pools found read-only and list their datasets.")
+	lsCmd.Flags().BoolVar(&lsLVMFlag, "lvm", false, "List the LVM volume groups and their logical volumes, including the inactive ones.")
+	lsCmd.Flags().BoolVar(&lsBtrfsFlag, "btrfs", false, "List the subvolumes and snapshots of the Btrfs file systems found. The file systems are mounted read-only for that.")
+
 	initVMRuntimeFlags(lsCmd.Flags())
 }
+
+type raidArrayListing struct {
+	vm.RAIDArray
+
+	Active   bool `json:"active"`
+	Degraded bool `json:"degraded"`
+}
+
+// The shape of the object is the same regardless of the flags, so that it
+// can be relied upon by scripts. The lists not asked for are null.
+type lsJSONOutput struct {
+	Devices []vm.BlockDevice   `json:"devices"`
+	RAID    []raidArrayListing `json:"raid"`
+
+	ZFS   []zfsPoolListing    `json:"zfs"`
+	Btrfs []btrfsListing      `json:"btrfs"`
+	LVM   []vm.LVMVolumeGroup `json:"lvm"`
+}
+
+func newLsJSONOutput(devs []vm.BlockDevice, raidArrays []vm.RAIDArray, zfsPools []zfsPoolListing, btrfsFilesystems []btrfsListing, lvmVGs []vm.LVMVolumeGroup) lsJSONOutput {
+	ret := lsJSONOutput{
+		Devices: devs,
+		RAID:    make([]raidArrayListing, 0, len(raidArrays)),
+	}
+
+	if ret.Devices == nil {
+		ret.Devices = []vm.BlockDevice{}
+	}
+
+	for _, a := range raidArrays {
+		ret.RAID = append(ret.RAID, raidArrayListing{
+			RAIDArray: a,
+			Active:    a.Active(),
+			Degraded:  a.Degraded(),
+		})
+	}
+
+	if lsZFSFlag {
+		ret.ZFS = zfsPools
+		if ret.ZFS == nil {
+			ret.ZFS = []zfsPoolListing{}
+		}
+	}
+
+	if lsBtrfsFlag {
+		ret.Btrfs = btrfsFilesystems
+		if ret.Btrfs == nil {
+			ret.Btrfs = []btrfsListing{}
+		}
+	}
+
+	if lsLVMFlag {
+		ret.LVM = lvmVGs
+		if ret.LVM == nil {
+			ret.LVM = []vm.LVMVolumeGroup{}
+		}
+	}
+
+	return ret
+}
+
+func printBlockDeviceTree(w io.Writer, devs []vm.BlockDevice, raidArrays []vm.RAIDArray) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tSIZE\tTYPE\tFSTYPE\tLABEL\tNOTE")
+
+	raidArraysByName := make(map[string]vm.RAIDArray)
+	for _, a := range raidArrays {
+		raidArraysByName[a.Name] = a
+	}
+
+	var haveLUKS, haveLVMPV, haveZFS, haveDegradedRAID, haveBtrfs bool
+
+	var walk func(devs []vm.BlockDevice, prefix string, root bool)
+	walk = func(devs []vm.BlockDevice, prefix string, root bool) {
+		for i, dev := range devs {
+			last := i == len(devs)-1
+
+			branch, childPrefix := "├─", prefix+"│ "
+			if last {
+				branch, childPrefix = "└─", prefix+"  "
+			}
+
+			if root {
+				branch, childPrefix = "", ""
+			}
+
+			var notes []string
+			if dev.IsLUKS() {
+				notes = append(notes, "LUKS container")
+				haveLUKS = true
+			}
+
+			if dev.DetectedEncryption() == vm.EncryptionBitLocker {
+				notes = append(notes, "BitLocker volume")
+			}
+
+			if dev.IsLVMPV() {
+				notes = append(notes, "LVM physical volume")
+				haveLVMPV = true
+			}
+
+			if dev.IsRAIDMember() {
+				notes = append(notes, "RAID member")
+			}
+
+			if a, ok := raidArraysByName[dev.Name]; ok && dev.IsRAIDArray() && a.Degraded() {
+				notes = append(notes, fmt.Sprintf("degraded, %v of %v devices missing", a.MissingDevices, a.Devices))
+				haveDegradedRAID = true
+			}
+
+			if dev.IsZFSMember() {
+				notes = append(notes, "ZFS pool member")
+				haveZFS = true
+			}
+
+			if dev.FSType == vm.FSTypeBtrfs {
+				haveBtrfs = true
+			}
+
+			if dev.ReadOnly {
+				notes = append(notes, "read-only")
+			}
+
+			fmt.Fprintf(tw, "%v%v\t%v\t%v\t%v\t%v\t%v\n", prefix+branch, dev.Name, humanize.IBytes(dev.Size), dev.Type, dev.FSType, dev.Label, strings.Join(notes, ", "))
+
+			walk(dev.Children, childPrefix, false)
+		}
+	}
+
+	walk(devs, "", true)
+
+	_ = tw.Flush()
+
+	if haveLUKS {
+		fmt.Fprintln(w, "\nLUKS containers can be opened with --luks (-l) when they hold a file system, or with --luks-container when they hold an LVM volume group.")
+	}
+
+	if haveLVMPV {
+		fmt.Fprintln(w, "\nLogical volumes of LVM physical volumes are available under mapper/<vg name>-<lv name>. The volume groups can be listed with --lvm.")
+	}
+
+	if haveDegradedRAID {
+		fmt.Fprintln(w, "\nDegraded RAID arrays have reduced or no redundancy. Consider replacing the missing devices before writing to them.")
+	}
+
+	if haveZFS && !lsZFSFlag {
+		fmt.Fprintln(w, "\nZFS pools can be listed with --zfs and mounted with --zfs in 'linsk run'.")
+	}
+
+	if haveBtrfs && !lsBtrfsFlag {
+		fmt.Fprintln(w, "\nBtrfs subvolumes and snapshots can be listed with --btrfs and mounted with --btrfs-subvol or --btrfs-subvolumes in 'linsk run'.")
+	}
+}
+
+type zfsPoolListing struct {
+	Name     string          `json:"name"`
+	Datasets []vm.ZFSDataset `json:"datasets"`
+}
+
+// Pools are imported read-only. The ones which fail to import are skipped.
+func listZFSPools(fm *vm.FileManager) ([]zfsPoolListing, error) {
+	pools, err := fm.ZFSImportablePools()
+	if err != nil {
+		return nil, errors.Wrap(err, "get importable zfs pools")
+	}
+
+	ret := []zfsPoolListing{}
+
+	for _, pool := range pools {
+		err = fm.ZFSImport(pool, false, false)
+		if err != nil {
+			slog.Warn("Failed to import ZFS pool, skipping", "pool", pool, "error", err.Error())
+			continue
+		}
+
+		datasets, err := fm.ZFSListDatasets(pool)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list datasets of pool '%v'", pool)
+		}
+
+		ret = append(ret, zfsPoolListing{
+			Name:     pool,
+			Datasets: datasets,
+		})
+	}
+
+	return ret, nil
+}
+
+func printZFSPools(w io.Writer, pools []zfsPoolListing) {
+	fmt.Fprintln(w)
+
+	if len(pools) == 0 {
+		fmt.Fprintln(w, "<no zfs pools found>")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "DATASET\tUSED\tAVAIL\tENCRYPTION\tNOTE")
+
+	for _, pool := range pools {
+		for _, ds := range pool.Datasets {
+			var notes []string
+			if ds.KeyStatus == "unavailable" {
+				notes = append(notes, "key not loaded")
+			}
+
+			if ds.CanMount == "off" {
+				notes = append(notes, "not mountable")
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", ds.Name, humanize.IBytes(ds.Used), humanize.IBytes(ds.Available), ds.Encryption, strings.Join(notes, ", "))
+		}
+	}
+
+	_ = tw.Flush()
+}
+
+type btrfsListing struct {
+	DevName    string              `json:"dev_name"`
+	UUID       string              `json:"uuid"`
+	Label      string              `json:"label,omitempty"`
+	Subvolumes []vm.BtrfsSubvolume `json:"subvolumes"`
+}
+
+// The devices of multi-device file systems share the same UUID, so each file system is listed once.
+func listBtrfsSubvolumes(fm *vm.FileManager, devs []vm.BlockDevice) ([]btrfsListing, error) {
+	ret := []btrfsListing{}
+	seen := make(map[string]bool)
+
+	var btrfsDevs []vm.BlockDevice
+	for _, dev := range vm.GetMountCandidates(devs) {
+		if dev.FSType == vm.FSTypeBtrfs && !seen[dev.UUID] {
+			seen[dev.UUID] = true
+			btrfsDevs = append(btrfsDevs, dev)
+		}
+	}
+
+	for _, dev := range btrfsDevs {
+		subvols, err := fm.BtrfsSubvolumes(dev.DevName())
+		if err != nil {
+			return nil, errors.Wrapf(err, "list subvolumes of '%v'", dev.DevName())
+		}
+
+		ret = append(ret, btrfsListing{
+			DevName:    dev.DevName(),
+			UUID:       dev.UUID,
+			Label:      dev.Label,
+			Subvolumes: subvols,
+		})
+	}
+
+	return ret, nil
+}
+
+func printBtrfsSubvolumes(w io.Writer, filesystems []btrfsListing) {
+	if len(filesystems) == 0 {
+		fmt.Fprintln(w, "\n<no btrfs file systems found>")
+		return
+	}
+
+	for _, fs := range filesystems {
+		fmt.Fprintln(w)
+
+		header := "Btrfs subvolumes of " + fs.DevName
+		if fs.Label != "" {
+			header += " (" + fs.Label + ")"
+		}
+
+		fmt.Fprintln(w, header+":")
+
+		if len(fs.Subvolumes) == 0 {
+			fmt.Fprintln(w, "<no subvolumes found>")
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+		fmt.Fprintln(tw, "ID\tPATH\tTYPE\tCREATED\tNOTE")
+
+		for _, subvol := range fs.Subvolumes {
+			typ := "subvolume"
+			if subvol.Snapshot {
+				typ = "snapshot"
+			}
+
+			var notes []string
+			if subvol.ReadOnly {
+				notes = append(notes, "read-only")
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", subvol.ID, subvol.Path, typ, subvol.CreatedAt, strings.Join(notes, ", "))
+		}
+
+		_ = tw.Flush()
+	}
+}
+
+func printLVMVolumeGroups(w io.Writer, vgs []vm.LVMVolumeGroup) {
+	fmt.Fprintln(w)
+
+	if len(vgs) == 0 {
+		fmt.Fprintln(w, "<no lvm volume groups found>")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "VG/LV\tSIZE\tTYPE\tDEVICE\tNOTE")
+
+	var haveDuplicates bool
+
+	for _, vg := range vgs {
+		notes := []string{humanize.IBytes(vg.Free) + " free"}
+		if vg.DuplicateName {
+			notes = append(notes, "duplicate name, uuid "+vg.UUID)
+			haveDuplicates = true
+		}
+
+		if vg.ActiveName != "" && vg.ActiveName != vg.Name {
+			notes = append(notes, "active as "+vg.ActiveName)
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", vg.Name, humanize.IBytes(vg.Size), "vg", strings.Join(vg.PhysicalVolumes, ","), strings.Join(notes, ", "))
+
+		for i, lv := range vg.LogicalVolumes {
+			branch := "├─"
+			if i == len(vg.LogicalVolumes)-1 {
+				branch = "└─"
+			}
+
+			var notes []string
+			if lv.Pool != "" {
+				notes = append(notes, "pool "+lv.Pool)
+			}
+
+			if lv.Origin != "" {
+				notes = append(notes, "snapshot of "+lv.Origin)
+			}
+
+			devName := lv.DevName
+			if !lv.Active {
+				devName = ""
+				notes = append(notes, "inactive")
+			}
+
+			fmt.Fprintf(tw, "%v%v\t%v\t%v\t%v\t%v\n", branch, lv.Name, humanize.IBytes(lv.Size), lv.Type, devName, strings.Join(notes, ", "))
+		}
+	}
+
+	_ = tw.Flush()
+
+	if haveDuplicates {
+		fmt.Fprintln(w, "\nOnly one of the volume groups with the same name is activated by default. Pick one with --lvm-activate uuid=<uuid>, or activate all of them under different names with --lvm-rename-duplicates.")
+	}
+}
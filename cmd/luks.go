@@ -0,0 +1,396 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/AlexSSD7/linsk/share"
+	"github.com/AlexSSD7/linsk/vm"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var luksCmd = &cobra.Command{
+	Use:   "luks",
+	Short: "Start a VM and manage the keys and the header of a LUKS device.",
+}
+
+var luksDumpCmd = &cobra.Command{
+	Use:   "dump <passthrough> <vm device>",
+	Short: "Print the information from the LUKS header, including the keyslots in use.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			info, err := fm.LUKSDump(devName)
+			if err != nil {
+				slog.Error("Failed to dump LUKS header", "error", err.Error())
+				return 1
+			}
+
+			if luksJSONFlag {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+
+				err = enc.Encode(info)
+				if err != nil {
+					slog.Error("Failed to encode LUKS header information", "error", err.Error())
+					return 1
+				}
+
+				return 0
+			}
+
+			printLUKSHeaderInfo(info)
+
+			return 0
+		}))
+	},
+}
+
+var luksAddKeyCmd = &cobra.Command{
+	Use:   "add-key <passthrough> <vm device>",
+	Short: "Add a new password or keyfile to a LUKS device. An existing password is required.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitIfLUKSReadOnly()
+
+		newSecret := getNewLUKSSecretOrExit()
+
+		ret := runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			err := fm.LUKSAddKey(devName, newSecret, luksSlotFlag, nil)
+			if err != nil {
+				slog.Error("Failed to add LUKS key", "error", err.Error())
+				return 1
+			}
+
+			slog.Info("Added LUKS key")
+
+			return 0
+		})
+
+		newSecret.Wipe()
+		os.Exit(ret)
+	},
+}
+
+var luksChangeKeyCmd = &cobra.Command{
+	Use:   "change-key <passthrough> <vm device>",
+	Short: "Replace an existing password or keyfile of a LUKS device with a new one.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitIfLUKSReadOnly()
+
+		newSecret := getNewLUKSSecretOrExit()
+
+		ret := runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			err := fm.LUKSChangeKey(devName, newSecret, luksSlotFlag, nil)
+			if err != nil {
+				slog.Error("Failed to change LUKS key", "error", err.Error())
+				return 1
+			}
+
+			slog.Info("Changed LUKS key")
+
+			return 0
+		})
+
+		newSecret.Wipe()
+		os.Exit(ret)
+	},
+}
+
+var luksRemoveKeyCmd = &cobra.Command{
+	Use:   "remove-key <passthrough> <vm device>",
+	Short: "Remove a password or keyfile from a LUKS device. With --slot, the keyslot is wiped, and the password of any other keyslot is required.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitIfLUKSReadOnly()
+
+		os.Exit(runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			var err error
+			if luksSlotFlag == vm.LUKSAnyKeyslot {
+				err = fm.LUKSRemoveKey(devName, nil)
+			} else {
+				err = fm.LUKSKillSlot(devName, luksSlotFlag, nil)
+			}
+
+			if err != nil {
+				slog.Error("Failed to remove LUKS key", "error", err.Error())
+				return 1
+			}
+
+			slog.Info("Removed LUKS key")
+
+			return 0
+		}))
+	},
+}
+
+var luksBackupHeaderCmd = &cobra.Command{
+	Use:   "backup-header <passthrough> <vm device> <host file>",
+	Short: "Back up the LUKS header to a file on the host. Anyone with the backup and a password valid at the time of the backup can access the data.",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		backupPath := filepath.Clean(args[2])
+
+		_, err := os.Stat(backupPath)
+		if err == nil {
+			slog.Error("The header backup file already exists", "path", backupPath)
+			os.Exit(1)
+		}
+
+		os.Exit(runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			f, err := os.OpenFile(backupPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				slog.Error("Failed to create the header backup file", "error", err.Error())
+				return 1
+			}
+
+			err = fm.LUKSHeaderBackup(devName, f)
+			err2 := f.Close()
+			if err == nil && err2 != nil {
+				err = errors.Wrap(err2, "close header backup file")
+			}
+
+			if err != nil {
+				slog.Error("Failed to back up LUKS header", "error", err.Error())
+
+				// A partial backup is worse than no backup.
+				_ = os.Remove(backupPath)
+
+				return 1
+			}
+
+			slog.Info("Backed up LUKS header", "path", backupPath)
+
+			return 0
+		}))
+	},
+}
+
+var luksRestoreHeaderCmd = &cobra.Command{
+	Use:   "restore-header <passthrough> <vm device> <host file>",
+	Short: "Restore the LUKS header from a backup on the host. The passwords added after the backup was made will stop working.",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitIfLUKSReadOnly()
+
+		backupPath := filepath.Clean(args[2])
+
+		f, err := os.Open(backupPath)
+		if err != nil {
+			slog.Error("Failed to open the header backup file", "error", err.Error())
+			os.Exit(1)
+		}
+
+		confirmOrExit("Will overwrite the LUKS header of '"+args[1]+"' with '"+backupPath+"'.", luksYesFlag)
+
+		os.Exit(runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			defer func() { _ = f.Close() }()
+
+			err := fm.LUKSHeaderRestore(devName, f)
+			if err != nil {
+				slog.Error("Failed to restore LUKS header", "error", err.Error())
+				return 1
+			}
+
+			slog.Info("Restored LUKS header", "path", backupPath)
+
+			return 0
+		}))
+	},
+}
+
+var luksConvertCmd = &cobra.Command{
+	Use:   "convert <passthrough> <vm device> <luks1|luks2>",
+	Short: "Convert a LUKS device between LUKS1 and LUKS2. It is strongly advised to back up the header first.",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitIfLUKSReadOnly()
+
+		var version int
+		switch args[2] {
+		case "luks1":
+			version = 1
+		case "luks2":
+			version = 2
+		default:
+			slog.Error("Unknown LUKS version, expected luks1 or luks2", "value", args[2])
+			os.Exit(1)
+		}
+
+		confirmOrExit("Will convert the LUKS header of '"+args[1]+"' to "+args[2]+".", luksYesFlag)
+
+		os.Exit(runLUKSCmd(args, func(fm *vm.FileManager, devName string) int {
+			err := fm.LUKSConvert(devName, version)
+			if err != nil {
+				slog.Error("Failed to convert LUKS header", "error", err.Error())
+				return 1
+			}
+
+			slog.Info("Converted LUKS header", "version", args[2])
+
+			return 0
+		}))
+	},
+}
+
+var (
+	luksJSONFlag              bool
+	luksSlotFlag              int
+	luksNewKeyfileFlag        string
+	luksNewPassphraseFileFlag string
+	luksYesFlag               bool
+)
+
+func init() {
+	luksCmd.AddCommand(luksDumpCmd)
+	luksCmd.AddCommand(luksAddKeyCmd)
+	luksCmd.AddCommand(luksChangeKeyCmd)
+	luksCmd.AddCommand(luksRemoveKeyCmd)
+	luksCmd.AddCommand(luksBackupHeaderCmd)
+	luksCmd.AddCommand(luksRestoreHeaderCmd)
+	luksCmd.AddCommand(luksConvertCmd)
+
+	luksDumpCmd.Flags().BoolVar(&luksJSONFlag, "json", false, "Print the LUKS header information in the JSON format.")
+
+	luksAddKeyCmd.Flags().IntVar(&luksSlotFlag, "slot", vm.LUKSAnyKeyslot, "Specifies the keyslot to put the new key in. The first free one is used by default.")
+	luksChangeKeyCmd.Flags().IntVar(&luksSlotFlag, "slot", vm.LUKSAnyKeyslot, "Specifies the keyslot of the key to change. The existing password is matched against all keyslots by default.")
+	luksRemoveKeyCmd.Flags().IntVar(&luksSlotFlag, "slot", vm.LUKSAnyKeyslot, "Wipe the specified keyslot instead of removing the key matching the entered password.")
+
+	for _, c := range []*cobra.Command{luksAddKeyCmd, luksChangeKeyCmd} {
+		c.Flags().StringVar(&luksNewKeyfileFlag, "new-keyfile", "", "Use the specified keyfile as the new key instead of prompting for a new password.")
+		c.Flags().StringVar(&luksNewPassphraseFileFlag, "new-passphrase-file", "", "Read the new password from the specified file instead of prompting for it. A trailing newline is ignored.")
+	}
+
+	for _, c := range []*cobra.Command{luksRestoreHeaderCmd, luksConvertCmd} {
+		c.Flags().BoolVarP(&luksYesFlag, "yes", "y", false, "Do not ask for confirmation.")
+	}
+
+	initLUKSSecretFlags(luksCmd.PersistentFlags())
+	initPassthroughFlags(luksCmd.PersistentFlags())
+}
+
+// runLUKSCmd runs the VM with the passthrough in args[0]
+// and calls fn with the in-VM device name in args[1].
+func runLUKSCmd(args []string, fn func(fm *vm.FileManager, devName string) int) int {
+	enableLUKSMemoryGrowth()
+
+	secretSource := getLUKSSecretSource()
+	if secretSource == nil {
+		secretSource = vm.TerminalLUKSSecretSource{Prompt: "Enter an existing password: "}
+	}
+
+	return runVM(args[:1], func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
+		fm.SetLUKSSecretSource(secretSource)
+		fm.SetLUKSMaxAttempts(int(vmRuntimeLUKSAttemptsFlag))
+
+		return fn(fm, args[1])
+	}, nil, false, false)
+}
+
+func exitIfLUKSReadOnly() {
+	if readOnlyFlag {
+		slog.Error("This LUKS operation writes to the device and is not allowed in read-only mode")
+		os.Exit(1)
+	}
+}
+
+func getNewLUKSSecretOrExit() *vm.LUKSSecret {
+	secret, err := getNewLUKSSecret()
+	if err != nil {
+		slog.Error("Failed to get the new LUKS key", "error", err.Error())
+		os.Exit(1)
+	}
+
+	return secret
+}
+
+func getNewLUKSSecret() (*vm.LUKSSecret, error) {
+	switch {
+	case luksNewKeyfileFlag != "" && luksNewPassphraseFileFlag != "":
+		return nil, fmt.Errorf("only one of --new-keyfile and --new-passphrase-file can be specified at once")
+	case luksNewKeyfileFlag != "":
+		return vm.KeyfileLUKSSecretSource{Path: luksNewKeyfileFlag}.GetLUKSSecret(vm.LUKSSecretRequest{Attempt: 1})
+	case luksNewPassphraseFileFlag != "":
+		return vm.PassphraseFileLUKSSecretSource{Path: luksNewPassphraseFileFlag}.GetLUKSSecret(vm.LUKSSecretRequest{Attempt: 1})
+	}
+
+	if !term.IsTerminal(int(syscall.Stdin)) { //nolint:unconvert // On Windows it's a different non-int type.
+		return nil, fmt.Errorf("stdin is not a terminal, please use --new-keyfile or --new-passphrase-file")
+	}
+
+	newSecret, err := vm.TerminalLUKSSecretSource{Prompt: "Enter a new password: "}.GetLUKSSecret(vm.LUKSSecretRequest{Attempt: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	confirmSecret, err := vm.TerminalLUKSSecretSource{Prompt: "Repeat the new password: "}.GetLUKSSecret(vm.LUKSSecretRequest{Attempt: 1})
+	if err != nil {
+		newSecret.Wipe()
+		return nil, err
+	}
+
+	defer confirmSecret.Wipe()
+
+	if len(newSecret.Passphrase) == 0 {
+		return nil, fmt.Errorf("the new password is empty")
+	}
+
+	if !bytes.Equal(newSecret.Passphrase, confirmSecret.Passphrase) {
+		newSecret.Wipe()
+		return nil, fmt.Errorf("the passwords do not match")
+	}
+
+	return newSecret, nil
+}
+
+func printLUKSHeaderInfo(info *vm.LUKSHeaderInfo) {
+	fmt.Printf("Version: LUKS%v\n", info.Version)
+	fmt.Printf("UUID:    %v\n", info.UUID)
+
+	if info.Label != "" {
+		fmt.Printf("Label:   %v\n", info.Label)
+	}
+
+	fmt.Printf("Cipher:  %v\n\n", info.Cipher)
+
+	if len(info.Keyslots) == 0 {
+		fmt.Printf("<no keyslots in use>\n")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "SLOT\tTYPE\tCIPHER\tPBKDF")
+
+	for _, ks := range info.Keyslots {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", ks.ID, ks.Type, ks.Cipher, ks.PBKDF)
+	}
+
+	_ = tw.Flush()
+}
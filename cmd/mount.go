@@ -0,0 +1,142 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/AlexSSD7/linsk/vm"
+)
+
+type mountSpec struct {
+	DevName string
+	Config  vm.MountConfig
+}
+
+var mountSpecOptionKeys = []string{"name", "fs", "luks", "encryption", "mapper", "options", "subvol", "subvolumes"}
+
+// Reports whether s starts with one of the spec options, which is either a
+// known key on its own or followed by "=". Option values can contain colons.
+func startsWithSpecOption(s string, keys []string) bool {
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(s, key)
+		if ok && (rest == "" || rest[0] == '=' || rest[0] == ':') {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Splits the spec at the colons followed by one of the options. The other colons
+// are kept, as they may be a part of a device selector value, like a label, or of
+// the mount options, like SELinux contexts.
+func splitSpec(val string, keys []string) []string {
+	var ret []string
+
+	start := 0
+	for i := 0; i < len(val); i++ {
+		if val[i] == ':' && startsWithSpecOption(val[i+1:], keys) {
+			ret = append(ret, val[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(ret, val[start:])
+}
+
+// Device names have no colons, unlike selectors. A colon in a device name
+// means that what follows it was meant to be an option.
+func checkSpecDevName(devName string) error {
+	if devName == "" {
+		return fmt.Errorf("empty device name")
+	}
+
+	if _, _, isSelector := vm.ParseDevSelector(devName); !isSelector {
+		if _, option, ok := strings.Cut(devName, ":"); ok {
+			return fmt.Errorf("unknown option '%v'", option)
+		}
+	}
+
+	return nil
+}
+
+// parseMountSpec parses the value of the --mount flag. The syntax is
+// "<vm dev>[:name=<name>][:fs=<fs type>][:luks[=<mapper name>]][:encryption=<type>][:mapper=<mapper name>][:options=<mount options>][:subvol=<btrfs subvolume>][:subvolumes]",
+// where the device can also be a "uuid=", "label=" or "partlabel=" selector.
+// Colons are used as separators as mount options contain commas.
+func parseMountSpec(val string) (mountSpec, error) {
+	split := splitSpec(val, mountSpecOptionKeys)
+
+	spec := mountSpec{
+		DevName: split[0],
+	}
+
+	err := checkSpecDevName(spec.DevName)
+	if err != nil {
+		return mountSpec{}, err
+	}
+
+	for _, item := range split[1:] {
+		key, value, _ := strings.Cut(item, "=")
+
+		switch key {
+		case "name":
+			spec.Config.Name = value
+		case "fs":
+			spec.Config.FSTypeOverride = value
+		case "luks":
+			spec.Config.LUKS = true
+			spec.Config.MapperName = value
+		case "encryption":
+			et, err := vm.ParseEncryptionType(value)
+			if err != nil {
+				return mountSpec{}, err
+			}
+
+			spec.Config.Encryption = et
+		case "mapper":
+			spec.Config.MapperName = value
+		case "options":
+			spec.Config.MountOptions = value
+		case "subvol":
+			spec.Config.BtrfsSubvolume = value
+		case "subvolumes":
+			spec.Config.BtrfsAllSubvolumes = true
+		default:
+			return mountSpec{}, fmt.Errorf("unknown mount option '%v'", key)
+		}
+	}
+
+	if spec.Config.Name == "" {
+		defaultName := path.Base(spec.DevName)
+		if _, value, ok := vm.ParseDevSelector(spec.DevName); ok {
+			defaultName = value
+		}
+
+		// Labels and UUIDs don't always make valid mount names as they are.
+		spec.Config.Name = utils.SanitizeMountName(defaultName)
+		if spec.Config.Name == "" {
+			return mountSpec{}, fmt.Errorf("cannot make a mount name out of '%v', please specify one with ':name=<name>'", defaultName)
+		}
+	}
+
+	return spec, nil
+}
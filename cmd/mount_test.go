@@ -0,0 +1,129 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AlexSSD7/linsk/vm"
+)
+
+func TestParseMountSpec(t *testing.T) {
+	for _, tc := range []struct {
+		val     string
+		devName string
+		config  vm.MountConfig
+		wantErr bool
+	}{
+		{
+			val:     "vdb1",
+			devName: "vdb1",
+			config:  vm.MountConfig{Name: "vdb1"},
+		},
+		{
+			val:     "mapper/vg-lv:name=root:luks=cryptroot:options=noatime,nodev",
+			devName: "mapper/vg-lv",
+			config:  vm.MountConfig{Name: "root", LUKS: true, MapperName: "cryptroot", MountOptions: "noatime,nodev"},
+		},
+		{
+			val:     "label=backup:2023:name=backup:subvolumes",
+			devName: "label=backup:2023",
+			config:  vm.MountConfig{Name: "backup", BtrfsAllSubvolumes: true},
+		},
+		{
+			val:     "partlabel=a:b",
+			devName: "partlabel=a:b",
+			config:  vm.MountConfig{Name: "a_b"},
+		},
+		{
+			val:     "uuid=0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10",
+			devName: "uuid=0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10",
+			config:  vm.MountConfig{Name: "0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c"},
+		},
+		{
+			val:     "label=My Disk",
+			devName: "label=My Disk",
+			config:  vm.MountConfig{Name: "My_Disk"},
+		},
+		{
+			val:     "label=.Données",
+			devName: "label=.Données",
+			config:  vm.MountConfig{Name: "Donn_es"},
+		},
+		{
+			val:     "label=My Disk:name=disk",
+			devName: "label=My Disk",
+			config:  vm.MountConfig{Name: "disk"},
+		},
+		{
+			val:     "mapper/vg--data-lv",
+			devName: "mapper/vg--data-lv",
+			config:  vm.MountConfig{Name: "vg--data-lv"},
+		},
+		{
+			// Nothing is left to make a name of.
+			val:     "label=***",
+			wantErr: true,
+		},
+		{
+			// Reserved by the file share servers.
+			val:     "label=Homes",
+			wantErr: true,
+		},
+		{
+			val:     "vdb2:options=context=system_u:object_r:fs_t:s0:fs=ext4",
+			devName: "vdb2",
+			config:  vm.MountConfig{Name: "vdb2", MountOptions: "context=system_u:object_r:fs_t:s0", FSTypeOverride: "ext4"},
+		},
+		{
+			val:     "vdb1:subvol=@home",
+			devName: "vdb1",
+			config:  vm.MountConfig{Name: "vdb1", BtrfsSubvolume: "@home"},
+		},
+		{
+			val:     "vdb1:unknown",
+			wantErr: true,
+		},
+		{
+			val:     ":name=root",
+			wantErr: true,
+		},
+	} {
+		spec, err := parseMountSpec(tc.val)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: want an error", tc.val)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tc.val, err)
+			continue
+		}
+
+		if spec.DevName != tc.devName {
+			t.Errorf("%q: want device name %q, have %q", tc.val, tc.devName, spec.DevName)
+		}
+
+		if !reflect.DeepEqual(spec.Config, tc.config) {
+			t.Errorf("%q: want config %+v, have %+v", tc.val, tc.config, spec.Config)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/qemuimg"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+const (
+	overlayActionAsk     = "ask"
+	overlayActionDiscard = "discard"
+	overlayActionKeep    = "keep"
+	overlayActionCommit  = "commit"
+)
+
+type sessionOverlay struct {
+	BackingPath string
+	OverlayPath string
+}
+
+// extractPassthroughOption removes a valueless option from the comma-separated
+// passthrough value and reports whether it was present. The first item is
+// always the path, so it is never treated as an option.
+func extractPassthroughOption(val string, opt string) (string, bool) {
+	split := strings.Split(val, ",")
+
+	var found bool
+
+	ret := split[:1]
+	for _, item := range split[1:] {
+		if item == opt {
+			found = true
+			continue
+		}
+
+		ret = append(ret, item)
+	}
+
+	return strings.Join(ret, ","), found
+}
+
+func checkOverlayActionFlag() error {
+	switch overlayActionFlag {
+	case overlayActionAsk, overlayActionDiscard, overlayActionKeep, overlayActionCommit:
+		return nil
+	default:
+		return fmt.Errorf("unknown overlay action '%v'", overlayActionFlag)
+	}
+}
+
+func askOverlayAction(o sessionOverlay) string {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		slog.Warn("Cannot ask what to do with the overlay as stdin is not a terminal, keeping it", "path", o.OverlayPath)
+		return overlayActionKeep
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Fprintf(os.Stderr, "The changes made to '%v' are stored in the overlay '%v'.\nWhat should be done with them? (discard/keep/commit) > ", o.BackingPath, o.OverlayPath)
+
+		answer, err := reader.ReadBytes('\n')
+		if err != nil {
+			slog.Error("Failed to read answer, keeping the overlay", "error", err.Error())
+			return overlayActionKeep
+		}
+
+		action := utils.ClearUnprintableChars(strings.ToLower(strings.TrimSpace(string(answer))), false)
+		switch action {
+		case overlayActionDiscard, overlayActionKeep, overlayActionCommit:
+			return action
+		}
+
+		fmt.Fprintf(os.Stderr, "Unknown answer '%v'.\n", action)
+	}
+}
+
+func finishOverlay(o sessionOverlay, action string) error {
+	lg := slog.With("path", o.OverlayPath, "backing-path", o.BackingPath)
+
+	switch action {
+	case overlayActionDiscard:
+		err := os.Remove(o.OverlayPath)
+		if err != nil {
+			return errors.Wrap(err, "remove overlay")
+		}
+
+		lg.Info("Discarded the overlay")
+	case overlayActionKeep:
+		lg.Info("Kept the overlay. You can attach it again with the 'img:' passthrough type.")
+	case overlayActionCommit:
+		lg.Info("Committing the overlay, this may take a while")
+
+		err := qemuimg.Commit(context.Background(), o.OverlayPath, os.Stderr)
+		if err != nil {
+			return errors.Wrap(err, "commit overlay")
+		}
+
+		err = os.Remove(o.OverlayPath)
+		if err != nil {
+			return errors.Wrap(err, "remove committed overlay")
+		}
+
+		lg.Info("Committed the overlay")
+	default:
+		return fmt.Errorf("unknown overlay action '%v'", action)
+	}
+
+	return nil
+}
+
+// finishOverlays applies the end-of-session action to every overlay.
+// Returns false if any of them failed.
+func finishOverlays(overlays []sessionOverlay, action string) bool {
+	ok := true
+
+	for _, o := range overlays {
+		oAction := action
+		if oAction == overlayActionAsk {
+			oAction = askOverlayAction(o)
+		}
+
+		err := finishOverlay(o, oAction)
+		if err != nil {
+			slog.Error("Failed to finish the overlay", "error", err.Error(), "path", o.OverlayPath, "action", oAction)
+			ok = false
+		}
+	}
+
+	return ok
+}
@@ -17,7 +17,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 
@@ -47,14 +46,19 @@ var (
 	vmDebugFlag                bool
 	unrestrictedNetworkingFlag bool
 	vmMemAllocFlag             uint32
+	vmMemMaxFlag               uint32
 	vmSSHSetupTimeoutFlag      uint32
 	vmOSUpTimeoutFlag          uint32
+	vmShutdownTimeoutFlag      uint32
 	dataDirFlag                string
 )
 
 const (
-	defaultMemAlloc     = 512
-	defaultMemAllocLUKS = 2048
+	defaultMemAlloc = 512
+
+	// This is enough for the default LUKS2 key derivation memory cost (1 GiB)
+	// with plenty to spare. The VM is grown up to this only when needed.
+	defaultMemMax = 4096
 )
 
 func init() {
@@ -63,6 +67,8 @@ func init() {
 	rootCmd.AddCommand(lsCmd)
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(shellCmd)
+	rootCmd.AddCommand(luksCmd)
+	rootCmd.AddCommand(fsckCmd)
 	rootCmd.AddCommand(cleanCmd)
 	rootCmd.AddCommand(buildCmd)
 	rootCmd.AddCommand(versionCmd)
@@ -70,9 +76,11 @@ func init() {
 
 	rootCmd.PersistentFlags().BoolVar(&vmDebugFlag, "vm-debug", false, "Enables the VM debug mode. This will open an accessible VM monitor and enable direct QEMU command log passthrough. You can log in with root user and no password.")
 	rootCmd.PersistentFlags().BoolVar(&unrestrictedNetworkingFlag, "vm-unrestricted-networking", false, "Enables unrestricted networking. This will allow the VM to connect to the internet.")
-	rootCmd.PersistentFlags().Uint32Var(&vmMemAllocFlag, "vm-mem-alloc", defaultMemAlloc, fmt.Sprintf("Specifies the VM memory allocation in KiB. (the default is %v in LUKS mode)", defaultMemAllocLUKS))
+	rootCmd.PersistentFlags().Uint32Var(&vmMemAllocFlag, "vm-mem-alloc", defaultMemAlloc, "Specifies the VM memory allocation in MiB.")
+	rootCmd.PersistentFlags().Uint32Var(&vmMemMaxFlag, "vm-mem-max", defaultMemMax, "Specifies the memory in MiB the VM can be grown to when LUKS devices need more memory to be opened than allocated. The memory is given back once the device is opened. Set to 0 to disable growing.")
 	rootCmd.PersistentFlags().Uint32Var(&vmOSUpTimeoutFlag, "vm-os-up-timeout", 30, "Specifies the VM OS-up timeout in seconds.")
 	rootCmd.PersistentFlags().Uint32Var(&vmSSHSetupTimeoutFlag, "vm-ssh-setup-timeout", 60, "Specifies the VM SSH server setup timeout in seconds. This cannot be lower than the OS-up timeout.")
+	rootCmd.PersistentFlags().Uint32Var(&vmShutdownTimeoutFlag, "vm-shutdown-timeout", 15, "Specifies the time in seconds given to the VM to shut down gracefully before it is terminated forcefully.")
 
 	defaultDataDir := "linsk-data-dir"
 
@@ -35,20 +35,106 @@ var runCmd = &cobra.Command{
 	Short: "Start a VM and expose an FTP file share.",
 	Args:  cobra.RangeArgs(1, 3),
 	Run: func(cmd *cobra.Command, args []string) {
-		configureVMRuntimeFlags()
+		var mounts []mountSpec
+
+		encryption, err := vm.ParseEncryptionType(encryptionFlag)
+		if err != nil {
+			slog.Error("Failed to parse encryption type", "error", err.Error())
+			os.Exit(1)
+		}
+
+		if luksFlag {
+			if encryption != vm.EncryptionNone && encryption != vm.EncryptionLUKS {
+				slog.Error("--luks (-l) cannot be combined with a different --encryption type")
+				os.Exit(1)
+			}
+
+			encryption = vm.EncryptionLUKS
+		}
 
-		vmMountDevName := defaultVMMountDevName
+		veraCrypt := vm.VeraCryptOptions{
+			PIM:    veraCryptPIMFlag,
+			Hidden: veraCryptHiddenFlag,
+		}
+
+		if len(mountFlag) != 0 {
+			if len(args) > 1 || encryption != vm.EncryptionNone || mountOptionsFlag != "" || btrfsSubvolFlag != "" || btrfsSubvolumesFlag {
+				slog.Error("--mount cannot be combined with the in-VM device positional arguments, --luks (-l), --encryption, --mount-options, --btrfs-subvol, or --btrfs-subvolumes")
+				os.Exit(1)
+			}
 
-		if len(args) > 1 {
-			vmMountDevName = args[1]
-		} else if vmRuntimeLUKSContainerDevice != "" {
-			slog.Error("Cannot use the default (entire) device with a LUKS container. Please specify the in-VM device name to mount as a second positional argument.")
+			for _, val := range mountFlag {
+				spec, err := parseMountSpec(val)
+				if err != nil {
+					slog.Error("Failed to parse mount", "value", val, "error", err.Error())
+					os.Exit(1)
+				}
+
+				// This is for the LUKS memory requirements to apply.
+				luksFlag = luksFlag || spec.Config.LUKS || spec.Config.Encryption != vm.EncryptionNone
+
+				spec.Config.VeraCrypt = veraCrypt
+
+				mounts = append(mounts, spec)
+			}
+		}
+
+		if zfsWritableFlag && readOnlyFlag {
+			slog.Error("--zfs-writable cannot be combined with --read-only")
 			os.Exit(1)
 		}
 
-		var fsTypeOverride string
-		if len(args) > 2 {
-			fsTypeOverride = args[2]
+		if btrfsSubvolFlag != "" && btrfsSubvolumesFlag {
+			slog.Error("--btrfs-subvol cannot be combined with --btrfs-subvolumes")
+			os.Exit(1)
+		}
+
+		if zfsFlag != "" && (len(args) > 1 || len(mounts) != 0 || encryption != vm.EncryptionNone || mountOptionsFlag != "" || btrfsSubvolFlag != "" || btrfsSubvolumesFlag) {
+			slog.Error("--zfs cannot be combined with the in-VM device positional arguments, --mount, --luks (-l), --encryption, --mount-options, --btrfs-subvol, or --btrfs-subvolumes")
+			os.Exit(1)
+		}
+
+		configureVMRuntimeFlags()
+
+		if len(mounts) == 0 && zfsFlag == "" {
+			// An empty device name means that it is to be selected automatically.
+			var vmMountDevName string
+			if len(args) > 1 {
+				vmMountDevName = args[1]
+			}
+
+			if vmMountDevName == "" && encryption != vm.EncryptionNone {
+				if encryption != vm.EncryptionLUKS && encryption != vm.EncryptionBitLocker {
+					slog.Error("Only LUKS and BitLocker devices can be detected automatically, please specify the in-VM device name as a second positional argument", "encryption", encryption)
+					os.Exit(1)
+				}
+
+				slog.Info("Encrypted devices are detected automatically when no in-VM device name is specified, ignoring the encryption type")
+				encryption = vm.EncryptionNone
+			}
+
+			var fsTypeOverride string
+			if len(args) > 2 {
+				fsTypeOverride = args[2]
+			}
+
+			mounts = append(mounts, mountSpec{
+				DevName: vmMountDevName,
+				Config: vm.MountConfig{
+					FSTypeOverride: fsTypeOverride,
+					Encryption:     encryption,
+					VeraCrypt:      veraCrypt,
+					MountOptions:   mountOptionsFlag,
+
+					BtrfsSubvolume:     btrfsSubvolFlag,
+					BtrfsAllSubvolumes: btrfsSubvolumesFlag,
+				},
+			})
+		}
+
+		// The LUKS containers need to be opened only once, before anything is mounted.
+		if len(mounts) != 0 {
+			mounts[0].Config.LUKSContainersPreopen = vmRuntimeLUKSContainers
 		}
 
 		newBackendFunc := share.GetBackend(shareBackendFlag)
@@ -74,28 +160,86 @@ var runCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		os.Exit(runVM(args[0], func(ctx context.Context, i *vm.VM, fm *vm.FileManager, tapCtx *share.NetTapRuntimeContext) int {
-			fsToLog := "<auto>"
-			if fsTypeOverride != "" {
-				fsToLog = fsTypeOverride
-			}
+		os.Exit(runVM(append([]string{args[0]}, extraPassthroughFlag...), func(ctx context.Context, i *vm.VM, fm *vm.FileManager, tapCtx *share.NetTapRuntimeContext) int {
+			fm.SetLUKSSecretSource(vmRuntimeLUKSSecretSource)
+			fm.SetLUKSMaxAttempts(int(vmRuntimeLUKSAttemptsFlag))
+
+			fm.SetSeparateShares(separateSharesFlag)
+
+			if zfsFlag != "" {
+				if len(vmRuntimeLUKSContainers) != 0 {
+					err := fm.PreopenLUKSContainers(vmRuntimeLUKSContainers)
+					if err != nil {
+						slog.Error("Failed to preopen LUKS containers", "error", err.Error())
+						return 1
+					}
+				}
 
-			mountOptionsToLog := "<default>"
-			if mountOptionsFlag != "" {
-				mountOptionsToLog = mountOptionsFlag
+				slog.Info("Mounting the ZFS dataset", "dataset", zfsFlag, "mountpoint", "/mnt", "recursive", zfsRecursiveFlag, "writable", zfsWritableFlag)
+
+				err := fm.MountZFS(zfsFlag, vm.ZFSMountConfig{
+					Recursive: zfsRecursiveFlag,
+					Writable:  zfsWritableFlag,
+					Force:     zfsForceFlag,
+				})
+				if err != nil {
+					slog.Error("Failed to mount the ZFS dataset inside the VM", "dataset", zfsFlag, "error", err.Error())
+					return 1
+				}
 			}
 
-			slog.Info("Mounting the device", "dev", vmMountDevName, "fs", fsToLog, "luks", luksFlag, "mountoptions", mountOptionsToLog)
+			for _, m := range mounts {
+				if m.DevName == "" {
+					slog.Info("No in-VM device name specified, selecting the device automatically")
 
-			err := fm.Mount(vmMountDevName, vm.MountConfig{
-				LUKSContainerPreopen: vmRuntimeLUKSContainerDevice,
-				FSTypeOverride:       fsTypeOverride,
-				LUKS:                 luksFlag,
-				MountOptions:         mountOptionsFlag,
-			})
-			if err != nil {
-				slog.Error("Failed to mount the disk inside the VM", "error", err.Error())
-				return 1
+					if len(m.Config.LUKSContainersPreopen) != 0 {
+						err := fm.PreopenLUKSContainers(m.Config.LUKSContainersPreopen)
+						if err != nil {
+							slog.Error("Failed to preopen LUKS containers", "error", err.Error())
+							return 1
+						}
+
+						m.Config.LUKSContainersPreopen = nil
+					}
+
+					devName, err := autoSelectMountDevice(ctx, fm)
+					if err != nil {
+						slog.Error("Failed to select the device to mount automatically. Please specify the in-VM device name as a second positional argument (see 'linsk ls').", "error", err.Error())
+						return 1
+					}
+
+					m.DevName = devName
+				}
+
+				fsToLog := "<auto>"
+				if m.Config.FSTypeOverride != "" {
+					fsToLog = m.Config.FSTypeOverride
+				}
+
+				mountOptionsToLog := "<default>"
+				if m.Config.MountOptions != "" {
+					mountOptionsToLog = m.Config.MountOptions
+				}
+
+				mountPointToLog := "/mnt"
+				if m.Config.Name != "" {
+					mountPointToLog += "/" + m.Config.Name
+				}
+
+				encryptionToLog := string(m.Config.Encryption)
+				if m.Config.LUKS {
+					encryptionToLog = string(vm.EncryptionLUKS)
+				} else if encryptionToLog == "" {
+					encryptionToLog = "<none>"
+				}
+
+				slog.Info("Mounting the device", "dev", m.DevName, "mountpoint", mountPointToLog, "fs", fsToLog, "encryption", encryptionToLog, "mountoptions", mountOptionsToLog)
+
+				err := fm.Mount(m.DevName, m.Config)
+				if err != nil {
+					slog.Error("Failed to mount the disk inside the VM", "dev", m.DevName, "error", err.Error())
+					return 1
+				}
 			}
 
 			sharePWD, err := password.Generate(16, 10, 0, false, false)
@@ -143,17 +287,44 @@ var runCmd = &cobra.Command{
 
 var (
 	luksFlag             bool
+	encryptionFlag       string
+	veraCryptPIMFlag     uint32
+	veraCryptHiddenFlag  bool
 	shareListenIPFlag    string
 	ftpExtIPFlag         string
 	shareBackendFlag     string
 	smbUseExternAddrFlag bool
 	debugShellFlag       bool
 	mountOptionsFlag     string
+	extraPassthroughFlag []string
+	mountFlag            []string
+	separateSharesFlag   bool
+	zfsFlag              string
+	zfsRecursiveFlag     bool
+	zfsWritableFlag      bool
+	zfsForceFlag         bool
+	btrfsSubvolFlag      string
+	btrfsSubvolumesFlag  bool
 )
 
 func init() {
-	runCmd.Flags().BoolVarP(&luksFlag, "luks", "l", false, "Use cryptsetup to open a LUKS volume (password will be prompted).")
+	runCmd.Flags().BoolVarP(&luksFlag, "luks", "l", false, "Use cryptsetup to open a LUKS volume (password will be prompted). This is a shorthand for --encryption luks.")
+	runCmd.Flags().StringVar(&encryptionFlag, "encryption", "", `Specifies the type of the encryption layer to open before mounting (password will be prompted). (available "luks", "veracrypt", "truecrypt", "bitlocker", "plain")`)
+	runCmd.Flags().Uint32Var(&veraCryptPIMFlag, "veracrypt-pim", 0, "Specifies the VeraCrypt Personal Iterations Multiplier (PIM). Zero means the default.")
+	runCmd.Flags().BoolVar(&veraCryptHiddenFlag, "veracrypt-hidden", false, "Open the hidden VeraCrypt or TrueCrypt volume instead of the outer one.")
 	runCmd.Flags().BoolVar(&debugShellFlag, "debug-shell", false, "Start a VM shell when the network file share is active.")
+	runCmd.Flags().StringArrayVarP(&extraPassthroughFlag, "passthrough", "p", nil, `Passes through an extra device in addition to the one specified as the first positional argument. Can be specified multiple times. The syntax is the same as for the positional argument. Useful for RAID arrays and LVM volume groups spanning multiple drives.`)
+
+	runCmd.Flags().StringArrayVar(&mountFlag, "mount", nil, `Mounts an in-VM device under /mnt/<name>. Can be specified multiple times to mount several devices or partitions at once. The syntax is "<vm dev>[:name=<name>][:fs=<fs type>][:luks[=<mapper name>]][:encryption=<type>][:mapper=<mapper name>][:options=<mount options>][:subvol=<btrfs subvolume>][:subvolumes]". The device can also be a "uuid=", "label=" or "partlabel=" selector. The name defaults to the device name or the selector value, made into a valid name. Cannot be combined with the in-VM device positional arguments.`)
+	runCmd.Flags().BoolVar(&separateSharesFlag, "separate-shares", false, "Export every device mounted with --mount as its own share instead of a single share with a subfolder per device. Not supported by FTP.")
+
+	runCmd.Flags().StringVar(&zfsFlag, "zfs", "", `Imports the ZFS pool and mounts the specified dataset ("<pool>" or "<pool>/<dataset>") instead of an in-VM device. The pool is imported read-only unless --zfs-writable is specified. Native encryption keys are prompted for like LUKS passwords.`)
+	runCmd.Flags().BoolVar(&zfsRecursiveFlag, "zfs-recursive", false, "Mount the descendant datasets of the --zfs dataset too, at the subfolders matching their names.")
+	runCmd.Flags().BoolVar(&zfsWritableFlag, "zfs-writable", false, "Import the ZFS pool writable. Not allowed in read-only mode.")
+	runCmd.Flags().BoolVar(&zfsForceFlag, "zfs-force", false, "Import the ZFS pool even if it appears to be in use by another system. Pools that were not exported cleanly need this.")
+
+	runCmd.Flags().StringVar(&btrfsSubvolFlag, "btrfs-subvol", "", `Mounts the specified Btrfs subvolume instead of the default one. Either the path of the subvolume relative to the top-level one, or "id=<subvolume id>". The subvolumes can be listed with "linsk ls --btrfs".`)
+	runCmd.Flags().BoolVar(&btrfsSubvolumesFlag, "btrfs-subvolumes", false, `Mounts the top-level Btrfs subvolume and every subvolume and snapshot at their own folders, named after the subvolume paths with "/" replaced by "_". The top-level subvolume is at the "toplevel" folder.`)
 
 	initVMRuntimeFlags(runCmd.Flags())
 
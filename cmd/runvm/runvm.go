@@ -93,7 +93,14 @@ func RunVM(vi *vm.VM, initFileManager bool, tapRuntimeCtx *share.NetTapRuntimeCo
 			return 1
 		case <-vi.SSHUpNotifyChan():
 			if fm != nil {
-				err := fm.InitLVM()
+				// LVM volume groups may be on top of RAID arrays.
+				err := fm.InitRAID()
+				if err != nil {
+					slog.Error("Failed to initialize File Manager RAID", "error", err.Error())
+					return 1
+				}
+
+				err = fm.InitLVM()
 				if err != nil {
 					slog.Error("Failed to initialize File Manager LVM", "error", err.Error())
 					return 1
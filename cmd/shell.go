@@ -34,13 +34,8 @@ import (
 var shellCmd = &cobra.Command{
 	Use:   "shell",
 	Short: "Start a VM and access the shell. Useful for formatting drives and debugging.",
-	Args:  cobra.RangeArgs(0, 1),
+	Args:  cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		var passthroughArg string
-		if len(args) > 0 {
-			passthroughArg = args[0]
-		}
-
 		var forwardPortRules []vm.PortForwardingRule
 
 		for i, fp := range strings.Split(forwardPortsFlagStr, ",") {
@@ -57,7 +52,7 @@ var shellCmd = &cobra.Command{
 			forwardPortRules = append(forwardPortRules, fpr)
 		}
 
-		os.Exit(runVM(passthroughArg, func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
+		os.Exit(runVM(args, func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
 			if trc != nil {
 				slog.Info("Tap host-VM networking is active", "host-ip", trc.Net.HostIP, "vm-ip", trc.Net.GuestIP)
 			}
@@ -79,6 +74,8 @@ var enableTapNetFlag bool
 func init() {
 	shellCmd.Flags().StringVar(&forwardPortsFlagStr, "forward-ports", "", "Extra TCP port forwarding rules. Syntax: '<HOST PORT>:<VM PORT>' OR '<HOST BIND IP>:<HOST PORT>:<VM PORT>'. Multiple rules split by comma are accepted.")
 	shellCmd.Flags().BoolVar(&enableTapNetFlag, "enable-net-tap", false, "Enables host-VM tap networking.")
+
+	initPassthroughFlags(shellCmd.Flags())
 }
 
 func runVMShell(ctx context.Context, vi *vm.VM) error {
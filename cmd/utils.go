@@ -17,6 +17,7 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"os"
@@ -30,8 +31,10 @@ import (
 	"github.com/AlexSSD7/linsk/cmd/runvm"
 	"github.com/AlexSSD7/linsk/nettap"
 	"github.com/AlexSSD7/linsk/osspecifics"
+	"github.com/AlexSSD7/linsk/qemuimg"
 	"github.com/AlexSSD7/linsk/share"
 	"github.com/AlexSSD7/linsk/storage"
+	"github.com/AlexSSD7/linsk/utils"
 	"github.com/AlexSSD7/linsk/vm"
 	"github.com/pkg/errors"
 )
@@ -46,7 +49,7 @@ func createStoreOrExit() *storage.Storage {
 	return store
 }
 
-func runVM(passthroughArg string, fn runvm.Func, forwardPortsRules []vm.PortForwardingRule, unrestrictedNetworking bool, withNetTap bool) int {
+func runVM(passthroughArgs []string, fn runvm.Func, forwardPortsRules []vm.PortForwardingRule, unrestrictedNetworking bool, withNetTap bool) int {
 	store := createStoreOrExit()
 
 	vmImagePath, err := store.CheckVMImageExists()
@@ -66,16 +69,108 @@ func runVM(passthroughArg string, fn runvm.Func, forwardPortsRules []vm.PortForw
 		return 1
 	}
 
+	err = checkOverlayActionFlag()
+	if err != nil {
+		slog.Error("Bad --overlay-action flag value", "error", err.Error())
+		return 1
+	}
+
 	var passthroughConfig vm.PassthroughConfig
+	var overlays []sessionOverlay
+
+	overlaysFinished := false
+	defer func() {
+		if !overlaysFinished && len(overlays) != 0 {
+			// The session did not even start, so there is nothing worth keeping.
+			finishOverlays(overlays, overlayActionDiscard)
+		}
+	}()
+
+	// Indices of the devices in passthroughConfig which are to be attached through an overlay.
+	var overlayBlockIdxs, overlayImageIdxs []int
+
+	for _, passthroughArg := range passthroughArgs {
+		passthroughArg, withOverlay := extractPassthroughOption(passthroughArg, "overlay")
 
-	if passthroughArg != "" {
 		passthroughConfigPtr, err := getDevicePassthroughConfig(passthroughArg)
 		if err != nil {
-			slog.Error("Failed to get device passthrough config", "error", err.Error())
+			slog.Error("Failed to get device passthrough config", "error", err.Error(), "value", passthroughArg)
 			return 1
 		}
 
-		passthroughConfig = *passthroughConfigPtr
+		if withOverlay {
+			if readOnlyFlag {
+				slog.Error("Overlays cannot be used in read-only mode", "value", passthroughArg)
+				return 1
+			}
+
+			if len(passthroughConfigPtr.USB) != 0 {
+				slog.Error("Overlays are not supported for USB passthrough", "value", passthroughArg)
+				return 1
+			}
+
+			for _, img := range passthroughConfigPtr.Image {
+				if img.ReadOnly {
+					slog.Error("Overlays cannot be used with read-only disk images", "value", passthroughArg)
+					return 1
+				}
+			}
+
+			for i := range passthroughConfigPtr.Block {
+				overlayBlockIdxs = append(overlayBlockIdxs, len(passthroughConfig.Block)+i)
+			}
+
+			for i := range passthroughConfigPtr.Image {
+				overlayImageIdxs = append(overlayImageIdxs, len(passthroughConfig.Image)+i)
+			}
+		}
+
+		passthroughConfig.USB = append(passthroughConfig.USB, passthroughConfigPtr.USB...)
+		passthroughConfig.Block = append(passthroughConfig.Block, passthroughConfigPtr.Block...)
+		passthroughConfig.Image = append(passthroughConfig.Image, passthroughConfigPtr.Image...)
+	}
+
+	for i, dev := range passthroughConfig.Block {
+		for _, otherDev := range passthroughConfig.Block[:i] {
+			if dev.Path == otherDev.Path {
+				slog.Error("The same device cannot be passed through more than once", "path", dev.Path)
+				return 1
+			}
+		}
+	}
+
+	for i, img := range passthroughConfig.Image {
+		for _, otherImg := range passthroughConfig.Image[:i] {
+			if img.Path == otherImg.Path {
+				slog.Error("The same disk image cannot be passed through more than once", "path", img.Path)
+				return 1
+			}
+		}
+	}
+
+	// The overlays are created only once the final set of devices to attach is known.
+	for _, i := range overlayBlockIdxs {
+		dev := &passthroughConfig.Block[i]
+
+		dev.OverlayPath, err = store.CreateOverlay(context.Background(), dev.Path, "raw")
+		if err != nil {
+			slog.Error("Failed to create device overlay", "error", err.Error(), "path", dev.Path)
+			return 1
+		}
+
+		overlays = append(overlays, sessionOverlay{BackingPath: dev.Path, OverlayPath: dev.OverlayPath})
+	}
+
+	for _, i := range overlayImageIdxs {
+		img := &passthroughConfig.Image[i]
+
+		img.OverlayPath, err = store.CreateOverlay(context.Background(), img.Path, img.Format)
+		if err != nil {
+			slog.Error("Failed to create disk image overlay", "error", err.Error(), "path", img.Path)
+			return 1
+		}
+
+		overlays = append(overlays, sessionOverlay{BackingPath: img.Path, OverlayPath: img.OverlayPath})
 	}
 
 	if len(passthroughConfig.USB) != 0 {
@@ -94,6 +189,15 @@ func runVM(passthroughArg string, fn runvm.Func, forwardPortsRules []vm.PortForw
 		}
 	}
 
+	if readOnlyFlag {
+		if len(passthroughConfig.USB) != 0 {
+			slog.Error("USB passthrough is not supported in read-only mode. Please use raw block device passthrough instead.")
+			return 1
+		}
+
+		slog.Info("Read-only mode is enabled, passed-through devices will not be written to")
+	}
+
 	var tapRuntimeCtx *share.NetTapRuntimeContext
 	var tapsConfig []vm.TapConfig
 
@@ -195,17 +299,29 @@ func runVM(passthroughArg string, fn runvm.Func, forwardPortsRules []vm.PortForw
 		}},
 
 		MemoryAlloc: vmMemAllocFlag,
+		MemoryMax:   vmRuntimeMemoryMax,
 		BIOSPath:    biosPath,
 
 		PassthroughConfig:        passthroughConfig,
 		ExtraPortForwardingRules: forwardPortsRules,
 
+		ReadOnly: readOnlyFlag,
+
+		LVM: vm.LVMConfig{
+			Activate:         vmRuntimeLVMActivateFlag,
+			RenameDuplicates: vmRuntimeLVMRenameDuplicatesFlag,
+		},
+
 		UnrestrictedNetworking: unrestrictedNetworking,
 		Taps:                   tapsConfig,
 
 		OSUpTimeout:  time.Duration(vmOSUpTimeoutFlag) * time.Second,
 		SSHUpTimeout: time.Duration(vmSSHSetupTimeoutFlag) * time.Second,
 
+		ShutdownTimeout: time.Duration(vmShutdownTimeoutFlag) * time.Second,
+
+		GuestAgent: true,
+
 		Debug: vmDebugFlag,
 	}
 
@@ -215,24 +331,90 @@ func runVM(passthroughArg string, fn runvm.Func, forwardPortsRules []vm.PortForw
 		return 1
 	}
 
-	return runvm.RunVM(vi, true, tapRuntimeCtx, fn)
+	exitCode := runvm.RunVM(vi, true, tapRuntimeCtx, func(ctx context.Context, i *vm.VM, fm *vm.FileManager, trc *share.NetTapRuntimeContext) int {
+		if len(passthroughConfig.Block) != 0 || len(passthroughConfig.Image) != 0 {
+			devMap, err := i.GetBlockPassthroughMap(ctx)
+			if err != nil {
+				slog.Error("Failed to map passed-through devices", "error", err.Error())
+				return 1
+			}
+
+			printBlockPassthroughMap(devMap)
+		}
+
+		return fn(ctx, i, fm, trc)
+	})
+
+	if len(overlays) != 0 {
+		overlaysFinished = true
+
+		if !finishOverlays(overlays, overlayActionFlag) {
+			return 1
+		}
+	}
+
+	return exitCode
 }
 
-func getDevicePassthroughConfig(val string) (*vm.PassthroughConfig, error) {
+func printBlockPassthroughMap(devMap []vm.BlockDevicePassthroughMapping) {
+	var sb strings.Builder
+
+	for _, m := range devMap {
+		sb.WriteString(m.HostPath + " -> " + m.VMDevName + "\n")
+	}
+
+	fmt.Fprintf(os.Stderr, "===========================\n[Passthrough Device Map]\nHost devices were passed through to the VM as follows (host device -> in-VM device).\n\n%v===========================\n", sb.String())
+}
+
+// confirmOrExit asks the user to confirm the operation described
+// in msg and exits unless confirmed. skip is set by "--yes" flags.
+func confirmOrExit(msg string, skip bool) {
+	if skip {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%v Proceed? (y/n) > ", msg)
+
+	reader := bufio.NewReader(os.Stdin)
+	answer, err := reader.ReadBytes('\n')
+	if err != nil {
+		slog.Error("Failed to read answer", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if utils.ClearUnprintableChars(strings.ToLower(string(answer)), false) != "y" {
+		fmt.Fprintf(os.Stderr, "Aborted.\n")
+		os.Exit(2)
+	}
+}
+
+func checkDevicePassthroughPrivileges() error {
 	isRoot, err := osspecifics.CheckRunAsRoot()
 	if err != nil {
-		return nil, errors.Wrap(err, "check whether the program is run as root")
+		return errors.Wrap(err, "check whether the program is run as root")
 	}
 
 	if !isRoot {
-		return nil, fmt.Errorf("device passthrough of any type requires root (admin) privileges")
+		return fmt.Errorf("device passthrough requires root (admin) privileges")
 	}
 
-	valSplit := strings.Split(val, ":")
+	return nil
+}
+
+func getDevicePassthroughConfig(val string) (*vm.PassthroughConfig, error) {
+	// Disk image paths may contain colons (think of Windows drive letters).
+	valSplit := strings.SplitN(val, ":", 2)
 	if want, have := 2, len(valSplit); want != have {
 		return nil, fmt.Errorf("bad device passthrough syntax: wrong items split by ':' count: want %v, have %v", want, have)
 	}
 
+	if valSplit[0] != "img" {
+		err := checkDevicePassthroughPrivileges()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	switch valSplit[0] {
 	case "usb":
 		usbValsSplit := strings.Split(valSplit[1], ",")
@@ -297,7 +479,76 @@ func getDevicePassthroughConfig(val string) (*vm.PassthroughConfig, error) {
 			Path:      devPath,
 			BlockSize: 512,
 		}}}, nil
+	case "img":
+		imgConfig, err := getImagePassthroughConfig(valSplit[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return &vm.PassthroughConfig{Image: []vm.ImagePassthroughConfig{*imgConfig}}, nil
 	default:
 		return nil, fmt.Errorf("unknown device passthrough type '%v'", val)
 	}
 }
+
+// Syntax: <path>[,format=<format>][,ro]
+func getImagePassthroughConfig(val string) (*vm.ImagePassthroughConfig, error) {
+	valSplit := strings.Split(val, ",")
+
+	imgPath := filepath.Clean(valSplit[0])
+
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat disk image '%v'", imgPath)
+	}
+
+	if stat.IsDir() {
+		return nil, fmt.Errorf("disk image path '%v' is a directory", imgPath)
+	}
+
+	cfg := vm.ImagePassthroughConfig{
+		Path: imgPath,
+	}
+
+	for _, opt := range valSplit[1:] {
+		optSplit := strings.SplitN(opt, "=", 2)
+
+		switch optSplit[0] {
+		case "format":
+			if len(optSplit) != 2 || optSplit[1] == "" {
+				return nil, fmt.Errorf("empty disk image format")
+			}
+
+			cfg.Format = optSplit[1]
+		case "ro":
+			if len(optSplit) != 1 {
+				return nil, fmt.Errorf("disk image option 'ro' does not accept a value")
+			}
+
+			cfg.ReadOnly = true
+		default:
+			return nil, fmt.Errorf("unknown disk image option '%v'", opt)
+		}
+	}
+
+	if cfg.Format == "" {
+		ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer ctxCancel()
+
+		info, err := qemuimg.GetInfo(ctx, imgPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "detect disk image format of '%v'", imgPath)
+		}
+
+		cfg.Format = info.Format
+
+		slog.Info("Detected disk image format", "path", imgPath, "format", cfg.Format)
+	}
+
+	err = vm.CheckImagePassthroughFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
@@ -26,7 +26,7 @@ const baseAlpineVersionMajor = "3.20"
 const baseAlpineVersionMinor = "3"
 const baseAlpineVersionCombined = baseAlpineVersionMajor + "." + baseAlpineVersionMinor
 
-const LinskVMImageVersion = "1"
+const LinskVMImageVersion = "9"
 
 var baseAlpineArch string
 var baseImageURL string
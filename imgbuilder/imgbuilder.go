@@ -24,12 +24,14 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"log/slog"
 
 	"github.com/AlexSSD7/linsk/cmd/runvm"
 	"github.com/AlexSSD7/linsk/osspecifics"
 	"github.com/AlexSSD7/linsk/share"
+	"github.com/AlexSSD7/linsk/sshutil"
 	"github.com/AlexSSD7/linsk/utils"
 	"github.com/AlexSSD7/linsk/vm"
 	"github.com/alessio/shellescape"
@@ -115,16 +117,65 @@ func (bc *BuildContext) RunCLIBuild() int {
 
 		bc.logger.Info("VM OS installation in progress")
 
-		err = runAlpineSetup(sc, []string{"openssh", "lvm2", "util-linux", "cryptsetup", "vsftpd", "samba", "netatalk"})
+		// The image runs the "virt" kernel flavor, which needs the
+		// matching ZFS modules package (zfs-lts is for linux-lts).
+		err = runAlpineSetup(sc, []string{"openssh", "lvm2", "thin-provisioning-tools", "mdadm", "btrfs-progs", "util-linux", "cryptsetup", "ntfs-3g", "ntfs-3g-progs", "exfatprogs", "e2fsprogs", "xfsprogs", "dosfstools", "zfs", "zfs-virt", "vsftpd", "samba", "netatalk"})
 		if err != nil {
 			bc.logger.Error("Failed to set up Alpine Linux", "error", err.Error())
 			return 1
 		}
 
+		err = installGuestServices(ctx, v, sc)
+		if err != nil {
+			bc.logger.Error("Failed to install Linsk guest services", "error", err.Error())
+			return 1
+		}
+
 		return 0
 	})
 }
 
+func installGuestServices(ctx context.Context, vi *vm.VM, sc *ssh.Client) error {
+	_, err := sshutil.RunSSHCmd(ctx, sc, "mkdir -p /mnt/usr/local/bin /mnt/etc/init.d")
+	if err != nil {
+		return errors.Wrap(err, "create guest service dirs")
+	}
+
+	scpClient, err := vi.DialSCP()
+	if err != nil {
+		return errors.Wrap(err, "dial scp")
+	}
+
+	defer scpClient.Close()
+
+	// This timeout is for the SCP client exclusively.
+	scpCtx, scpCtxCancel := context.WithTimeout(ctx, time.Second*5)
+	defer scpCtxCancel()
+
+	files := []struct {
+		path    string
+		content string
+	}{
+		{path: "/mnt/usr/local/bin/linsk-agent", content: vm.GetGuestAgentScript()},
+		{path: "/mnt/etc/init.d/linsk-agent", content: vm.GetGuestAgentInitScript()},
+		{path: "/mnt/etc/init.d/linsk-ssh-keys", content: vm.GetSSHKeysInitScript()},
+	}
+
+	for _, f := range files {
+		err = scpClient.CopyFile(scpCtx, strings.NewReader(f.content), f.path, "0755")
+		if err != nil {
+			return errors.Wrapf(err, "copy file '%v'", f.path)
+		}
+	}
+
+	_, err = sshutil.RunSSHCmd(ctx, sc, "chroot /mnt rc-update add linsk-ssh-keys default && chroot /mnt rc-update add linsk-agent default")
+	if err != nil {
+		return errors.Wrap(err, "enable guest services")
+	}
+
+	return nil
+}
+
 func runAlpineSetup(sc *ssh.Client, pkgs []string) error {
 	sess, err := sc.NewSession()
 	if err != nil {
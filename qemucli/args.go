@@ -47,6 +47,9 @@ var safeArgs = map[string]ArgAcceptedValue{
 	"display": ArgAcceptedValueString,
 	"drive":   ArgAcceptedValueKeyValue,
 	"bios":    ArgAcceptedValueString,
+	"chardev": ArgAcceptedValueKeyValue,
+	"mon":     ArgAcceptedValueKeyValue,
+	"fw_cfg":  ArgAcceptedValueKeyValue,
 }
 
 type Arg interface {
@@ -0,0 +1,138 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package qemuimg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/AlexSSD7/linsk/osspecifics"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/pkg/errors"
+)
+
+type Info struct {
+	Filename        string `json:"filename"`
+	Format          string `json:"format"`
+	VirtualSize     uint64 `json:"virtual-size"`
+	ActualSize      uint64 `json:"actual-size"`
+	BackingFilename string `json:"backing-filename"`
+	Encrypted       bool   `json:"encrypted"`
+}
+
+func getCmd() string {
+	if osspecifics.IsWindows() {
+		return "qemu-img.exe"
+	}
+
+	return "qemu-img"
+}
+
+func run(ctx context.Context, args ...string) ([]byte, error) {
+	return runWithProgress(ctx, nil, args...)
+}
+
+// If progress is not nil, stdout is streamed to it instead of being returned.
+func runWithProgress(ctx context.Context, progress io.Writer, args ...string) ([]byte, error) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+
+	cmd := exec.CommandContext(ctx, getCmd(), args...) //#nosec G204 // All arguments are either fixed or file paths.
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if progress != nil {
+		cmd.Stdout = progress
+	}
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, utils.WrapErrWithLog(err, "run qemu-img", stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Paths are made absolute so that they are never confused with flags.
+func absPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "get absolute path of '%v'", path)
+	}
+
+	return absPath, nil
+}
+
+// GetInfo returns the information about a disk image, including its detected format.
+func GetInfo(ctx context.Context, path string) (*Info, error) {
+	path, err := absPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := run(ctx, "info", "--output=json", path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info Info
+	err = json.Unmarshal(out, &info)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal qemu-img info output")
+	}
+
+	return &info, nil
+}
+
+// CreateOverlay creates a qcow2 image which stores all writes on top of
+// the backing file (or device), leaving the latter intact.
+func CreateOverlay(ctx context.Context, path string, backingPath string, backingFormat string) error {
+	path, err := absPath(path)
+	if err != nil {
+		return err
+	}
+
+	backingPath, err = absPath(backingPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = run(ctx, "create", "-q", "-f", "qcow2", "-b", backingPath, "-F", backingFormat, path)
+	return err
+}
+
+// Commit writes the contents of an overlay to its backing file (or device).
+// The overlay is left as is, and is to be removed by the caller. If progress
+// is not nil, the progress is reported there.
+func Commit(ctx context.Context, path string, progress io.Writer) error {
+	path, err := absPath(path)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"commit", "-d"}
+	if progress != nil {
+		args = append(args, "-p")
+	}
+
+	_, err = runWithProgress(ctx, progress, append(args, path)...)
+	return err
+}
@@ -37,3 +37,14 @@ type VMShareContext struct {
 	FileManager *vm.FileManager
 	NetTapCtx   *NetTapRuntimeContext
 }
+
+// Returns the share path to put into the share URL. With several
+// shares exported, the URL points to the server root instead.
+func (vc *VMShareContext) sharePath(sep string) string {
+	names := vc.FileManager.ShareNames()
+	if len(names) != 1 {
+		return sep
+	}
+
+	return sep + names[0]
+}
@@ -19,8 +19,10 @@ package sshutil
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/pem"
 	"fmt"
 	"time"
 
@@ -43,9 +45,34 @@ func GenerateSSHKey() (ssh.Signer, []byte, error) {
 	return signer, ssh.MarshalAuthorizedKey(signer.PublicKey()), nil
 }
 
+// GenerateSSHHostKey generates an Ed25519 key to be used as an SSH server
+// identity. The private key is returned in the OpenSSH PEM format.
+func GenerateSSHHostKey() ([]byte, ssh.PublicKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generate ed25519 private key")
+	}
+
+	pemBlock, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "marshal private key")
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create signer from key")
+	}
+
+	return pem.EncodeToMemory(pemBlock), signer.PublicKey(), nil
+}
+
 func RunSSHCmd(ctx context.Context, sc *ssh.Client, cmd string) ([]byte, error) {
+	return RunSSHCmdWithTimeout(ctx, time.Second*15, sc, cmd)
+}
+
+func RunSSHCmdWithTimeout(ctx context.Context, timeout time.Duration, sc *ssh.Client, cmd string) ([]byte, error) {
 	var ret []byte
-	err := NewSSHSession(ctx, time.Second*15, sc, func(sess *ssh.Session) error {
+	err := NewSSHSession(ctx, timeout, sc, func(sess *ssh.Session) error {
 		stdout := bytes.NewBuffer(nil)
 		stderr := bytes.NewBuffer(nil)
 
@@ -0,0 +1,61 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/AlexSSD7/linsk/qemuimg"
+	"github.com/pkg/errors"
+)
+
+const overlaysDirName = "overlays"
+
+var overlayNameUnsafeCharsRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// CreateOverlay creates a new qcow2 overlay for the backing file (or device)
+// in the data directory. It returns the path to the overlay.
+func (s *Storage) CreateOverlay(ctx context.Context, backingPath string, backingFormat string) (string, error) {
+	overlaysDir := filepath.Join(s.path, overlaysDirName)
+
+	err := os.MkdirAll(overlaysDir, 0700)
+	if err != nil {
+		return "", errors.Wrap(err, "mkdir all overlays dir")
+	}
+
+	name := overlayNameUnsafeCharsRegexp.ReplaceAllString(filepath.Base(backingPath), "_")
+	overlayPath := filepath.Join(overlaysDir, fmt.Sprintf("%v_%v.qcow2", name, time.Now().Format("20060102_150405")))
+
+	_, err = os.Stat(overlayPath)
+	if err == nil {
+		return "", fmt.Errorf("overlay '%v' already exists", overlayPath)
+	}
+
+	err = qemuimg.CreateOverlay(ctx, overlayPath, backingPath, backingFormat)
+	if err != nil {
+		return "", errors.Wrap(err, "create qcow2 overlay")
+	}
+
+	s.logger.Info("Created an overlay", "path", overlayPath, "backing-path", backingPath)
+
+	return overlayPath, nil
+}
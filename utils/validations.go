@@ -58,6 +58,52 @@ func ValidateDevName(s string) bool {
 	return devNameRegexp.MatchString(s)
 }
 
+var mountNameRegexp = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_-]{0,31}$`)
+
+// Mount names are used both as directory names and as share names.
+// Names reserved by file share servers are not allowed.
+func ValidateMountName(s string) bool {
+	switch strings.ToLower(s) {
+	case "global", "homes", "printers":
+		return false
+	}
+
+	return mountNameRegexp.MatchString(s)
+}
+
+const maxMountNameLen = 32
+
+// SanitizeMountName makes a mount name out of an arbitrary string, like a file
+// system label, by replacing the disallowed characters with underscores and
+// truncating it. Returns an empty string if no valid name can be made.
+func SanitizeMountName(s string) string {
+	ret := strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || r == '-' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, s)
+
+	ret = strings.TrimLeft(ret, "_-")
+	if len(ret) > maxMountNameLen {
+		ret = strings.TrimRight(ret[:maxMountNameLen], "_-")
+	}
+
+	if !ValidateMountName(ret) {
+		return ""
+	}
+
+	return ret
+}
+
+var zfsNameRegexp = regexp.MustCompile(`^[A-Za-z][0-9A-Za-z_.:-]*(/[0-9A-Za-z_:-][0-9A-Za-z_.:-]*)*$`)
+
+// ValidateZFSName validates ZFS pool and dataset names. Snapshots are not allowed.
+func ValidateZFSName(s string) bool {
+	return len(s) <= 255 && zfsNameRegexp.MatchString(s)
+}
+
 var unixUsernameRegexp = regexp.MustCompile(`^[a-z_]([a-z0-9_-]{0,31}|[a-z0-9_-]{0,30}\$)$`)
 
 func ValidateUnixUsername(s string) bool {
@@ -69,3 +115,35 @@ func Uint16ToBytesBE(v uint16) []byte {
 	binary.BigEndian.PutUint16(b, v)
 	return b
 }
+
+var btrfsSubvolumePathRegexp = regexp.MustCompile(`^/?[0-9A-Za-z_.@+ -]+(/[0-9A-Za-z_.@+ -]+)*$`)
+
+// ValidateBtrfsSubvolumePath validates paths of Btrfs subvolumes relative to
+// the top-level subvolume. Commas are not allowed as they separate mount options.
+func ValidateBtrfsSubvolumePath(s string) bool {
+	if !btrfsSubvolumePathRegexp.MatchString(s) {
+		return false
+	}
+
+	for _, elem := range strings.Split(strings.TrimPrefix(s, "/"), "/") {
+		if elem == "." || elem == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+var lvmNameRegexp = regexp.MustCompile(`^[0-9A-Za-z+_.][0-9A-Za-z+_.-]{0,126}$`)
+
+// ValidateLVMName validates LVM volume group and logical volume names.
+func ValidateLVMName(s string) bool {
+	return s != "." && s != ".." && lvmNameRegexp.MatchString(s)
+}
+
+var lvmUUIDRegexp = regexp.MustCompile(`^[0-9A-Za-z]{6}(-[0-9A-Za-z]{4}){5}-[0-9A-Za-z]{6}$`)
+
+// ValidateLVMUUID validates LVM UUIDs, as printed by the LVM tools.
+func ValidateLVMUUID(s string) bool {
+	return lvmUUIDRegexp.MatchString(s)
+}
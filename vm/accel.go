@@ -0,0 +1,111 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/osspecifics"
+	"github.com/AlexSSD7/linsk/qemucli"
+	"github.com/pkg/errors"
+)
+
+// Software emulation is many times slower than hardware-accelerated
+// virtualization, so all VM timeouts are multiplied by this factor.
+const softwareEmulationTimeoutMultiplier = 5
+
+type accelerator struct {
+	Name     string
+	Items    []qemucli.KeyValueArgItem
+	Software bool
+}
+
+func getHardwareAccelerator() accelerator {
+	switch {
+	case osspecifics.IsWindows():
+		return accelerator{
+			Name: "whpx",
+			Items: []qemucli.KeyValueArgItem{
+				{Key: "whpx"},
+				{Key: "kernel-irqchip", Value: "off"},
+			},
+		}
+	case osspecifics.IsMacOS():
+		return accelerator{
+			Name:  "hvf",
+			Items: []qemucli.KeyValueArgItem{{Key: "hvf"}},
+		}
+	default:
+		return accelerator{
+			Name:  "kvm",
+			Items: []qemucli.KeyValueArgItem{{Key: "kvm"}},
+		}
+	}
+}
+
+func getSoftwareAccelerator() accelerator {
+	return accelerator{
+		Name:     "tcg",
+		Items:    []qemucli.KeyValueArgItem{{Key: "tcg"}},
+		Software: true,
+	}
+}
+
+func detectAccelerator(logger *slog.Logger, qemuCmd string) accelerator {
+	hw := getHardwareAccelerator()
+
+	err := checkAcceleratorAvailable(qemuCmd, hw.Name)
+	if err == nil {
+		return hw
+	}
+
+	logger.Warn("=== HARDWARE ACCELERATION IS UNAVAILABLE === Falling back to software emulation (TCG). The VM will be VERY slow, and all VM timeouts will be increased accordingly.", "accel", hw.Name, "reason", err.Error())
+
+	return getSoftwareAccelerator()
+}
+
+func checkAcceleratorAvailable(qemuCmd string, name string) error {
+	if name == "kvm" {
+		// QEMU lists KVM as supported even when /dev/kvm
+		// is missing or inaccessible, hence the check.
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err != nil {
+			return errors.Wrap(err, "open /dev/kvm")
+		}
+
+		_ = f.Close()
+	}
+
+	out, err := exec.Command(qemuCmd, "-accel", "help").Output() //#nosec G204 // The command name is not user-controlled.
+	if err != nil {
+		// We don't want to prevent the VM from starting if
+		// QEMU doesn't like the arguments for some reason.
+		return nil
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("accelerator '%v' is not supported by '%v'", name, qemuCmd)
+}
@@ -0,0 +1,236 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/pkg/errors"
+)
+
+// The name of the virtio-serial port the guest agent listens on.
+// The guest sees it as /dev/virtio-ports/<name>.
+const GuestAgentPortName = "org.linsk.agent.0"
+
+// The guest agent protocol is line-based. Every frame is a single line
+// of space-separated fields, and every binary payload is base64-encoded
+// so that it never contains spaces or newlines.
+//
+// Request (host -> guest):  <id> <op> <payload>
+// Response (guest -> host): <id> <exit code> <stdout> <stderr>
+//
+// Supported ops are "ping" (responds with "pong" in stdout) and "exec"
+// (runs the payload as a shell script). Responses with unknown IDs are
+// leftovers from requests that timed out, and are to be discarded.
+//
+// The guest side is implemented as a shell script installed by imgbuilder.
+
+const (
+	guestAgentOpPing = "ping"
+	guestAgentOpExec = "exec"
+)
+
+type AgentExecResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+type AgentClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// We allow only one request in flight to keep the guest side simple.
+	mu     sync.Mutex
+	nextID uint64
+}
+
+func DialAgent(ctx context.Context, addr string) (*AgentClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial agent socket")
+	}
+
+	return &AgentClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+func (c *AgentClient) request(ctx context.Context, op string, payload []byte) (AgentExecResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	id := utils.UintToStr(c.nextID)
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second * 30)
+	}
+
+	_ = c.conn.SetDeadline(deadline)
+
+	_, err := c.conn.Write([]byte(id + " " + op + " " + base64.StdEncoding.EncodeToString(payload) + "\n"))
+	if err != nil {
+		return AgentExecResult{}, errors.Wrap(err, "write request")
+	}
+
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return AgentExecResult{}, errors.Wrap(err, "read response")
+		}
+
+		fields := strings.Split(strings.TrimRight(line, "\r\n"), " ")
+		if want, have := 4, len(fields); want != have {
+			return AgentExecResult{}, fmt.Errorf("bad response fields count: want %v, have %v", want, have)
+		}
+
+		if fields[0] != id {
+			// A stale response to a request that timed out.
+			continue
+		}
+
+		exitCode, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return AgentExecResult{}, errors.Wrap(err, "parse exit code")
+		}
+
+		stdout, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return AgentExecResult{}, errors.Wrap(err, "decode stdout")
+		}
+
+		stderr, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return AgentExecResult{}, errors.Wrap(err, "decode stderr")
+		}
+
+		return AgentExecResult{
+			ExitCode: exitCode,
+			Stdout:   stdout,
+			Stderr:   stderr,
+		}, nil
+	}
+}
+
+func (c *AgentClient) Ping(ctx context.Context) error {
+	res, err := c.request(ctx, guestAgentOpPing, nil)
+	if err != nil {
+		return err
+	}
+
+	if string(res.Stdout) != "pong" {
+		return fmt.Errorf("unexpected ping response '%v'", string(res.Stdout))
+	}
+
+	return nil
+}
+
+// Exec runs a shell script in the guest and returns its output along
+// with the exit code. A non-zero exit code is not considered an error.
+func (c *AgentClient) Exec(ctx context.Context, script string) (AgentExecResult, error) {
+	return c.request(ctx, guestAgentOpExec, []byte(script))
+}
+
+// ExecOK is the same as Exec, except that it returns an error
+// if the script exits with a non-zero code.
+func (c *AgentClient) ExecOK(ctx context.Context, script string) ([]byte, error) {
+	res, err := c.Exec(ctx, script)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ExitCode != 0 {
+		return nil, utils.WrapErrWithLog(fmt.Errorf("non-zero exit code %v", res.ExitCode), "run agent cmd", string(res.Stderr))
+	}
+
+	return res.Stdout, nil
+}
+
+func (c *AgentClient) Close() error {
+	return c.conn.Close()
+}
+
+// GetGuestAgentScript returns the guest side of the agent. It is supposed to
+// be installed into the VM image and run as a service.
+func GetGuestAgentScript() string {
+	return `#!/bin/sh
+# Linsk guest agent. Do not edit, this file is managed by Linsk.
+port=/dev/virtio-ports/` + GuestAgentPortName + `
+tmp=$(mktemp -d)
+
+modprobe virtio_console 2>/dev/null
+
+while :; do
+	if [ ! -e "$port" ]; then
+		sleep 0.2
+		continue
+	fi
+
+	# Virtio ports can only be opened once, hence a single read-write descriptor.
+	while IFS=' ' read -r id op payload <&3; do
+		code=0
+		: > "$tmp/out"
+		: > "$tmp/err"
+		case "$op" in
+		ping)
+			printf 'pong' > "$tmp/out"
+			;;
+		exec)
+			printf '%s' "$payload" | base64 -d > "$tmp/cmd"
+			sh "$tmp/cmd" < /dev/null > "$tmp/out" 2> "$tmp/err"
+			code=$?
+			;;
+		*)
+			printf 'unknown op' > "$tmp/err"
+			code=127
+			;;
+		esac
+		printf '%s %s %s %s\n' "$id" "$code" "$(base64 -w 0 < "$tmp/out")" "$(base64 -w 0 < "$tmp/err")" >&3
+	done 3<> "$port"
+
+	# The host side is disconnected (or the port could not be opened).
+	sleep 0.2
+done
+`
+}
+
+// GetGuestAgentInitScript returns the OpenRC service definition for the guest agent.
+func GetGuestAgentInitScript() string {
+	return `#!/sbin/openrc-run
+description="Linsk guest agent"
+command="/usr/local/bin/linsk-agent"
+command_background=true
+pidfile="/run/linsk-agent.pid"
+
+depend() {
+	after hwdrivers modules linsk-ssh-keys
+}
+`
+}
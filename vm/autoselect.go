@@ -0,0 +1,210 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/pkg/errors"
+)
+
+// The system drive of the VM. It is never a passthrough candidate.
+const systemDriveDevName = "vda"
+
+// File system types which cannot be mounted directly.
+var nonMountableFSTypes = map[string]bool{
+	"":               true,
+	FSTypeLUKS:       true,
+	FSTypeBitLocker:  true,
+	FSTypeLVMPV:      true,
+	FSTypeZFSMember:  true,
+	FSTypeRAIDMember: true,
+	"swap":           true,
+}
+
+// DevName returns the device name relative to /dev, which is
+// what FileManager.Mount and the rest of Linsk expect.
+func (bd BlockDevice) DevName() string {
+	switch bd.Type {
+	case "crypt", "lvm", "dm":
+		return "mapper/" + bd.Name
+	default:
+		return bd.Name
+	}
+}
+
+func (bd BlockDevice) Mountable() bool {
+	return !nonMountableFSTypes[bd.FSType]
+}
+
+// OpenLUKS opens a LUKS device (the password will be prompted) as /dev/mapper/<dmName>.
+func (fm *FileManager) OpenLUKS(devName string, dmName string) error {
+	return fm.OpenEncrypted(devName, dmName, EncryptionLUKS, VeraCryptOptions{})
+}
+
+// OpenEncrypted opens an encrypted device (the password will be prompted) as /dev/mapper/<dmName>.
+func (fm *FileManager) OpenEncrypted(devName string, dmName string, et EncryptionType, vc VeraCryptOptions) error {
+	if !utils.ValidateDevName(devName) {
+		return fmt.Errorf("bad encrypted device name")
+	}
+
+	if !validateMapperName(dmName) {
+		return fmt.Errorf("bad encrypted device mapper name")
+	}
+
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	return fm.cryptOpen(sc, "/dev/"+devName, dmName, et, vc, nil)
+}
+
+// Returns the in-VM names of the disks passed through. USB devices do not
+// appear in the passthrough map, so every disk but the system one is returned then.
+func (fm *FileManager) getPassthroughDisks(ctx context.Context, devs []BlockDevice) ([]string, error) {
+	mappings, err := fm.vm.GetBlockPassthroughMap(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get block passthrough map")
+	}
+
+	var ret []string
+	for _, m := range mappings {
+		ret = append(ret, m.VMDevName)
+	}
+
+	if len(ret) == 0 {
+		for _, dev := range devs {
+			if dev.Name != systemDriveDevName {
+				ret = append(ret, dev.Name)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func walkBlockDevices(devs []BlockDevice, fn func(dev BlockDevice)) {
+	for _, dev := range devs {
+		fn(dev)
+		walkBlockDevices(dev.Children, fn)
+	}
+}
+
+// OpenPassthroughLayers opens the LUKS containers, assembles the RAID arrays and activates
+// the LVM volume groups found on the passed-through disks, prompting for LUKS
+// passwords as needed, until no more closed layers are left. It returns
+// the resulting block device trees of the passed-through disks.
+func (fm *FileManager) OpenPassthroughLayers(ctx context.Context) ([]BlockDevice, error) {
+	// Devices we have already tried to open, to never ask twice.
+	tried := make(map[string]bool)
+
+	for {
+		devs, err := fm.Lsblk()
+		if err != nil {
+			return nil, errors.Wrap(err, "lsblk")
+		}
+
+		diskNames, err := fm.getPassthroughDisks(ctx, devs)
+		if err != nil {
+			return nil, errors.Wrap(err, "get passthrough disks")
+		}
+
+		var disks []BlockDevice
+		for _, dev := range devs {
+			for _, name := range diskNames {
+				if dev.Name == name {
+					disks = append(disks, dev)
+				}
+			}
+		}
+
+		var closedEncrypted []BlockDevice
+		var inactiveLVM, unassembledRAID bool
+
+		walkBlockDevices(disks, func(dev BlockDevice) {
+			if len(dev.Children) != 0 || tried[dev.DevName()] {
+				return
+			}
+
+			switch {
+			case dev.DetectedEncryption() != EncryptionNone:
+				closedEncrypted = append(closedEncrypted, dev)
+			case dev.IsLVMPV():
+				inactiveLVM = true
+			case dev.IsRAIDMember():
+				unassembledRAID = true
+			}
+
+			tried[dev.DevName()] = true
+		})
+
+		if len(closedEncrypted) == 0 && !inactiveLVM && !unassembledRAID {
+			return disks, nil
+		}
+
+		for _, dev := range closedEncrypted {
+			et := dev.DetectedEncryption()
+
+			fm.logger.Info("Found an encrypted device", "dev", dev.DevName(), "encryption", et, "size", dev.Size, "label", dev.Label)
+
+			err := fm.OpenEncrypted(dev.DevName(), "crypt_"+dev.Name, et, VeraCryptOptions{})
+			if err != nil {
+				return nil, errors.Wrapf(err, "open %v device '%v'", et, dev.DevName())
+			}
+		}
+
+		// LVM physical volumes may be on top of RAID arrays, so these go first.
+		if unassembledRAID {
+			fm.logger.Info("Found RAID members, assembling the arrays")
+
+			err := fm.InitRAID()
+			if err != nil {
+				return nil, errors.Wrap(err, "init raid")
+			}
+
+			// The volume groups on the arrays need to be activated.
+			inactiveLVM = true
+		}
+
+		if inactiveLVM {
+			fm.logger.Info("Found LVM physical volumes, activating the volume groups")
+
+			err := fm.InitLVM()
+			if err != nil {
+				return nil, errors.Wrap(err, "init lvm")
+			}
+		}
+	}
+}
+
+// GetMountCandidates returns the mountable devices found in the block device trees.
+func GetMountCandidates(devs []BlockDevice) []BlockDevice {
+	var ret []BlockDevice
+
+	walkBlockDevices(devs, func(dev BlockDevice) {
+		if dev.Mountable() {
+			ret = append(ret, dev)
+		}
+	})
+
+	return ret
+}
@@ -0,0 +1,98 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/pkg/errors"
+)
+
+func (vm *VM) balloonEnabled() bool {
+	return vm.originalCfg.MemoryMax > vm.originalCfg.MemoryAlloc && !vm.balloonFailed.Load()
+}
+
+// Falls back to the fixed memory allocation, which is the
+// maximum one as the VM was started with it.
+func (vm *VM) disableMemoryBalloon() {
+	vm.balloonFailed.Store(true)
+	vm.memoryTarget.Store(vm.originalCfg.MemoryMax)
+}
+
+// Shrinks the VM down to MemoryAlloc. The host does not give the VM any actual
+// memory until the guest OS touches it, so nothing is wasted before this is done.
+func (vm *VM) initMemoryBalloon() error {
+	sc, err := vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	_, err = sshutil.RunSSHCmd(vm.ctx, sc, "modprobe -q virtio_balloon || true")
+	if err != nil {
+		return errors.Wrap(err, "load virtio balloon module")
+	}
+
+	return vm.SetMemoryTarget(vm.ctx, vm.originalCfg.MemoryAlloc)
+}
+
+// MemoryTarget returns the memory the guest OS is given, in MiB.
+func (vm *VM) MemoryTarget() uint32 {
+	return vm.memoryTarget.Load()
+}
+
+// MemoryMax returns the memory the VM can be grown to, in MiB. It is the same
+// as MemoryTarget if the memory balloon is not used.
+func (vm *VM) MemoryMax() uint32 {
+	if !vm.balloonEnabled() {
+		return vm.MemoryTarget()
+	}
+
+	return vm.originalCfg.MemoryMax
+}
+
+// SetMemoryTarget grows or shrinks the memory of the running VM using the
+// balloon. The guest OS adjusts to the change asynchronously. It returns
+// ErrBalloonUnavailable if the VM was configured without the balloon.
+func (vm *VM) SetMemoryTarget(ctx context.Context, mib uint32) error {
+	if !vm.balloonEnabled() {
+		return ErrBalloonUnavailable
+	}
+
+	if mib > vm.originalCfg.MemoryMax {
+		return fmt.Errorf("memory target %v MiB exceeds the maximum of %v MiB", mib, vm.originalCfg.MemoryMax)
+	}
+
+	qmp, err := vm.QMP()
+	if err != nil {
+		return err
+	}
+
+	err = qmp.Balloon(ctx, uint64(mib)*1024*1024)
+	if err != nil {
+		return errors.Wrap(err, "qmp balloon")
+	}
+
+	vm.memoryTarget.Store(mib)
+
+	vm.logger.Debug("Set VM memory target", "mib", mib)
+
+	return nil
+}
@@ -0,0 +1,45 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// The fake hypervisor has no QMP, so the balloon cannot be set up.
+func TestMemoryBalloonFallback(t *testing.T) {
+	vi, _ := startFakeVM(t, Config{
+		MemoryAlloc: 512,
+		MemoryMax:   2048,
+	}, nil)
+
+	if want, have := uint32(2048), vi.MemoryTarget(); want != have {
+		t.Errorf("want memory target %v, have %v", want, have)
+	}
+
+	if want, have := uint32(2048), vi.MemoryMax(); want != have {
+		t.Errorf("want memory max %v, have %v", want, have)
+	}
+
+	err := vi.SetMemoryTarget(context.Background(), 1024)
+	if !errors.Is(err, ErrBalloonUnavailable) {
+		t.Errorf("want ErrBalloonUnavailable, have %v", err)
+	}
+}
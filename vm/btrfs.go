@@ -0,0 +1,349 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const FSTypeBtrfs = "btrfs"
+
+// The ID of the top-level subvolume, which all other subvolumes are nested in.
+const btrfsTopLevelSubvolumeID = 5
+
+// The name of the folder the top-level subvolume is mounted at when mounting all subvolumes.
+const btrfsTopLevelFolderName = "toplevel"
+
+type BtrfsSubvolume struct {
+	ID       uint64 `json:"id"`
+	ParentID uint64 `json:"parent_id"`
+
+	// Relative to the top-level subvolume.
+	Path string `json:"path"`
+
+	UUID string `json:"uuid"`
+
+	// The UUID of the subvolume the snapshot was taken of.
+	// Empty if the subvolume is not a snapshot.
+	ParentUUID string `json:"parent_uuid,omitempty"`
+
+	Snapshot bool `json:"snapshot"`
+	ReadOnly bool `json:"read_only"`
+
+	// The time the snapshot was taken, as printed by btrfs-progs. Empty for regular subvolumes.
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// ParseBtrfsSubvolume parses a subvolume reference, which is
+// either the path of the subvolume or "id=<subvolume id>".
+// It returns the corresponding mount option.
+func ParseBtrfsSubvolume(s string) (string, error) {
+	if idStr, ok := strings.CutPrefix(s, "id="); ok {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return "", errors.Wrap(err, "parse subvolume id")
+		}
+
+		return "subvolid=" + fmt.Sprint(id), nil
+	}
+
+	if !utils.ValidateBtrfsSubvolumePath(s) {
+		return "", fmt.Errorf("bad btrfs subvolume path '%v'", s)
+	}
+
+	return "subvol=" + s, nil
+}
+
+// The kernel does not discover the devices of multi-device
+// file systems by itself, and there is no udev in the VM to do it.
+func (fm *FileManager) scanBtrfsDevices(sc *ssh.Client) error {
+	_, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "btrfs device scan > /dev/null")
+	if err != nil {
+		return errors.Wrap(err, "run btrfs device scan")
+	}
+
+	return nil
+}
+
+// Mounts the top-level subvolume read-only at a temporary directory for the
+// duration of fn. Nothing gets written to the device, including the log replay.
+func (fm *FileManager) withBtrfsTopLevel(sc *ssh.Client, fullDevPath string, fn func(mountPoint string) error) error {
+	err := fm.scanBtrfsDevices(sc)
+	if err != nil {
+		return err
+	}
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "mktemp -d /run/linsk-btrfs.XXXXXX")
+	if err != nil {
+		return errors.Wrap(err, "create temporary mount point")
+	}
+
+	mountPoint := strings.TrimSpace(string(out))
+
+	_, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, "mount -t btrfs -o ro,nologreplay,subvolid="+fmt.Sprint(btrfsTopLevelSubvolumeID)+" "+shellescape.Quote(fullDevPath)+" "+shellescape.Quote(mountPoint))
+	if err != nil {
+		_, _ = sshutil.RunSSHCmd(context.Background(), sc, "rmdir "+shellescape.Quote(mountPoint))
+		return errors.Wrap(err, "mount top-level subvolume")
+	}
+
+	defer func() {
+		_, err := sshutil.RunSSHCmd(context.Background(), sc, "umount "+shellescape.Quote(mountPoint)+" && rmdir "+shellescape.Quote(mountPoint))
+		if err != nil {
+			fm.logger.Warn("Failed to unmount the temporary Btrfs mount", "mountpoint", mountPoint, "error", err.Error())
+		}
+	}()
+
+	return fn(mountPoint)
+}
+
+// BtrfsSubvolumes returns the subvolumes and the snapshots of the Btrfs file system on the device.
+func (fm *FileManager) BtrfsSubvolumes(devName string) ([]BtrfsSubvolume, error) {
+	_, _, isSelector := ParseDevSelector(devName)
+	if !isSelector && !utils.ValidateDevName(devName) {
+		return nil, fmt.Errorf("bad device name")
+	}
+
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	devName, err = fm.resolveDevName(sc, devName)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve device name")
+	}
+
+	var ret []BtrfsSubvolume
+
+	err = fm.withBtrfsTopLevel(sc, "/dev/"+devName, func(mountPoint string) error {
+		var err error
+		ret, err = fm.listBtrfsSubvolumes(sc, mountPoint)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (fm *FileManager) listBtrfsSubvolumes(sc *ssh.Client, mountPoint string) ([]BtrfsSubvolume, error) {
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "btrfs subvolume list -p -u -q "+shellescape.Quote(mountPoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "list subvolumes")
+	}
+
+	subvols, err := parseBtrfsSubvolumeList(string(out))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse subvolume list")
+	}
+
+	// Only the snapshots have the creation time printed.
+	out, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, "btrfs subvolume list -s "+shellescape.Quote(mountPoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "list snapshots")
+	}
+
+	snapshots, err := parseBtrfsSubvolumeList(string(out))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse snapshot list")
+	}
+
+	out, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, "btrfs subvolume list -r "+shellescape.Quote(mountPoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "list read-only subvolumes")
+	}
+
+	readOnly, err := parseBtrfsSubvolumeList(string(out))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse read-only subvolume list")
+	}
+
+	return mergeBtrfsSubvolumeLists(subvols, snapshots, readOnly), nil
+}
+
+// Marks the subvolumes found in the snapshot and the read-only subvolume lists.
+func mergeBtrfsSubvolumeLists(subvols []BtrfsSubvolume, snapshots []BtrfsSubvolume, readOnly []BtrfsSubvolume) []BtrfsSubvolume {
+	for i := range subvols {
+		for _, s := range snapshots {
+			if s.ID == subvols[i].ID {
+				subvols[i].Snapshot = true
+				subvols[i].CreatedAt = s.CreatedAt
+			}
+		}
+
+		for _, s := range readOnly {
+			if s.ID == subvols[i].ID {
+				subvols[i].ReadOnly = true
+			}
+		}
+
+		if subvols[i].ParentUUID != "" {
+			subvols[i].Snapshot = true
+		}
+	}
+
+	return subvols
+}
+
+// The set of fields depends on the flags passed to "btrfs subvolume list".
+var btrfsSubvolumeListLineRegexp = regexp.MustCompile(`^ID (\d+) gen \d+(?: cgen \d+)?(?: parent (\d+))? top level \d+(?: otime (\S+ \S+|-))?(?: parent_uuid (\S+))?(?: received_uuid \S+)?(?: uuid (\S+))? path (.+)$`)
+
+func parseBtrfsSubvolumeList(out string) ([]BtrfsSubvolume, error) {
+	var ret []BtrfsSubvolume
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		m := btrfsSubvolumeListLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("bad subvolume line '%v'", line)
+		}
+
+		id, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse subvolume id")
+		}
+
+		var parentID uint64
+		if m[2] != "" {
+			parentID, err = strconv.ParseUint(m[2], 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "parse parent subvolume id")
+			}
+		}
+
+		// btrfs-progs prints "-" for the unset values.
+		unsetToEmpty := func(s string) string {
+			if s == "-" {
+				return ""
+			}
+
+			return s
+		}
+
+		ret = append(ret, BtrfsSubvolume{
+			ID:         id,
+			ParentID:   parentID,
+			Path:       m[6],
+			UUID:       unsetToEmpty(m[5]),
+			ParentUUID: unsetToEmpty(m[4]),
+			CreatedAt:  unsetToEmpty(m[3]),
+		})
+	}
+
+	return ret, nil
+}
+
+// Matches the characters that are not allowed in subvolume folder names.
+var btrfsFolderNameBadCharsRegexp = regexp.MustCompile(`[^0-9A-Za-z_.@+-]`)
+
+const maxBtrfsFolderNameLen = 128
+
+// Returns the name of the folder for the subvolume. The subvolumes are not mounted
+// following their hierarchy because that would require creating directories on
+// the file system itself, so the path is flattened instead. The paths come from
+// the disk, so anything but a few safe characters is replaced as well.
+func getBtrfsSubvolumeFolderName(path string) string {
+	name := btrfsFolderNameBadCharsRegexp.ReplaceAllString(path, "_")
+	if len(name) > maxBtrfsFolderNameLen {
+		name = name[:maxBtrfsFolderNameLen]
+	}
+
+	// "." and ".." cannot be used as folder names.
+	if strings.Trim(name, ".") == "" {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// Returns the folder names for the subvolumes, in the same order. The names are
+// made unique by appending the subvolume ID, and a counter if that is not enough.
+func getBtrfsSubvolumeFolderNames(subvols []BtrfsSubvolume) []string {
+	ret := make([]string, 0, len(subvols))
+	usedNames := make(map[string]bool)
+
+	for _, subvol := range subvols {
+		baseName := getBtrfsSubvolumeFolderName(subvol.Path)
+		name := baseName
+
+		for i := 1; usedNames[name]; i++ {
+			name = baseName + "-" + fmt.Sprint(subvol.ID)
+			if i > 1 {
+				name += "-" + fmt.Sprint(i)
+			}
+		}
+
+		usedNames[name] = true
+		ret = append(ret, name)
+	}
+
+	return ret
+}
+
+// Mounts the top-level subvolume and every subvolume and snapshot
+// of the file system at their own folders under the mount point.
+func (fm *FileManager) mountBtrfsSubvolumes(sc *ssh.Client, fullDevPath string, mountPoint string, mountOptions string) error {
+	var subvols []BtrfsSubvolume
+
+	// Listing the subvolumes requires the file system to be mounted.
+	err := fm.withBtrfsTopLevel(sc, fullDevPath, func(tmpMountPoint string) error {
+		var err error
+		subvols, err = fm.listBtrfsSubvolumes(sc, tmpMountPoint)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "list subvolumes")
+	}
+
+	subvols = append([]BtrfsSubvolume{{ID: btrfsTopLevelSubvolumeID, Path: btrfsTopLevelFolderName}}, subvols...)
+
+	if mountOptions != "" {
+		mountOptions += ","
+	}
+
+	names := getBtrfsSubvolumeFolderNames(subvols)
+
+	for i, subvol := range subvols {
+		name := names[i]
+		subvolMountPoint := shellescape.Quote(mountPoint + "/" + name)
+
+		fm.logger.Info("Mounting Btrfs subvolume", "id", subvol.ID, "path", subvol.Path, "snapshot", subvol.Snapshot, "folder", name)
+
+		_, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "mkdir -p "+subvolMountPoint+" && mount -t btrfs -o "+shellescape.Quote(mountOptions+"subvolid="+fmt.Sprint(subvol.ID))+" "+shellescape.Quote(fullDevPath)+" "+subvolMountPoint)
+		if err != nil {
+			return errors.Wrapf(err, "mount subvolume '%v'", subvol.Path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The output of "btrfs subvolume list -p -u -q".
+const testBtrfsSubvolumeList = `ID 256 gen 412 parent 5 top level 5 parent_uuid - uuid 3c0f5a2e-8d41-6b4f-a0e9-2c7d5b1f9e36 path @
+ID 257 gen 409 parent 5 top level 5 parent_uuid - uuid 91b2e4d7-0f3a-5c48-b6e1-7a9d2c4f0b58 path @home
+ID 260 gen 398 parent 256 top level 256 parent_uuid - uuid 5e7a1c9b-3d2f-4a06-8b5c-e1f0d9a7c342 path @/var/lib/my data
+ID 261 gen 401 parent 5 top level 5 parent_uuid 3c0f5a2e-8d41-6b4f-a0e9-2c7d5b1f9e36 uuid c4d9f2a1-6b7e-4830-9a5d-0e2b8c1f7d64 path .snapshots/@-2023-10-01
+ID 262 gen 405 parent 5 top level 5 parent_uuid 91b2e4d7-0f3a-5c48-b6e1-7a9d2c4f0b58 uuid 7f3b0e5d-2a9c-41d6-8e7b-b5c0a4d2f913 path .snapshots/@home-2023-10-02
+`
+
+// The output of "btrfs subvolume list -s".
+const testBtrfsSnapshotList = `ID 261 gen 401 cgen 401 top level 5 otime 2023-10-01 12:00:03 path .snapshots/@-2023-10-01
+ID 262 gen 405 cgen 405 top level 5 otime 2023-10-02 12:00:04 path .snapshots/@home-2023-10-02
+`
+
+// The output of "btrfs subvolume list -r".
+const testBtrfsReadOnlyList = `ID 261 gen 401 top level 5 path .snapshots/@-2023-10-01
+`
+
+func TestParseBtrfsSubvolumeList(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []BtrfsSubvolume
+	}{
+		{
+			name: "none",
+			out:  "",
+		},
+		{
+			name: "subvolumes",
+			out:  testBtrfsSubvolumeList,
+			want: []BtrfsSubvolume{
+				{ID: 256, ParentID: 5, Path: "@", UUID: "3c0f5a2e-8d41-6b4f-a0e9-2c7d5b1f9e36"},
+				{ID: 257, ParentID: 5, Path: "@home", UUID: "91b2e4d7-0f3a-5c48-b6e1-7a9d2c4f0b58"},
+				{ID: 260, ParentID: 256, Path: "@/var/lib/my data", UUID: "5e7a1c9b-3d2f-4a06-8b5c-e1f0d9a7c342"},
+				{ID: 261, ParentID: 5, Path: ".snapshots/@-2023-10-01", UUID: "c4d9f2a1-6b7e-4830-9a5d-0e2b8c1f7d64", ParentUUID: "3c0f5a2e-8d41-6b4f-a0e9-2c7d5b1f9e36"},
+				{ID: 262, ParentID: 5, Path: ".snapshots/@home-2023-10-02", UUID: "7f3b0e5d-2a9c-41d6-8e7b-b5c0a4d2f913", ParentUUID: "91b2e4d7-0f3a-5c48-b6e1-7a9d2c4f0b58"},
+			},
+		},
+		{
+			name: "snapshots",
+			out:  testBtrfsSnapshotList,
+			want: []BtrfsSubvolume{
+				{ID: 261, Path: ".snapshots/@-2023-10-01", CreatedAt: "2023-10-01 12:00:03"},
+				{ID: 262, Path: ".snapshots/@home-2023-10-02", CreatedAt: "2023-10-02 12:00:04"},
+			},
+		},
+		{
+			name: "read-only",
+			out:  testBtrfsReadOnlyList,
+			want: []BtrfsSubvolume{
+				{ID: 261, Path: ".snapshots/@-2023-10-01"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := parseBtrfsSubvolumeList(tc.out)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Errorf("want %+v, have %+v", tc.want, have)
+			}
+		})
+	}
+}
+
+func TestParseBtrfsSubvolumeListErrors(t *testing.T) {
+	for _, out := range []string{
+		"ERROR: not a btrfs filesystem: /mnt\n",
+		"ID 256 gen 412 top level 5\n",
+		"ID 18446744073709551616 gen 412 top level 5 path @\n",
+	} {
+		_, err := parseBtrfsSubvolumeList(out)
+		if err == nil {
+			t.Errorf("%q: want an error", out)
+		}
+	}
+}
+
+func TestMergeBtrfsSubvolumeLists(t *testing.T) {
+	var lists [3][]BtrfsSubvolume
+	for i, out := range []string{testBtrfsSubvolumeList, testBtrfsSnapshotList, testBtrfsReadOnlyList} {
+		var err error
+		lists[i], err = parseBtrfsSubvolumeList(out)
+		if err != nil {
+			t.Fatalf("parse list %v: %v", i, err)
+		}
+	}
+
+	have := mergeBtrfsSubvolumeLists(lists[0], lists[1], lists[2])
+
+	for _, tc := range []struct {
+		id        uint64
+		snapshot  bool
+		readOnly  bool
+		createdAt string
+	}{
+		{id: 256},
+		{id: 257},
+		{id: 260},
+		{id: 261, snapshot: true, readOnly: true, createdAt: "2023-10-01 12:00:03"},
+		{id: 262, snapshot: true, createdAt: "2023-10-02 12:00:04"},
+	} {
+		var found bool
+		for _, s := range have {
+			if s.ID != tc.id {
+				continue
+			}
+
+			found = true
+
+			if s.Snapshot != tc.snapshot || s.ReadOnly != tc.readOnly || s.CreatedAt != tc.createdAt {
+				t.Errorf("subvolume %v: want snapshot %v, read-only %v, created at %q, have %+v", tc.id, tc.snapshot, tc.readOnly, tc.createdAt, s)
+			}
+		}
+
+		if !found {
+			t.Errorf("subvolume %v not found", tc.id)
+		}
+	}
+}
+
+func TestGetBtrfsSubvolumeFolderNames(t *testing.T) {
+	subvols := []BtrfsSubvolume{
+		{ID: btrfsTopLevelSubvolumeID, Path: btrfsTopLevelFolderName},
+		{ID: 256, Path: "@"},
+		{ID: 257, Path: "toplevel"},
+		{ID: 258, Path: "@/var/lib/my data"},
+		{ID: 259, Path: "@_var_lib_my_data"},
+		{ID: 260, Path: "@_var_lib_my_data-258"},
+		{ID: 258, Path: "@/var/lib/my\tdata"},
+		{ID: 261, Path: "$(reboot)`id`;'\""},
+		{ID: 262, Path: ".."},
+		{ID: 263, Path: "snapshots/" + strings.Repeat("x", 200)},
+	}
+
+	want := []string{
+		"toplevel",
+		"@",
+		"toplevel-257",
+		"@_var_lib_my_data",
+		"@_var_lib_my_data-259",
+		"@_var_lib_my_data-258",
+		"@_var_lib_my_data-258-2",
+		"__reboot__id____",
+		"_..",
+		"snapshots_" + strings.Repeat("x", maxBtrfsFolderNameLen-len("snapshots_")),
+	}
+
+	have := getBtrfsSubvolumeFolderNames(subvols)
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log/slog"
-	"net"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -35,6 +34,11 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	qmpChardevID   = "qmp0"
+	agentChardevID = "agent0"
+)
+
 func getUniqueQEMUNetID() string {
 	time.Sleep(time.Millisecond)
 	return "net" + utils.IntToStr(time.Now().UnixNano())
@@ -56,40 +60,78 @@ func cleanQEMUPath(s string) string {
 	return path
 }
 
-func configureBaseVMCmd(logger *slog.Logger, cfg Config) (string, []qemucli.Arg, error) {
+func getQEMUSystemCmd() (string, error) {
 	baseCmd := "qemu-system"
 
+	switch runtime.GOARCH {
+	case "amd64":
+		baseCmd += "-x86_64"
+	case "arm64":
+		baseCmd += "-aarch64"
+	default:
+		return "", fmt.Errorf("arch '%v' is not supported", runtime.GOARCH)
+	}
+
+	if osspecifics.IsWindows() {
+		baseCmd += ".exe"
+	}
+
+	return baseCmd, nil
+}
+
+func configureBaseVMCmd(logger *slog.Logger, cfg Config, qmpPort uint16, accel accelerator) (string, []qemucli.Arg, error) {
+	baseCmd, err := getQEMUSystemCmd()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "get qemu system cmd")
+	}
+
+	// With the balloon, the VM is started with the maximum memory, and
+	// everything above MemoryAlloc is taken away once the guest OS is up.
+	memory := cfg.MemoryAlloc
+	if cfg.MemoryMax > cfg.MemoryAlloc {
+		memory = cfg.MemoryMax
+	}
+
 	args := []qemucli.Arg{
 		qemucli.MustNewStringArg("serial", "stdio"),
-		qemucli.MustNewUintArg("m", cfg.MemoryAlloc),
+		qemucli.MustNewUintArg("m", memory),
 		qemucli.MustNewUintArg("smp", runtime.NumCPU()),
 	}
 
-	if osspecifics.IsMacOS() {
-		args = append(args, qemucli.MustNewStringArg("cpu", "host"))
+	if cfg.MemoryMax > cfg.MemoryAlloc {
+		args = append(args, qemucli.MustNewKeyValueArg("device", []qemucli.KeyValueArgItem{
+			{Key: "driver", Value: "virtio-balloon-pci"},
+			{Key: "id", Value: "balloon0"},
+		}))
 	}
 
-	var accel []qemucli.KeyValueArgItem
+	// QMP (QEMU Machine Protocol) control channel. We're using TCP instead
+	// of UNIX sockets because the latter are not well-supported on Windows.
+	args = append(args,
+		qemucli.MustNewKeyValueArg("chardev", []qemucli.KeyValueArgItem{
+			{Key: "socket"},
+			{Key: "id", Value: qmpChardevID},
+			{Key: "host", Value: "127.0.0.1"},
+			{Key: "port", Value: utils.UintToStr(qmpPort)},
+			{Key: "server", Value: "on"},
+			{Key: "wait", Value: "off"},
+		}),
+		qemucli.MustNewKeyValueArg("mon", []qemucli.KeyValueArgItem{
+			{Key: "chardev", Value: qmpChardevID},
+			{Key: "mode", Value: "control"},
+		}),
+	)
+
 	switch {
-	case osspecifics.IsWindows():
-		accel = []qemucli.KeyValueArgItem{
-			{Key: "whpx"},
-			{Key: "kernel-irqchip", Value: "off"},
-		}
+	case accel.Software:
+		// "host" CPU model is available only with hardware acceleration. Also,
+		// the default aarch64 CPU model in TCG is a 32-bit one.
+		args = append(args, qemucli.MustNewStringArg("cpu", "max"))
 	case osspecifics.IsMacOS():
-		accel = []qemucli.KeyValueArgItem{{
-			Key: "hvf",
-		}}
-	default:
-		accel = []qemucli.KeyValueArgItem{{
-			Key: "kvm",
-		}}
+		args = append(args, qemucli.MustNewStringArg("cpu", "host"))
 	}
 
-	switch runtime.GOARCH {
-	case "amd64":
-		baseCmd += "-x86_64"
-	case "arm64":
+	if runtime.GOARCH == "arm64" {
 		if cfg.BIOSPath == "" {
 			logger.Warn("BIOS image path is not specified while attempting to run an aarch64 (arm64) VM. The VM will not boot.")
 		}
@@ -101,13 +143,14 @@ func configureBaseVMCmd(logger *slog.Logger, cfg Config) (string, []qemucli.Arg,
 				{Key: "highmem", Value: "off"},
 			}),
 		)
+	}
 
-		baseCmd += "-aarch64"
-	default:
-		return "", nil, fmt.Errorf("arch '%v' is not supported", runtime.GOARCH)
+	accelArg, err := qemucli.NewKeyValueArg("accel", accel.Items)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create accel key-value arg")
 	}
 
-	args = append(args, qemucli.MustNewKeyValueArg("accel", accel))
+	args = append(args, accelArg)
 
 	if cfg.BIOSPath != "" {
 		biosPath := cleanQEMUPath(cfg.BIOSPath)
@@ -135,13 +178,28 @@ func configureBaseVMCmd(logger *slog.Logger, cfg Config) (string, []qemucli.Arg,
 		args = append(args, cdromArg, qemucli.MustNewStringArg("boot", "d"))
 	}
 
-	if osspecifics.IsWindows() {
-		baseCmd += ".exe"
-	}
-
 	return baseCmd, args, nil
 }
 
+func configureVMCmdGuestAgent(agentPort uint16) []qemucli.Arg {
+	return []qemucli.Arg{
+		qemucli.MustNewKeyValueArg("device", []qemucli.KeyValueArgItem{{Key: "driver", Value: "virtio-serial-pci"}}),
+		qemucli.MustNewKeyValueArg("chardev", []qemucli.KeyValueArgItem{
+			{Key: "socket"},
+			{Key: "id", Value: agentChardevID},
+			{Key: "host", Value: "127.0.0.1"},
+			{Key: "port", Value: utils.UintToStr(agentPort)},
+			{Key: "server", Value: "on"},
+			{Key: "wait", Value: "off"},
+		}),
+		qemucli.MustNewKeyValueArg("device", []qemucli.KeyValueArgItem{
+			{Key: "driver", Value: "virtserialport"},
+			{Key: "chardev", Value: agentChardevID},
+			{Key: "name", Value: GuestAgentPortName},
+		}),
+	}
+}
+
 func configureVMCmdUserNetwork(ports []PortForwardingRule, unrestricted bool) ([]qemucli.Arg, error) {
 	netID := getUniqueQEMUNetID()
 
@@ -205,16 +263,7 @@ func configureVMCmdTapNetwork(tapName string) ([]qemucli.Arg, error) {
 	return []qemucli.Arg{netdevArg, deviceArg}, nil
 }
 
-func configureVMCmdNetworking(logger *slog.Logger, cfg Config, sshPort uint16) ([]qemucli.Arg, error) {
-	// SSH port config.
-	ports := []PortForwardingRule{{
-		HostIP:   net.ParseIP("127.0.0.1"),
-		HostPort: sshPort,
-		VMPort:   22,
-	}}
-
-	ports = append(ports, cfg.ExtraPortForwardingRules...)
-
+func configureVMCmdNetworking(logger *slog.Logger, cfg Config, ports []PortForwardingRule) ([]qemucli.Arg, error) {
 	if cfg.UnrestrictedNetworking {
 		logger.Warn("Using unrestricted VM networking")
 	}
@@ -315,7 +364,7 @@ func configureVMCmdBlockDevicePassthrough(logger *slog.Logger, cfg Config) ([]qe
 		logger.Warn("Using raw block device passthrough. Please note that it's YOUR responsibility to ensure that no device is mounted in your OS and the VM at the same time. Otherwise, you run serious risks. No further warnings will be issued.")
 	}
 
-	for _, dev := range cfg.PassthroughConfig.Block {
+	for i, dev := range cfg.PassthroughConfig.Block {
 		// It's always a user's responsibility to ensure that no drives are mounted
 		// in both host and guest system. This should serve as the last resort.
 		{
@@ -351,17 +400,29 @@ func configureVMCmdBlockDevicePassthrough(logger *slog.Logger, cfg Config) ([]qe
 			{Key: "drive", Value: driveID},
 			{Key: "logical_block_size", Value: strBlockSize},
 			{Key: "physical_block_size", Value: strBlockSize},
+			{Key: "serial", Value: getBlockPassthroughSerial(i)},
 		})
 		if err != nil {
 			return nil, errors.Wrapf(err, "create drive device key-value arg (path '%v')", devPath)
 		}
 
-		driveArg, err := qemucli.NewKeyValueArg("drive", []qemucli.KeyValueArgItem{
-			{Key: "file", Value: devPath},
-			{Key: "format", Value: "raw"},
+		driveFile, driveFormat := devPath, "raw"
+		if dev.OverlayPath != "" {
+			driveFile, driveFormat = cleanQEMUPath(dev.OverlayPath), "qcow2"
+		}
+
+		driveArgItems := []qemucli.KeyValueArgItem{
+			{Key: "file", Value: driveFile},
+			{Key: "format", Value: driveFormat},
 			{Key: "if", Value: "none"},
 			{Key: "id", Value: driveID},
-		})
+		}
+
+		if cfg.ReadOnly {
+			driveArgItems = append(driveArgItems, qemucli.KeyValueArgItem{Key: "readonly", Value: "on"})
+		}
+
+		driveArg, err := qemucli.NewKeyValueArg("drive", driveArgItems)
 		if err != nil {
 			return nil, errors.Wrapf(err, "create drive key-value arg (path '%v')", devPath)
 		}
@@ -371,3 +432,51 @@ func configureVMCmdBlockDevicePassthrough(logger *slog.Logger, cfg Config) ([]qe
 
 	return args, nil
 }
+
+func configureVMCmdImagePassthrough(cfg Config) ([]qemucli.Arg, error) {
+	var args []qemucli.Arg
+
+	for i, img := range cfg.PassthroughConfig.Image {
+		err := CheckImagePassthroughFormat(img.Format)
+		if err != nil {
+			return nil, errors.Wrapf(err, "check image format (path '%v')", img.Path)
+		}
+
+		imgPath := cleanQEMUPath(img.Path)
+		driveID := getUniqueQEMUDriveID()
+
+		driveDevArg, err := qemucli.NewKeyValueArg("device", []qemucli.KeyValueArgItem{
+			{Key: "driver", Value: "virtio-blk-pci"},
+			{Key: "drive", Value: driveID},
+			{Key: "serial", Value: getImagePassthroughSerial(i)},
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "create drive device key-value arg (path '%v')", imgPath)
+		}
+
+		driveFile, driveFormat := imgPath, img.Format
+		if img.OverlayPath != "" {
+			driveFile, driveFormat = cleanQEMUPath(img.OverlayPath), "qcow2"
+		}
+
+		driveArgItems := []qemucli.KeyValueArgItem{
+			{Key: "file", Value: driveFile},
+			{Key: "format", Value: driveFormat},
+			{Key: "if", Value: "none"},
+			{Key: "id", Value: driveID},
+		}
+
+		if img.ReadOnly || cfg.ReadOnly {
+			driveArgItems = append(driveArgItems, qemucli.KeyValueArgItem{Key: "readonly", Value: "on"})
+		}
+
+		driveArg, err := qemucli.NewKeyValueArg("drive", driveArgItems)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create drive key-value arg (path '%v')", imgPath)
+		}
+
+		args = append(args, driveDevArg, driveArg)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,111 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Device selectors are resolved to device names in the VM with blkid.
+// They stay the same regardless of the passthrough order.
+var devSelectorTags = map[string]string{
+	"uuid":      "UUID",
+	"label":     "LABEL",
+	"partlabel": "PARTLABEL",
+}
+
+// ParseDevSelector returns the blkid tag and the value if the
+// device name is a selector like "uuid=...", "label=..." or "partlabel=...".
+func ParseDevSelector(s string) (string, string, bool) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", false
+	}
+
+	tag, ok := devSelectorTags[strings.ToLower(key)]
+	if !ok {
+		return "", "", false
+	}
+
+	return tag, value, true
+}
+
+func validateDevSelectorValue(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if r == '"' || r == '\'' || r == '\\' || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Resolves device selectors to device names relative to /dev.
+// Device names which are not selectors are validated and returned as is.
+func (fm *FileManager) resolveDevName(sc *ssh.Client, devName string) (string, error) {
+	tag, value, ok := ParseDevSelector(devName)
+	if !ok {
+		// It does allow "mapper/" prefix for mapped devices.
+		// This is to enable the support for LVM and LUKS.
+		if !utils.ValidateDevName(devName) {
+			return "", fmt.Errorf("bad device name")
+		}
+
+		return devName, nil
+	}
+
+	if !validateDevSelectorValue(value) {
+		return "", fmt.Errorf("bad device selector value")
+	}
+
+	// blkid exits with a non-zero code if nothing is found. The cache is
+	// bypassed as the devices may have just appeared (e.g. opened LUKS).
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "blkid -c /dev/null -o device -t "+shellescape.Quote(tag+"="+value)+" || true")
+	if err != nil {
+		return "", errors.Wrap(err, "run blkid")
+	}
+
+	devPaths := strings.Fields(string(out))
+	switch len(devPaths) {
+	case 0:
+		return "", fmt.Errorf("no device with %v '%v' found", tag, value)
+	case 1:
+	default:
+		return "", fmt.Errorf("more than one device with %v '%v' found: %v", tag, value, strings.Join(devPaths, ", "))
+	}
+
+	ret := strings.TrimPrefix(devPaths[0], "/dev/")
+	if !utils.ValidateDevName(ret) {
+		return "", fmt.Errorf("bad resolved device name '%v'", devPaths[0])
+	}
+
+	fm.logger.Info("Resolved device selector", "selector", devName, "dev", ret)
+
+	return ret, nil
+}
@@ -0,0 +1,102 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// EncryptionType is the type of the encryption layer to open before mounting.
+// All of them are handled by cryptsetup inside the VM.
+type EncryptionType string
+
+const (
+	EncryptionNone      EncryptionType = ""
+	EncryptionLUKS      EncryptionType = "luks"
+	EncryptionVeraCrypt EncryptionType = "veracrypt"
+	EncryptionTrueCrypt EncryptionType = "truecrypt"
+	EncryptionBitLocker EncryptionType = "bitlocker"
+	EncryptionPlain     EncryptionType = "plain"
+)
+
+var encryptionTypes = []EncryptionType{EncryptionLUKS, EncryptionVeraCrypt, EncryptionTrueCrypt, EncryptionBitLocker, EncryptionPlain}
+
+// ParseEncryptionType parses the encryption type. An empty string stands for no encryption.
+func ParseEncryptionType(s string) (EncryptionType, error) {
+	if s == "" {
+		return EncryptionNone, nil
+	}
+
+	for _, et := range encryptionTypes {
+		if string(et) == strings.ToLower(s) {
+			return et, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown encryption type '%v'", s)
+}
+
+type VeraCryptOptions struct {
+	// Personal Iterations Multiplier. Zero means the default.
+	PIM uint32
+
+	// Open the hidden volume instead of the outer one.
+	Hidden bool
+}
+
+// Returns the cryptsetup open arguments (without the device and the mapping name).
+func getCryptOpenArgs(et EncryptionType, vc VeraCryptOptions) (string, error) {
+	switch et {
+	case EncryptionLUKS:
+		return "luksOpen", nil
+	case EncryptionVeraCrypt, EncryptionTrueCrypt:
+		args := "open --type tcrypt"
+		if et == EncryptionVeraCrypt {
+			args += " --veracrypt"
+			if vc.PIM != 0 {
+				args += " --veracrypt-pim " + fmt.Sprint(vc.PIM)
+			}
+		} else if vc.PIM != 0 {
+			return "", fmt.Errorf("pim is supported only by veracrypt")
+		}
+
+		if vc.Hidden {
+			args += " --tcrypt-hidden"
+		}
+
+		return args, nil
+	case EncryptionBitLocker:
+		return "open --type bitlk", nil
+	case EncryptionPlain:
+		return "open --type plain", nil
+	default:
+		return "", fmt.Errorf("unsupported encryption type '%v'", et)
+	}
+}
+
+// cryptsetup exits with this code when none of the keyslots can be opened with
+// the secret given. Unlike the messages, the exit code doesn't depend on the locale.
+const cryptWrongPassphraseExitCode = 2
+
+func isCryptWrongPassphraseErr(err error) bool {
+	var exitErr *ssh.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitStatus() == cryptWrongPassphraseExitCode
+}
@@ -22,4 +22,17 @@ import (
 
 var (
 	ErrSSHUnavailable = errors.New("ssh unavailable")
+	ErrQMPUnavailable = errors.New("qmp unavailable")
+
+	ErrAgentUnavailable = errors.New("guest agent unavailable")
+
+	ErrBalloonUnavailable = errors.New("memory balloon unavailable")
+
+	// Returned when the LUKS secret is wrong. This includes the
+	// cases when all attempts to enter the password are used up.
+	ErrLUKSWrongPassphrase = errors.New("wrong luks passphrase")
+
+	// Returned when an operation which writes to
+	// the devices is requested in read-only mode.
+	ErrReadOnly = errors.New("not allowed in read-only mode")
 )
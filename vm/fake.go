@@ -0,0 +1,456 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// FakeGuestHandler handles a command which would otherwise be run in the
+// guest shell. An empty command means an interactive shell was requested.
+// The returned value is the exit code.
+type FakeGuestHandler func(ctx context.Context, cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int
+
+// FakeHypervisor emulates the guest with an in-process SSH server listening
+// on the forwarded SSH port, so that everything built on top of VM can be
+// run without a real VM. "poweroff" and SCP uploads are handled by the fake
+// itself, everything else is passed to the handler. If the handler is nil,
+// all commands succeed without any output.
+//
+// The exported fields change how the fake guest behaves on shutdown. They
+// are to be set before the VM is started.
+type FakeHypervisor struct {
+	// How long the guest takes to power off after the poweroff command.
+	PoweroffDelay time.Duration
+
+	// The guest never powers off, as if the guest OS hung on the way.
+	IgnorePoweroff bool
+
+	// The guest powers off on the shutdown requests from the hypervisor. By
+	// default, they are ignored, as they are by a guest OS without ACPI support.
+	HandleShutdown bool
+
+	// The hypervisor fails to terminate the VM, so that it can only be killed.
+	IgnoreTerminate bool
+
+	logger  *slog.Logger
+	handler FakeGuestHandler
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	serverConf *ssh.ServerConfig
+	sshAddr    string
+
+	listener net.Listener
+	exitedCh chan struct{}
+	exitOnce sync.Once
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	commands []string
+	files    map[string][]byte
+	stops    []string
+}
+
+func NewFakeHypervisor(logger *slog.Logger, handler FakeGuestHandler) *FakeHypervisor {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	return &FakeHypervisor{
+		logger:  logger,
+		handler: handler,
+
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+
+		exitedCh: make(chan struct{}),
+
+		conns: make(map[net.Conn]struct{}),
+		files: make(map[string][]byte),
+	}
+}
+
+func (f *FakeHypervisor) Prepare(spec HypervisorSpec) error {
+	if f.serverConf != nil {
+		return fmt.Errorf("already prepared")
+	}
+
+	for _, rule := range spec.PortForwardingRules {
+		if rule.VMPort != 22 {
+			f.logger.Debug("Ignoring port forwarding rule as there is no guest to forward to", "host-port", rule.HostPort, "vm-port", rule.VMPort)
+			continue
+		}
+
+		hostIP := "127.0.0.1"
+		if rule.HostIP != nil {
+			hostIP = rule.HostIP.String()
+		}
+
+		f.sshAddr = net.JoinHostPort(hostIP, utils.UintToStr(rule.HostPort))
+	}
+
+	if f.sshAddr == "" {
+		return fmt.Errorf("no ssh port forwarding rule")
+	}
+
+	hostKey, err := ssh.ParsePrivateKey(spec.SSHHostKeyPEM)
+	if err != nil {
+		return errors.Wrap(err, "parse ssh host key")
+	}
+
+	authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey(spec.SSHAuthorizedKey)
+	if err != nil {
+		return errors.Wrap(err, "parse ssh authorized key")
+	}
+
+	serverConf := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, fmt.Errorf("unknown public key")
+			}
+
+			return nil, nil
+		},
+	}
+
+	serverConf.AddHostKey(hostKey)
+
+	f.serverConf = serverConf
+
+	return nil
+}
+
+func (f *FakeHypervisor) Start() error {
+	if f.serverConf == nil {
+		return fmt.Errorf("not prepared")
+	}
+
+	listener, err := net.Listen("tcp", f.sshAddr)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	f.listener = listener
+
+	go f.runAcceptLoop()
+
+	return nil
+}
+
+func (f *FakeHypervisor) runAcceptLoop() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.conns[conn] = struct{}{}
+		f.mu.Unlock()
+
+		go func() {
+			f.handleConn(conn)
+
+			f.mu.Lock()
+			delete(f.conns, conn)
+			f.mu.Unlock()
+
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (f *FakeHypervisor) handleConn(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, f.serverConf)
+	if err != nil {
+		f.logger.Debug("SSH handshake failed", "error", err.Error())
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			_ = newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			f.logger.Debug("Failed to accept SSH channel", "error", err.Error())
+			continue
+		}
+
+		go f.handleSession(ch, chReqs)
+	}
+}
+
+func (f *FakeHypervisor) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer func() { _ = ch.Close() }()
+
+	for req := range reqs {
+		var cmd string
+
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			err := ssh.Unmarshal(req.Payload, &payload)
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			cmd = payload.Command
+		case "shell":
+		case "pty-req", "env", "window-change":
+			_ = req.Reply(true, nil)
+			continue
+		default:
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		_ = req.Reply(true, nil)
+
+		exitCode := f.runCmd(cmd, ch, ch, ch.Stderr())
+
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(exitCode)}))
+
+		if cmd == "poweroff" && !f.IgnorePoweroff {
+			// The exit status needs to be delivered first.
+			_ = ch.Close()
+			f.exitAfter(f.PoweroffDelay)
+		}
+
+		return
+	}
+}
+
+func (f *FakeHypervisor) runCmd(cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	f.mu.Lock()
+	f.commands = append(f.commands, cmd)
+	f.mu.Unlock()
+
+	switch {
+	case cmd == "poweroff":
+		// Handled once the session is over.
+		return 0
+	case strings.HasPrefix(cmd, "scp -qt "):
+		err := f.runSCPSink(strings.TrimPrefix(cmd, "scp -qt "), stdin, stdout)
+		if err != nil {
+			_, _ = io.WriteString(stderr, err.Error())
+			return 1
+		}
+
+		return 0
+	}
+
+	if f.handler == nil {
+		return 0
+	}
+
+	return f.handler(f.ctx, cmd, stdin, stdout, stderr)
+}
+
+// runSCPSink implements the receiving side of the SCP protocol
+// for a single file, which is all what the scp client needs.
+func (f *FakeHypervisor) runSCPSink(quotedPath string, stdin io.Reader, stdout io.Writer) error {
+	path, err := strconv.Unquote(quotedPath)
+	if err != nil {
+		path = quotedPath
+	}
+
+	r := bufio.NewReader(stdin)
+
+	_, err = stdout.Write([]byte{0})
+	if err != nil {
+		return errors.Wrap(err, "write ready ack")
+	}
+
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "read header")
+	}
+
+	headerSplit := strings.Split(strings.TrimSpace(header), " ")
+	if want, have := 3, len(headerSplit); want != have || !strings.HasPrefix(headerSplit[0], "C") {
+		return fmt.Errorf("bad scp header '%v'", strings.TrimSpace(header))
+	}
+
+	size, err := strconv.ParseUint(headerSplit[1], 10, 32)
+	if err != nil {
+		return errors.Wrap(err, "parse size")
+	}
+
+	_, err = stdout.Write([]byte{0})
+	if err != nil {
+		return errors.Wrap(err, "write header ack")
+	}
+
+	data := make([]byte, size+1)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return errors.Wrap(err, "read data")
+	}
+
+	f.mu.Lock()
+	f.files[path] = data[:size]
+	f.mu.Unlock()
+
+	_, err = stdout.Write([]byte{0})
+	if err != nil {
+		return errors.Wrap(err, "write data ack")
+	}
+
+	return nil
+}
+
+// Commands returns all commands run in the fake guest so far.
+func (f *FakeHypervisor) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.commands...)
+}
+
+// File returns the contents of a file uploaded to the fake guest over SCP.
+func (f *FakeHypervisor) File(path string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.files[path]
+	return data, ok
+}
+
+// Stops returns the ways the VM was asked to stop through the
+// hypervisor so far, which are "shutdown", "terminate" and "kill".
+func (f *FakeHypervisor) Stops() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.stops...)
+}
+
+func (f *FakeHypervisor) recordStop(stop string) {
+	f.mu.Lock()
+	f.stops = append(f.stops, stop)
+	f.mu.Unlock()
+}
+
+func (f *FakeHypervisor) exitAfter(delay time.Duration) {
+	if delay == 0 {
+		f.exit()
+		return
+	}
+
+	go func() {
+		select {
+		case <-time.After(delay):
+			f.exit()
+		case <-f.exitedCh:
+		}
+	}()
+}
+
+func (f *FakeHypervisor) exit() {
+	f.exitOnce.Do(func() {
+		f.ctxCancel()
+
+		if f.listener != nil {
+			_ = f.listener.Close()
+		}
+
+		f.mu.Lock()
+		for conn := range f.conns {
+			_ = conn.Close()
+		}
+		f.mu.Unlock()
+
+		close(f.exitedCh)
+	})
+}
+
+func (f *FakeHypervisor) Wait() error {
+	if f.listener == nil {
+		return fmt.Errorf("not started")
+	}
+
+	<-f.exitedCh
+
+	return nil
+}
+
+func (f *FakeHypervisor) Shutdown(_ context.Context) error {
+	f.recordStop("shutdown")
+
+	if f.HandleShutdown {
+		f.exitAfter(f.PoweroffDelay)
+	}
+
+	return nil
+}
+
+func (f *FakeHypervisor) Terminate() error {
+	f.recordStop("terminate")
+
+	if !f.IgnoreTerminate {
+		f.exit()
+	}
+
+	return nil
+}
+
+func (f *FakeHypervisor) Kill() error {
+	f.recordStop("kill")
+	f.exit()
+	return nil
+}
+
+func (f *FakeHypervisor) Console() (io.Reader, io.Writer) {
+	return nil, nil
+}
+
+func (f *FakeHypervisor) AgentAddr() (string, error) {
+	return "", ErrAgentUnavailable
+}
+
+func (f *FakeHypervisor) SoftwareEmulated() bool {
+	return false
+}
+
+func (f *FakeHypervisor) Log() string {
+	return ""
+}
+
+func (f *FakeHypervisor) Close() error {
+	f.exit()
+	return nil
+}
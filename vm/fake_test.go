@@ -0,0 +1,259 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// Starts a VM run by a FakeHypervisor and waits for it to be ready.
+// The VM is shut down once the test is over.
+func startFakeVM(t *testing.T, cfg Config, handler FakeGuestHandler) (*VM, *FakeHypervisor) {
+	t.Helper()
+
+	hv := NewFakeHypervisor(newTestLogger(), handler)
+
+	cfg.Hypervisor = hv
+	cfg.OSUpTimeout = time.Second * 10
+	cfg.SSHUpTimeout = time.Second * 10
+	cfg.ShutdownTimeout = time.Second * 5
+
+	vi, err := NewVM(newTestLogger(), cfg)
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- vi.Run()
+	}()
+
+	t.Cleanup(func() {
+		err := vi.Cancel()
+		if err != nil {
+			t.Errorf("cancel vm: %v", err)
+		}
+
+		select {
+		case err := <-runErrCh:
+			if err != nil {
+				t.Errorf("run vm: %v", err)
+			}
+		case <-time.After(time.Second * 10):
+			t.Errorf("vm did not exit in time")
+		}
+	})
+
+	select {
+	case <-vi.SSHUpNotifyChan():
+	case err := <-runErrCh:
+		t.Fatalf("vm exited before it was ready: %v", err)
+	case <-time.After(time.Second * 10):
+		t.Fatalf("vm was not ready in time")
+	}
+
+	return vi, hv
+}
+
+func hasCommand(commands []string, substr string) bool {
+	for _, cmd := range commands {
+		if strings.Contains(cmd, substr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestFakeHypervisorSSH(t *testing.T) {
+	vi, _ := startFakeVM(t, Config{}, func(_ context.Context, cmd string, _ io.Reader, stdout io.Writer, stderr io.Writer) int {
+		switch cmd {
+		case "echo hello":
+			_, _ = io.WriteString(stdout, "hello\n")
+			return 0
+		case "false":
+			_, _ = io.WriteString(stderr, "failed")
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	sc, err := vi.DialSSH()
+	if err != nil {
+		t.Fatalf("dial ssh: %v", err)
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	out, err := sshutil.RunSSHCmd(context.Background(), sc, "echo hello")
+	if err != nil {
+		t.Fatalf("run echo: %v", err)
+	}
+
+	if want, have := "hello\n", string(out); want != have {
+		t.Errorf("want output %q, have %q", want, have)
+	}
+
+	_, err = sshutil.RunSSHCmd(context.Background(), sc, "false")
+	if err == nil {
+		t.Errorf("want an error for a failing command")
+	}
+}
+
+func TestFakeHypervisorMount(t *testing.T) {
+	vi, hv := startFakeVM(t, Config{}, nil)
+
+	fm := NewFileManager(newTestLogger(), vi)
+
+	err := fm.Mount("vdb1", MountConfig{})
+	if err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+
+	if !hasCommand(hv.Commands(), "mkdir -p /mnt && mount /dev/vdb1 /mnt") {
+		t.Errorf("no mount command run, have %q", hv.Commands())
+	}
+
+	err = fm.Mount("vdb2", MountConfig{})
+	if err == nil {
+		t.Errorf("want an error for a second mount at /mnt")
+	}
+}
+
+// Starts the VM, waits for it to be ready and cancels it.
+// Returns how long it took for the VM to exit after being canceled.
+func runAndCancelFakeVM(t *testing.T, hv *FakeHypervisor, shutdownTimeout time.Duration) time.Duration {
+	t.Helper()
+
+	vi, err := NewVM(newTestLogger(), Config{
+		Hypervisor:      hv,
+		OSUpTimeout:     time.Second * 10,
+		SSHUpTimeout:    time.Second * 10,
+		ShutdownTimeout: shutdownTimeout,
+	})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- vi.Run()
+	}()
+
+	select {
+	case <-vi.SSHUpNotifyChan():
+	case <-time.After(time.Second * 10):
+		t.Fatalf("vm was not ready in time")
+	}
+
+	start := time.Now()
+
+	err = vi.Cancel()
+	if err != nil {
+		t.Fatalf("cancel vm: %v", err)
+	}
+
+	select {
+	case err := <-runErrCh:
+		if err != nil {
+			t.Fatalf("run vm: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("vm did not exit in time")
+	}
+
+	return time.Since(start)
+}
+
+func TestFakeHypervisorShutdown(t *testing.T) {
+	hv := NewFakeHypervisor(newTestLogger(), nil)
+
+	runAndCancelFakeVM(t, hv, time.Second*5)
+
+	commands := hv.Commands()
+
+	if !hasCommand(commands, "poweroff") {
+		t.Errorf("vm was not powered off, have %q", commands)
+	}
+
+	// The teardown is to be done before powering off.
+	if commands[len(commands)-1] != "poweroff" || !hasCommand(commands[:len(commands)-1], "sync") {
+		t.Errorf("teardown was not run before poweroff, have %q", commands)
+	}
+
+	if stops := hv.Stops(); len(stops) != 0 {
+		t.Errorf("want the vm stopped by the guest alone, have %q", stops)
+	}
+}
+
+func TestFakeHypervisorSlowShutdown(t *testing.T) {
+	hv := NewFakeHypervisor(newTestLogger(), nil)
+	hv.PoweroffDelay = time.Second
+
+	took := runAndCancelFakeVM(t, hv, time.Second*5)
+
+	if took < hv.PoweroffDelay {
+		t.Errorf("want the guest waited for, the vm exited after %v", took)
+	}
+
+	if stops := hv.Stops(); len(stops) != 0 {
+		t.Errorf("want the vm stopped by the guest alone, have %q", stops)
+	}
+}
+
+func TestFakeHypervisorForceStop(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		ignoreTerminate bool
+		want            []string
+	}{
+		{
+			name: "terminate",
+			want: []string{"terminate"},
+		},
+		{
+			name:            "kill",
+			ignoreTerminate: true,
+			want:            []string{"terminate", "kill"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hv := NewFakeHypervisor(newTestLogger(), nil)
+			hv.IgnorePoweroff = true
+			hv.IgnoreTerminate = tc.ignoreTerminate
+
+			runAndCancelFakeVM(t, hv, time.Second)
+
+			if have := hv.Stops(); !reflect.DeepEqual(tc.want, have) {
+				t.Errorf("want stops %q, have %q", tc.want, have)
+			}
+		})
+	}
+}
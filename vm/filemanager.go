@@ -20,13 +20,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
-	"os"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/AlexSSD7/linsk/sshutil"
@@ -35,13 +36,24 @@ import (
 	"github.com/pkg/errors"
 	"go.uber.org/multierr"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/term"
 )
 
 type FileManager struct {
 	logger *slog.Logger
 
 	vm *VM
+
+	// Names of the mounts made. An empty name
+	// stands for the device mounted at /mnt itself.
+	mounts   []string
+	mountsMu sync.Mutex
+
+	separateShares bool
+
+	luksSecretSource LUKSSecretSource
+	luksMaxAttempts  int
+
+	luksContainerCount atomic.Int32
 }
 
 func NewFileManager(logger *slog.Logger, vm *VM) *FileManager {
@@ -52,125 +64,332 @@ func NewFileManager(logger *slog.Logger, vm *VM) *FileManager {
 	}
 }
 
-func (fm *FileManager) InitLVM() error {
+// Lsblk returns the tree of block devices available in the VM.
+func (fm *FileManager) Lsblk() ([]BlockDevice, error) {
 	sc, err := fm.vm.DialSSH()
 	if err != nil {
-		return errors.Wrap(err, "dial vm ssh")
+		return nil, errors.Wrap(err, "dial vm ssh")
 	}
 
 	defer func() { _ = sc.Close() }()
 
-	_, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, "vgchange -ay")
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "lsblk -J -b -o "+lsblkColumns+" -e 7,11,2")
 	if err != nil {
-		return errors.Wrap(err, "run vgchange cmd")
+		return nil, errors.Wrap(err, "run lsblk")
 	}
 
-	return nil
+	ret, err := parseLsblkOutput(out)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse lsblk output")
+	}
+
+	return ret, nil
 }
 
-func (fm *FileManager) Lsblk() ([]byte, error) {
-	sc, err := fm.vm.DialSSH()
+type MountConfig struct {
+	LUKSContainersPreopen []LUKSContainer
+
+	FSTypeOverride string
+	MountOptions   string
+
+	// The Btrfs subvolume to mount instead of the default one, in the
+	// format accepted by ParseBtrfsSubvolume. Cannot be combined with
+	// BtrfsAllSubvolumes.
+	BtrfsSubvolume string
+
+	// Mounts the top-level Btrfs subvolume and every subvolume and snapshot
+	// at their own folders under the mount point, for example to access
+	// the point-in-time state of files kept in snapshots.
+	BtrfsAllSubvolumes bool
+
+	// The encryption layer to open before mounting. LUKS
+	// is a shorthand for Encryption set to EncryptionLUKS.
+	Encryption EncryptionType
+	LUKS       bool
+	VeraCrypt  VeraCryptOptions
+
+	// The name of the mapping under /dev/mapper for the encrypted
+	// device. If empty, it is derived from the mount name.
+	MapperName string
+
+	// The source of secrets for the encrypted device and the LUKS containers to preopen.
+	// If nil, the one set with FileManager.SetLUKSSecretSource is used.
+	LUKSSecretSource LUKSSecretSource
+
+	// If set, the device is mounted at /mnt/<name> instead of /mnt, which
+	// allows mounting several devices at once. With separate shares enabled,
+	// the name is also used as the share name.
+	Name string
+}
+
+// The directory in the VM where LUKS keyfiles and headers are
+// temporarily stored. It is a tmpfs. LUKS2 headers take up to 16 MiB.
+const luksSecretFilesDir = "/run/linsk-secrets"
+
+// Returns a new path in the secret files directory, creating the directory if needed.
+func (fm *FileManager) getLUKSSecretFilePath(sc *ssh.Client) (string, error) {
+	_, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "mkdir -p "+luksSecretFilesDir+" && (mountpoint -q "+luksSecretFilesDir+" || mount -t tmpfs -o size=64m,mode=0700 tmpfs "+luksSecretFilesDir+")")
 	if err != nil {
-		return nil, errors.Wrap(err, "dial vm ssh")
+		return "", errors.Wrap(err, "mount secret files tmpfs")
 	}
 
-	ret, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "lsblk -o NAME,SIZE,FSTYPE,LABEL -e 7,11,2")
+	nameBytes := make([]byte, 8)
+	_, err = rand.Read(nameBytes)
 	if err != nil {
-		return nil, errors.Wrap(err, "run lsblk")
+		return "", errors.Wrap(err, "read random secret file name")
 	}
 
-	return ret, nil
+	return luksSecretFilesDir + "/" + hex.EncodeToString(nameBytes), nil
 }
 
-type MountConfig struct {
-	LUKSContainerPreopen string
+func (fm *FileManager) uploadLUKSSecretFile(sc *ssh.Client, data []byte) (string, error) {
+	return fm.uploadLUKSSecretFileFrom(sc, bytes.NewReader(data), time.Second*5)
+}
 
-	FSTypeOverride string
-	LUKS           bool
-	MountOptions   string
+func (fm *FileManager) uploadLUKSSecretFileFrom(sc *ssh.Client, r io.Reader, timeout time.Duration) (string, error) {
+	keyfilePath, err := fm.getLUKSSecretFilePath(sc)
+	if err != nil {
+		return "", err
+	}
+
+	scpCtx, scpCtxCancel := context.WithTimeout(fm.vm.ctx, timeout)
+	defer scpCtxCancel()
+
+	scpClient, err := fm.vm.DialSCP()
+	if err != nil {
+		return "", errors.Wrap(err, "dial scp")
+	}
+
+	defer scpClient.Close()
+
+	err = scpClient.CopyFile(scpCtx, r, keyfilePath, "0400")
+	if err != nil {
+		return "", errors.Wrap(err, "copy secret file")
+	}
+
+	return keyfilePath, nil
 }
 
-func (fm *FileManager) luksOpen(sc *ssh.Client, fullDevPath string, luksDMName string) error {
-	lg := fm.logger.With("vm-path", fullDevPath)
+func (fm *FileManager) wipeLUKSSecretFile(sc *ssh.Client, path string) {
+	_, err := sshutil.RunSSHCmd(context.Background(), sc, "shred -u "+path+" 2> /dev/null || rm -f "+path)
+	if err != nil {
+		fm.logger.Warn("Failed to wipe the LUKS secret file in the VM", "path", path, "error", err.Error())
+	}
+}
 
-	return sshutil.NewSSHSessionWithDelayedTimeout(fm.vm.ctx, time.Second*15, sc, func(sess *ssh.Session, startTimeout func(preTimeout func())) error {
-		stdinPipe, err := sess.StdinPipe()
+// SetLUKSSecretSource sets the source of secrets for LUKS devices which
+// don't have one set explicitly. The default is TerminalLUKSSecretSource.
+func (fm *FileManager) SetLUKSSecretSource(src LUKSSecretSource) {
+	fm.luksSecretSource = src
+}
+
+func (fm *FileManager) getLUKSSecretSource(src LUKSSecretSource) LUKSSecretSource {
+	if src != nil {
+		return src
+	}
+
+	if fm.luksSecretSource != nil {
+		return fm.luksSecretSource
+	}
+
+	return TerminalLUKSSecretSource{}
+}
+
+// SetLUKSMaxAttempts sets how many times to ask for the secret when
+// the previous one was wrong. The default is defaultLUKSMaxAttempts.
+func (fm *FileManager) SetLUKSMaxAttempts(n int) {
+	fm.luksMaxAttempts = n
+}
+
+func (fm *FileManager) luksOpen(sc *ssh.Client, fullDevPath string, luksDMName string, src LUKSSecretSource) error {
+	return fm.cryptOpen(sc, fullDevPath, luksDMName, EncryptionLUKS, VeraCryptOptions{}, src)
+}
+
+func (fm *FileManager) cryptOpen(sc *ssh.Client, fullDevPath string, dmName string, et EncryptionType, vc VeraCryptOptions, src LUKSSecretSource) error {
+	lg := fm.logger.With("vm-path", fullDevPath, "encryption", et)
+
+	openArgs, err := getCryptOpenArgs(et, vc)
+	if err != nil {
+		return err
+	}
+
+	if et == EncryptionLUKS {
+		restoreMemory, err := fm.ensureLUKSMemory(sc, fullDevPath)
 		if err != nil {
-			return errors.Wrap(err, "create vm ssh session stdin pipe")
+			return errors.Wrap(err, "ensure luks memory")
 		}
 
-		stderrBuf := bytes.NewBuffer(nil)
-		sess.Stderr = stderrBuf
+		defer restoreMemory()
+	}
 
-		err = sess.Start("cryptsetup luksOpen " + shellescape.Quote(fullDevPath) + " " + luksDMName)
+	lg.Info("Attempting to open an encrypted device")
+
+	err = fm.withLUKSSecret(fullDevPath, src, func(secret *LUKSSecret) error {
+		return fm.cryptOpenWithSecret(sc, fullDevPath, dmName, openArgs, secret)
+	})
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Encrypted device opened successfully")
+
+	return nil
+}
+
+// withLUKSSecret calls fn with secrets from the source until fn
+// stops returning ErrLUKSWrongPassphrase or the attempts run out.
+func (fm *FileManager) withLUKSSecret(fullDevPath string, src LUKSSecretSource, fn func(secret *LUKSSecret) error) error {
+	maxAttempts := fm.luksMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultLUKSMaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		secret, err := fm.getLUKSSecretSource(src).GetLUKSSecret(LUKSSecretRequest{
+			DevPath: fullDevPath,
+			Attempt: attempt,
+		})
 		if err != nil {
-			return errors.Wrap(err, "start cryptsetup luksopen cmd")
+			return errors.Wrap(err, "get luks secret")
+		}
+
+		err = fn(secret)
+		secret.Wipe()
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, ErrLUKSWrongPassphrase) || attempt >= maxAttempts {
+			return err
 		}
 
-		lg.Info("Attempting to open a LUKS device")
+		fm.logger.Warn("Wrong password", "vm-path", fullDevPath, "attempt", attempt, "max-attempts", maxAttempts)
+	}
+}
+
+func (fm *FileManager) cryptOpenWithSecret(sc *ssh.Client, fullDevPath string, dmName string, openArgs string, secret *LUKSSecret) error {
+	lg := fm.logger.With("vm-path", fullDevPath)
+
+	cmd := "cryptsetup " + openArgs + " "
+
+	readOnly, err := fm.isReadOnlyDev(sc, fullDevPath)
+	if err != nil {
+		return errors.Wrap(err, "check if device is read-only")
+	}
+
+	if readOnly {
+		cmd += "--readonly "
+	}
 
-		_, err = os.Stderr.Write([]byte("Enter Password: "))
+	if secret.Keyfile != nil {
+		keyfilePath, err := fm.uploadLUKSSecretFile(sc, secret.Keyfile)
 		if err != nil {
-			return errors.Wrap(err, "write prompt to stderr")
+			return errors.Wrap(err, "upload luks keyfile")
 		}
 
-		pwd, err := term.ReadPassword(int(syscall.Stdin)) //nolint:unconvert // On Windows it's a different non-int type.
+		defer fm.wipeLUKSSecretFile(sc, keyfilePath)
+
+		cmd += "--key-file " + keyfilePath + " "
+	}
+
+	return sshutil.NewSSHSessionWithDelayedTimeout(fm.vm.ctx, time.Second*15, sc, func(sess *ssh.Session, startTimeout func(preTimeout func())) error {
+		stdinPipe, err := sess.StdinPipe()
 		if err != nil {
-			return errors.Wrap(err, "read luks password")
+			return errors.Wrap(err, "create vm ssh session stdin pipe")
 		}
 
-		fmt.Print("\n")
+		stderrBuf := bytes.NewBuffer(nil)
+		sess.Stderr = stderrBuf
+
+		err = sess.Start(cmd + shellescape.Quote(fullDevPath) + " " + dmName)
+		if err != nil {
+			return errors.Wrap(err, "start cryptsetup open cmd")
+		}
 
-		// We start the timeout countdown now only to avoid timing out
-		// while the user is entering the password, or shortly after that.
 		startTimeout(func() {
-			lg.Warn("LUKS open command timed out. If you are using large-memory key derivation function, try increasing the VM memory allocation using --vm-mem-alloc flag.")
+			lg.Warn("Encrypted device open command timed out. If you are using large-memory key derivation function, try increasing the VM memory allocation using --vm-mem-alloc flag.")
 		})
 
 		var wErr error
 		var wWG sync.WaitGroup
 
-		wWG.Add(1)
-		go func() {
-			defer wWG.Done()
+		if secret.Passphrase != nil {
+			wWG.Add(1)
+			go func() {
+				defer wWG.Done()
+
+				_, err := stdinPipe.Write(secret.Passphrase)
+				_, err2 := stdinPipe.Write([]byte("\n"))
+				wErr = errors.Wrap(multierr.Combine(err, err2), "write password to stdin")
+			}()
+		} else {
+			// Some device types still ask for a passphrase when a keyfile is used.
+			_ = stdinPipe.Close()
+		}
 
-			_, err := stdinPipe.Write(pwd)
-			_, err2 := stdinPipe.Write([]byte("\n"))
-			wErr = errors.Wrap(multierr.Combine(err, err2), "write password to stdin")
-		}()
+		err = sess.Wait()
 
-		defer func() {
-			// Clear the memory up for security.
-			{
-				for i := 0; i < len(pwd); i++ {
-					pwd[i] = 0
-				}
-
-				// This is my paranoia.
-				_, _ = rand.Read(pwd)
-				_, _ = rand.Read(pwd)
-			}
-		}()
+		// The secret is wiped right after we return, so the writer must be done
+		// with it. The writes fail once the command exits, so this doesn't block.
+		wWG.Wait()
+		_ = stdinPipe.Close()
 
-		err = sess.Wait()
 		if err != nil {
+			if isCryptWrongPassphraseErr(err) {
+				return ErrLUKSWrongPassphrase
+			}
+
 			if strings.Contains(stderrBuf.String(), "Not enough available memory to open a keyslot.") {
-				fm.logger.Warn("Detected not enough memory to open a LUKS device, please allocate more memory using --vm-mem-alloc flag.")
+				fm.logger.Warn("Detected not enough memory to open a LUKS device, please allocate more memory using --vm-mem-alloc or --vm-mem-max flag.")
 			}
 
-			return utils.WrapErrWithLog(err, "wait for cryptsetup luksopen cmd to finish", stderrBuf.String())
+			return utils.WrapErrWithLog(err, "wait for cryptsetup open cmd to finish", stderrBuf.String())
 		}
 
-		lg.Info("LUKS device opened successfully")
-
-		_ = stdinPipe.Close()
-		wWG.Wait()
-
 		return wErr
 	})
 }
 
+// Closes the mapping opened with cryptOpen.
+func (fm *FileManager) cryptClose(sc *ssh.Client, dmName string) {
+	_, err := sshutil.RunSSHCmd(context.Background(), sc, "cryptsetup close "+shellescape.Quote(dmName))
+	if err != nil {
+		fm.logger.Warn("Failed to close the encrypted device", "name", dmName, "error", err.Error())
+	}
+}
+
+// LUKSContainer is a LUKS device to open before mounting anything,
+// for example one holding an LVM physical volume or a RAID member.
+type LUKSContainer struct {
+	// The device name relative to /dev, or a device selector.
+	DevName string
+
+	// The name of the mapping under /dev/mapper. It is generated if empty.
+	MapperName string
+}
+
+func validateMapperName(s string) bool {
+	return !strings.HasPrefix(s, "mapper/") && utils.ValidateDevName(s)
+}
+
+// The first container gets "cryptcontainer" for
+// compatibility, the next ones get a number appended.
+func (fm *FileManager) nextLUKSContainerMapperName() string {
+	n := fm.luksContainerCount.Add(1)
+	if n == 1 {
+		return "cryptcontainer"
+	}
+
+	return "cryptcontainer" + fmt.Sprint(n)
+}
+
 func (fm *FileManager) PreopenLUKSContainer(containerDevPath string) error {
+	return fm.PreopenLUKSContainers([]LUKSContainer{{DevName: containerDevPath}})
+}
+
+// PreopenLUKSContainers opens the LUKS containers one by one and then reinitializes
+// RAID and LVM to pick up the arrays and the volume groups behind them.
+func (fm *FileManager) PreopenLUKSContainers(containers []LUKSContainer) error {
 	sc, err := fm.vm.DialSSH()
 	if err != nil {
 		return errors.Wrap(err, "dial vm ssh")
@@ -178,21 +397,42 @@ func (fm *FileManager) PreopenLUKSContainer(containerDevPath string) error {
 
 	defer func() { _ = sc.Close() }()
 
-	return fm.preopenLUKSContainerWithSSH(sc, containerDevPath)
+	return fm.preopenLUKSContainersWithSSH(sc, containers, nil)
 }
 
-func (fm *FileManager) preopenLUKSContainerWithSSH(sc *ssh.Client, containerDevPath string) error {
-	if !utils.ValidateDevName(containerDevPath) {
-		return fmt.Errorf("bad luks container device name")
+func (fm *FileManager) preopenLUKSContainersWithSSH(sc *ssh.Client, containers []LUKSContainer, src LUKSSecretSource) error {
+	if len(containers) == 0 {
+		return nil
 	}
 
-	fullContainerDevPath := "/dev/" + containerDevPath
+	for _, c := range containers {
+		if c.MapperName != "" && !validateMapperName(c.MapperName) {
+			return fmt.Errorf("bad luks container mapper name '%v'", c.MapperName)
+		}
 
-	fm.logger.Info("Preopening a LUKS container", "container", fullContainerDevPath)
+		containerDevPath, err := fm.resolveDevName(sc, c.DevName)
+		if err != nil {
+			return errors.Wrap(err, "resolve luks container device name")
+		}
+
+		fullContainerDevPath := "/dev/" + containerDevPath
+
+		mapperName := c.MapperName
+		if mapperName == "" {
+			mapperName = fm.nextLUKSContainerMapperName()
+		}
 
-	err := fm.luksOpen(sc, fullContainerDevPath, "cryptcontainer")
+		fm.logger.Info("Preopening a LUKS container", "container", fullContainerDevPath, "mapper", mapperName)
+
+		err = fm.luksOpen(sc, fullContainerDevPath, mapperName, src)
+		if err != nil {
+			return errors.Wrapf(err, "luks (pre)open container '%v'", fullContainerDevPath)
+		}
+	}
+
+	err := fm.InitRAID()
 	if err != nil {
-		return errors.Wrap(err, "luks (pre)open container")
+		return errors.Wrap(err, "reinit raid")
 	}
 
 	err = fm.InitLVM()
@@ -208,18 +448,12 @@ func (fm *FileManager) Mount(devName string, mc MountConfig) error {
 		return fmt.Errorf("device name is empty")
 	}
 
-	// It does allow "mapper/" prefix for mapped devices.
-	// This is to enable the support for LVM and LUKS.
-	if !utils.ValidateDevName(devName) {
+	// Device selectors are resolved after dialing SSH.
+	_, _, isSelector := ParseDevSelector(devName)
+	if !isSelector && !utils.ValidateDevName(devName) {
 		return fmt.Errorf("bad device name")
 	}
 
-	// We're intentionally not calling filepath.Clean() as
-	// this causes unintended consequences when run on Windows.
-	// (Windows Go standard library treats the path as it's for
-	// Windows, but we're targeting a Linux VM.)
-	fullDevPath := "/dev/" + devName
-
 	var fsOverride string
 	if mc.FSTypeOverride != "" {
 		if !utils.ValidateFsType(mc.FSTypeOverride) {
@@ -236,6 +470,63 @@ func (fm *FileManager) Mount(devName string, mc MountConfig) error {
 		mountOptions = mc.MountOptions
 	}
 
+	if mc.BtrfsSubvolume != "" {
+		if mc.BtrfsAllSubvolumes {
+			return fmt.Errorf("btrfs subvolume cannot be combined with mounting all subvolumes")
+		}
+
+		subvolOption, err := ParseBtrfsSubvolume(mc.BtrfsSubvolume)
+		if err != nil {
+			return errors.Wrap(err, "parse btrfs subvolume")
+		}
+
+		if mountOptions != "" {
+			mountOptions += ","
+		}
+
+		mountOptions += subvolOption
+	}
+
+	if mc.BtrfsAllSubvolumes && fsOverride != "" && fsOverride != FSTypeBtrfs {
+		return fmt.Errorf("mounting all btrfs subvolumes conflicts with fs type override '%v'", fsOverride)
+	}
+
+	mountPoint := "/mnt"
+	luksDMName := "cryptmnt"
+	if mc.Name != "" {
+		if !utils.ValidateMountName(mc.Name) {
+			return fmt.Errorf("bad mount name '%v'", mc.Name)
+		}
+
+		mountPoint += "/" + mc.Name
+		luksDMName += "_" + mc.Name
+	}
+
+	if mc.MapperName != "" {
+		if !validateMapperName(mc.MapperName) {
+			return fmt.Errorf("bad mapper name '%v'", mc.MapperName)
+		}
+
+		luksDMName = mc.MapperName
+	}
+
+	encryption := mc.Encryption
+	if mc.LUKS {
+		if encryption != EncryptionNone && encryption != EncryptionLUKS {
+			return fmt.Errorf("luks conflicts with encryption type '%v'", encryption)
+		}
+
+		encryption = EncryptionLUKS
+	}
+
+	fm.mountsMu.Lock()
+	defer fm.mountsMu.Unlock()
+
+	err := fm.checkMountNameLocked(mc.Name)
+	if err != nil {
+		return err
+	}
+
 	sc, err := fm.vm.DialSSH()
 	if err != nil {
 		return errors.Wrap(err, "dial vm ssh")
@@ -243,45 +534,214 @@ func (fm *FileManager) Mount(devName string, mc MountConfig) error {
 
 	defer func() { _ = sc.Close() }()
 
-	if mc.LUKSContainerPreopen != "" {
-		err := fm.preopenLUKSContainerWithSSH(sc, mc.LUKSContainerPreopen)
+	err = fm.preopenLUKSContainersWithSSH(sc, mc.LUKSContainersPreopen, mc.LUKSSecretSource)
+	if err != nil {
+		return errors.Wrap(err, "preopen luks containers")
+	}
+
+	// The selector may point to a device behind the preopened LUKS container.
+	devName, err = fm.resolveDevName(sc, devName)
+	if err != nil {
+		return errors.Wrap(err, "resolve device name")
+	}
+
+	// We're intentionally not calling filepath.Clean() as
+	// this causes unintended consequences when run on Windows.
+	// (Windows Go standard library treats the path as it's for
+	// Windows, but we're targeting a Linux VM.)
+	fullDevPath := "/dev/" + devName
+
+	var mounted bool
+
+	if encryption != EncryptionNone {
+		err = fm.cryptOpen(sc, fullDevPath, luksDMName, encryption, mc.VeraCrypt, mc.LUKSSecretSource)
 		if err != nil {
-			return errors.Wrap(err, "preopen luks container")
+			return errors.Wrapf(err, "open %v device", encryption)
 		}
+
+		// Otherwise, the mapping would stay open with the mapper name taken.
+		defer func() {
+			if !mounted {
+				fm.cryptClose(sc, luksDMName)
+			}
+		}()
+
+		fullDevPath = "/dev/mapper/" + luksDMName
 	}
 
-	if mc.LUKS {
-		luksDMName := "cryptmnt"
+	readOnly, err := fm.isReadOnlyDev(sc, fullDevPath)
+	if err != nil {
+		return errors.Wrap(err, "check if device is read-only")
+	}
 
-		err = fm.luksOpen(sc, fullDevPath, luksDMName)
+	if readOnly {
+		mountOptions, err = fm.getReadOnlyMountOptions(sc, fullDevPath, fsOverride, mountOptions)
 		if err != nil {
-			return errors.Wrap(err, "luks open")
+			return errors.Wrap(err, "get read-only mount options")
 		}
+	}
 
-		fullDevPath = "/dev/mapper/" + luksDMName
+	if mc.BtrfsAllSubvolumes {
+		err = fm.mountBtrfsSubvolumes(sc, fullDevPath, mountPoint, mountOptions)
+		if err != nil {
+			return errors.Wrap(err, "mount btrfs subvolumes")
+		}
+
+		mounted = true
+		fm.mounts = append(fm.mounts, mc.Name)
+
+		return nil
 	}
 
-	cmd := "mount "
+	if mc.BtrfsSubvolume != "" {
+		err = fm.scanBtrfsDevices(sc)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := "mkdir -p " + mountPoint + " && mount "
 	if fsOverride != "" {
 		cmd += "-t " + shellescape.Quote(fsOverride) + " "
 	}
 	if mountOptions != "" {
 		cmd += "-o " + shellescape.Quote(mountOptions) + " "
 	}
-	cmd += shellescape.Quote(fullDevPath) + " /mnt"
+	cmd += shellescape.Quote(fullDevPath) + " " + mountPoint
 
 	_, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, cmd)
 	if err != nil {
 		return errors.Wrap(err, "run mount cmd")
 	}
 
+	mounted = true
+	fm.mounts = append(fm.mounts, mc.Name)
+
 	return nil
 }
 
+// Needs mountsMu to be held.
+func (fm *FileManager) checkMountNameLocked(mountName string) error {
+	for _, name := range fm.mounts {
+		switch {
+		case name == mountName:
+			return fmt.Errorf("mount name '%v' is already in use", mountName)
+		case name == "" || mountName == "":
+			return fmt.Errorf("a device mounted at /mnt cannot be combined with other mounts")
+		}
+	}
+
+	return nil
+}
+
+// SetSeparateShares makes the file share servers export every named mount
+// as its own share. Otherwise, a single "linsk" share with named mounts as
+// subfolders is exported. It needs to be called before starting any share.
+func (fm *FileManager) SetSeparateShares(separate bool) {
+	fm.mountsMu.Lock()
+	defer fm.mountsMu.Unlock()
+
+	fm.separateShares = separate
+}
+
+type shareDir struct {
+	Name string
+	Path string
+}
+
+func (fm *FileManager) getShareDirs() []shareDir {
+	fm.mountsMu.Lock()
+	defer fm.mountsMu.Unlock()
+
+	var ret []shareDir
+
+	if fm.separateShares {
+		for _, name := range fm.mounts {
+			if name != "" {
+				ret = append(ret, shareDir{Name: name, Path: "/mnt/" + name})
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		ret = append(ret, shareDir{Name: "linsk", Path: "/mnt"})
+	}
+
+	return ret
+}
+
+// ShareNames returns the names of the shares exported by the file share servers.
+func (fm *FileManager) ShareNames() []string {
+	var ret []string
+	for _, dir := range fm.getShareDirs() {
+		ret = append(ret, dir.Name)
+	}
+
+	return ret
+}
+
+// Mounting read-only is not enough for some file systems as they would
+// still replay the journal, which writes to the device.
+// Reports whether the device is read-only, which is the case for all devices
+// in the read-only mode, and for the ones on the drives attached read-only,
+// like disk images with the "ro" option. The devices mapped on top of
+// read-only devices are read-only too.
+func (fm *FileManager) isReadOnlyDev(sc *ssh.Client, fullDevPath string) (bool, error) {
+	if fm.vm.originalCfg.ReadOnly {
+		return true, nil
+	}
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, `cat "/sys/class/block/$(basename "$(readlink -f `+shellescape.Quote(fullDevPath)+`)")/ro"`)
+	if err != nil {
+		return false, errors.Wrap(err, "read device ro flag")
+	}
+
+	return strings.TrimSpace(string(out)) == "1", nil
+}
+
+func (fm *FileManager) getReadOnlyMountOptions(sc *ssh.Client, fullDevPath string, fsType string, mountOptions string) (string, error) {
+	if fsType == "" {
+		out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "blkid -o value -s TYPE "+shellescape.Quote(fullDevPath))
+		if err != nil {
+			return "", errors.Wrap(err, "detect fs type")
+		}
+
+		fsType = strings.TrimSpace(string(out))
+	}
+
+	opts := []string{"ro"}
+
+	switch fsType {
+	case "ext3", "ext4":
+		opts = append(opts, "noload")
+	case "xfs":
+		opts = append(opts, "norecovery")
+	case FSTypeBtrfs:
+		opts = append(opts, "nologreplay")
+	}
+
+	// Options that come later take precedence.
+	if mountOptions != "" {
+		opts = append([]string{mountOptions}, opts...)
+	}
+
+	return strings.Join(opts, ","), nil
+}
+
 func (fm *FileManager) StartFTP(pwd string, passivePortStart uint16, passivePortCount uint16, extIP net.IP) error {
+	writeEnable := "YES"
+	if fm.vm.originalCfg.ReadOnly {
+		writeEnable = "NO"
+	}
+
+	// FTP has no notion of shares, the chroot is /mnt.
+	if len(fm.getShareDirs()) > 1 {
+		fm.logger.Warn("FTP does not support separate shares, the mounts will be available as subfolders")
+	}
+
 	ftpdCfg := `anonymous_enable=NO
 local_enable=YES
-write_enable=YES
+write_enable=` + writeEnable + `
 local_umask=022
 chroot_local_user=YES
 allow_writeable_chroot=YES
@@ -296,6 +756,11 @@ pasv_address=` + extIP.String() + `
 }
 
 func (fm *FileManager) StartSMB(pwd string) error {
+	writeable := "yes"
+	if fm.vm.originalCfg.ReadOnly {
+		writeable = "no"
+	}
+
 	sambaCfg := `[global]
 workgroup = WORKGROUP
 dos charset = cp866
@@ -311,29 +776,44 @@ use sendfile = true
 aio read size = 16384
 aio write size = 16384
 server signing = no
+`
 
-[linsk]
+	for _, dir := range fm.getShareDirs() {
+		sambaCfg += `
+[` + dir.Name + `]
 browseable = yes
-writeable = yes
-path = /mnt
+writeable = ` + writeable + `
+path = ` + dir.Path + `
 force user = linsk
 force group = linsk
 create mask = 0664
 `
+	}
+
 	return fm.startGenericShare(pwd, sambaCfg, "/etc/samba/smb.conf", "samba", sshutil.ChangeSambaPass)
 }
 
 func (fm *FileManager) StartAFP(pwd string) error {
+	readOnly := "no"
+	if fm.vm.originalCfg.ReadOnly {
+		readOnly = "yes"
+	}
+
 	afpCfg := `[Global]
+`
 
-[linsk]
-path = /mnt
+	for _, dir := range fm.getShareDirs() {
+		afpCfg += `
+[` + dir.Name + `]
+path = ` + dir.Path + `
+read only = ` + readOnly + `
 file perm = 0664
 directory perm = 0775
 valid users = linsk
 force user = linsk
 force group = linsk
 `
+	}
 
 	return fm.startGenericShare(pwd, afpCfg, "/etc/afp.conf", "netatalk", sshutil.ChangeUnixPass)
 }
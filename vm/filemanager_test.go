@@ -0,0 +1,84 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMountReadOnlyDrive(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ro       string
+		wantCmd  string
+		wantOpen string
+	}{
+		{
+			name:     "writable",
+			ro:       "0\n",
+			wantCmd:  "mount /dev/mapper/cryptmnt /mnt",
+			wantOpen: "cryptsetup luksOpen /dev/vdb",
+		},
+		{
+			// Like a disk image attached with the "ro" option.
+			name:     "read-only",
+			ro:       "1\n",
+			wantCmd:  "mount -o ro,noload /dev/mapper/cryptmnt /mnt",
+			wantOpen: "cryptsetup luksOpen --readonly /dev/vdb",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vi, hv := startFakeVM(t, Config{}, func(_ context.Context, cmd string, stdin io.Reader, stdout io.Writer, _ io.Writer) int {
+				switch {
+				case strings.Contains(cmd, "/sys/class/block/"):
+					_, _ = io.WriteString(stdout, tc.ro)
+				case strings.HasPrefix(cmd, "blkid "):
+					_, _ = io.WriteString(stdout, "ext4\n")
+				case strings.HasPrefix(cmd, "cryptsetup luksDump "):
+					return 1
+				case strings.HasPrefix(cmd, "cryptsetup luksOpen "):
+					_, _ = io.ReadAll(io.LimitReader(stdin, int64(len("secret\n"))))
+				}
+
+				return 0
+			})
+
+			fm := NewFileManager(newTestLogger(), vi)
+
+			err := fm.Mount("vdb", MountConfig{
+				LUKS: true,
+				LUKSSecretSource: LUKSSecretSourceFunc(func(_ LUKSSecretRequest) (*LUKSSecret, error) {
+					return &LUKSSecret{Passphrase: []byte("secret")}, nil
+				}),
+			})
+			if err != nil {
+				t.Fatalf("mount: %v", err)
+			}
+
+			if !hasCommand(hv.Commands(), tc.wantOpen) {
+				t.Errorf("want %q run, have %q", tc.wantOpen, hv.Commands())
+			}
+
+			if !hasCommand(hv.Commands(), tc.wantCmd) {
+				t.Errorf("want %q run, have %q", tc.wantCmd, hv.Commands())
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+type FsckStatus string
+
+const (
+	// No errors were found.
+	FsckStatusClean FsckStatus = "clean"
+
+	// Errors were found and nothing was changed, as the check was run without repairing.
+	FsckStatusErrorsFound FsckStatus = "errors-found"
+
+	// Errors were found and repaired.
+	FsckStatusRepaired FsckStatus = "repaired"
+
+	// The repair finished, but the checker does not tell whether anything was repaired.
+	FsckStatusCompleted FsckStatus = "completed"
+
+	// Errors were found, and some of them could not be repaired.
+	FsckStatusErrorsLeft FsckStatus = "errors-left"
+
+	// The checker could not complete the check.
+	FsckStatusFailed FsckStatus = "failed"
+)
+
+type FsckConfig struct {
+	// Repairs the errors found. Otherwise, the file system is checked
+	// without writing anything to the device. Not allowed in read-only mode.
+	Repair bool
+
+	FSTypeOverride string
+
+	// The output of the checker is copied to it as it comes. Can be nil.
+	Output io.Writer
+}
+
+// FsckReport is the summary of a file system check.
+type FsckReport struct {
+	DevName  string     `json:"dev_name"`
+	FSType   string     `json:"fs_type"`
+	Command  string     `json:"command"`
+	Repair   bool       `json:"repair"`
+	ExitCode int        `json:"exit_code"`
+	Status   FsckStatus `json:"status"`
+
+	// Additional information about the outcome, for example what to do next.
+	Hint string `json:"hint,omitempty"`
+}
+
+func (r FsckReport) OK() bool {
+	switch r.Status {
+	case FsckStatusClean, FsckStatusRepaired, FsckStatusCompleted:
+		return true
+	default:
+		return false
+	}
+}
+
+type fsChecker struct {
+	// The device path is appended to the commands.
+	CheckCmd  string
+	RepairCmd string
+
+	GetStatus func(exitCode int, repair bool) (FsckStatus, string)
+}
+
+// The exit codes of e2fsck and the checkers following its
+// convention are bit masks, see the fsck(8) man page.
+func getConventionalFsckStatus(exitCode int, repair bool) (FsckStatus, string) {
+	switch {
+	case exitCode == 0:
+		return FsckStatusClean, ""
+	case exitCode&^(1|2|4) != 0:
+		return FsckStatusFailed, ""
+	case !repair:
+		// Nothing is written without repairing, whatever the checker reports.
+		return FsckStatusErrorsFound, ""
+	case exitCode&4 != 0:
+		return FsckStatusErrorsLeft, "Some of the errors need to be repaired manually."
+	default:
+		return FsckStatusRepaired, ""
+	}
+}
+
+var fsCheckers = map[string]fsChecker{
+	"ext2": {
+		CheckCmd:  "e2fsck -f -n",
+		RepairCmd: "e2fsck -f -y",
+		GetStatus: getConventionalFsckStatus,
+	},
+	"ext3": {
+		CheckCmd:  "e2fsck -f -n",
+		RepairCmd: "e2fsck -f -y",
+		GetStatus: getConventionalFsckStatus,
+	},
+	"ext4": {
+		CheckCmd:  "e2fsck -f -n",
+		RepairCmd: "e2fsck -f -y",
+		GetStatus: getConventionalFsckStatus,
+	},
+	"exfat": {
+		CheckCmd:  "fsck.exfat -n",
+		RepairCmd: "fsck.exfat -y",
+		GetStatus: getConventionalFsckStatus,
+	},
+	"xfs": {
+		CheckCmd:  "xfs_repair -n",
+		RepairCmd: "xfs_repair",
+		GetStatus: func(exitCode int, repair bool) (FsckStatus, string) {
+			switch {
+			case exitCode == 0 && repair:
+				return FsckStatusCompleted, ""
+			case exitCode == 0:
+				return FsckStatusClean, ""
+			case exitCode == 1 && !repair:
+				return FsckStatusErrorsFound, ""
+			case exitCode == 2:
+				return FsckStatusFailed, "The file system log needs to be replayed first, which is done by mounting the file system."
+			default:
+				return FsckStatusFailed, ""
+			}
+		},
+	},
+	"btrfs": {
+		CheckCmd:  "btrfs check --readonly",
+		RepairCmd: "btrfs check --repair",
+		GetStatus: func(exitCode int, repair bool) (FsckStatus, string) {
+			switch {
+			case exitCode == 0 && repair:
+				return FsckStatusCompleted, ""
+			case exitCode == 0:
+				return FsckStatusClean, ""
+			case repair:
+				return FsckStatusErrorsLeft, ""
+			default:
+				return FsckStatusErrorsFound, "Btrfs repairs can make things worse. Consider copying the data off with a read-only mount, or running \"btrfs scrub\" first."
+			}
+		},
+	},
+	"vfat": {
+		CheckCmd:  "fsck.vfat -n",
+		RepairCmd: "fsck.vfat -a",
+		GetStatus: func(exitCode int, repair bool) (FsckStatus, string) {
+			switch {
+			case exitCode == 0:
+				return FsckStatusClean, ""
+			case exitCode == 1 && repair:
+				return FsckStatusRepaired, ""
+			case exitCode == 1:
+				return FsckStatusErrorsFound, ""
+			default:
+				return FsckStatusFailed, ""
+			}
+		},
+	},
+	"ntfs": {
+		CheckCmd:  "ntfsfix -n",
+		RepairCmd: "ntfsfix",
+		GetStatus: func(exitCode int, repair bool) (FsckStatus, string) {
+			// ntfsfix fixes only the most common inconsistencies.
+			const hint = "For a full check, run chkdsk on Windows."
+
+			switch {
+			case exitCode == 0 && repair:
+				return FsckStatusCompleted, hint
+			case exitCode == 0:
+				return FsckStatusClean, hint
+			case !repair:
+				return FsckStatusErrorsFound, hint
+			default:
+				return FsckStatusFailed, hint
+			}
+		},
+	},
+}
+
+// FsckSupportedFSTypes returns the file system types Fsck can check.
+func FsckSupportedFSTypes() []string {
+	ret := make([]string, 0, len(fsCheckers))
+	for fsType := range fsCheckers {
+		ret = append(ret, fsType)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// The SSH session copies stdout and stderr in separate goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	return lw.w.Write(p)
+}
+
+// Fsck checks the file system on the device with the checker matching its type.
+// The checker exit codes are not treated as errors, they are reported instead.
+func (fm *FileManager) Fsck(devName string, fc FsckConfig) (FsckReport, error) {
+	_, _, isSelector := ParseDevSelector(devName)
+	if !isSelector && !utils.ValidateDevName(devName) {
+		return FsckReport{}, fmt.Errorf("bad device name")
+	}
+
+	if fc.FSTypeOverride != "" && !utils.ValidateFsType(fc.FSTypeOverride) {
+		return FsckReport{}, fmt.Errorf("bad fs type override (contains illegal characters)")
+	}
+
+	if fc.Repair && fm.vm.originalCfg.ReadOnly {
+		return FsckReport{}, ErrReadOnly
+	}
+
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return FsckReport{}, errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	devName, err = fm.resolveDevName(sc, devName)
+	if err != nil {
+		return FsckReport{}, errors.Wrap(err, "resolve device name")
+	}
+
+	fullDevPath := "/dev/" + devName
+
+	// Checking a mounted file system gives false errors, and repairing it corrupts it.
+	_, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, "! findmnt --source "+shellescape.Quote(fullDevPath)+" > /dev/null")
+	if err != nil {
+		return FsckReport{}, fmt.Errorf("device '%v' is mounted", fullDevPath)
+	}
+
+	fsType := fc.FSTypeOverride
+	if fsType == "" {
+		out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "blkid -c /dev/null -o value -s TYPE "+shellescape.Quote(fullDevPath)+" || true")
+		if err != nil {
+			return FsckReport{}, errors.Wrap(err, "detect fs type")
+		}
+
+		fsType = strings.TrimSpace(string(out))
+		if fsType == "" {
+			return FsckReport{}, fmt.Errorf("no file system detected on '%v'", fullDevPath)
+		}
+	}
+
+	checker, ok := fsCheckers[fsType]
+	if !ok {
+		return FsckReport{}, fmt.Errorf("checking '%v' file systems is not supported (supported: %v)", fsType, strings.Join(FsckSupportedFSTypes(), ", "))
+	}
+
+	cmd := checker.CheckCmd
+	if fc.Repair {
+		cmd = checker.RepairCmd
+	}
+
+	cmd += " " + shellescape.Quote(fullDevPath)
+
+	fm.logger.Info("Running file system checker", "dev", fullDevPath, "fs", fsType, "cmd", cmd)
+
+	output := fc.Output
+	if output == nil {
+		output = io.Discard
+	}
+
+	lw := &lockedWriter{w: output}
+
+	var exitCode int
+
+	// Checks of large file systems take hours, so there is no timeout.
+	err = sshutil.NewSSHSessionWithDelayedTimeout(fm.vm.ctx, 0, sc, func(sess *ssh.Session, _ func(preTimeout func())) error {
+		sess.Stdout = lw
+		sess.Stderr = lw
+
+		err := sess.Run(cmd)
+		if err != nil {
+			var exitErr *ssh.ExitError
+			if !errors.As(err, &exitErr) {
+				return errors.Wrap(err, "run checker")
+			}
+
+			exitCode = exitErr.ExitStatus()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	status, hint := checker.GetStatus(exitCode, fc.Repair)
+
+	return FsckReport{
+		DevName:  devName,
+		FSType:   fsType,
+		Command:  cmd,
+		Repair:   fc.Repair,
+		ExitCode: exitCode,
+		Status:   status,
+		Hint:     hint,
+	}, nil
+}
@@ -0,0 +1,111 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/AlexSSD7/linsk/qemucli"
+	"github.com/pkg/errors"
+)
+
+// QEMU firmware configuration (fw_cfg) items are exposed to the guest
+// under /sys/firmware/qemu_fw_cfg/by_name/<name>/raw. User-defined
+// item names must start with "opt/".
+const (
+	fwCfgPrefix = "opt/org.linsk/"
+
+	fwCfgAuthorizedKeysName = "authorized_keys"
+	fwCfgSSHHostKeyName     = "ssh_host_ed25519_key"
+)
+
+type fwCfgFile struct {
+	Name string
+	Data []byte
+}
+
+// writeFwCfgFiles writes the items to a temporary directory as QEMU accepts
+// only files (or strings which may not contain commas and equals signs).
+// It is the caller's responsibility to remove the directory afterwards.
+func writeFwCfgFiles(files []fwCfgFile) (string, []qemucli.Arg, error) {
+	dir, err := os.MkdirTemp("", "linsk-fwcfg-")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create temp dir")
+	}
+
+	var success bool
+	defer func() {
+		if !success {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	var args []qemucli.Arg
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name)
+
+		err = os.WriteFile(path, f.Data, 0600)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "write fw_cfg file '%v'", f.Name)
+		}
+
+		arg, err := qemucli.NewKeyValueArg("fw_cfg", []qemucli.KeyValueArgItem{
+			{Key: "name", Value: fwCfgPrefix + f.Name},
+			{Key: "file", Value: cleanQEMUPath(path)},
+		})
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "create fw_cfg key-value arg (name '%v')", f.Name)
+		}
+
+		args = append(args, arg)
+	}
+
+	success = true
+
+	return dir, args, nil
+}
+
+// GetSSHKeysInstallScript returns a guest-side shell script which installs
+// the SSH credentials passed through fw_cfg. It needs to be run before sshd
+// starts so that the server picks up the host key we know.
+func GetSSHKeysInstallScript() string {
+	fwCfgDir := "/sys/firmware/qemu_fw_cfg/by_name/" + fwCfgPrefix
+	return "(modprobe -q qemu_fw_cfg || true); mkdir -p /root/.ssh /etc/ssh && " +
+		"cat " + fwCfgDir + fwCfgAuthorizedKeysName + "/raw > /root/.ssh/authorized_keys && " +
+		"(umask 077; cat " + fwCfgDir + fwCfgSSHHostKeyName + "/raw > /etc/ssh/" + fwCfgSSHHostKeyName + ")"
+}
+
+// GetSSHKeysInitScript returns the OpenRC service definition that
+// installs the SSH credentials at boot.
+func GetSSHKeysInitScript() string {
+	return `#!/sbin/openrc-run
+description="Install Linsk SSH credentials from QEMU fw_cfg"
+
+depend() {
+	after modules
+	before sshd
+}
+
+start() {
+	ebegin "Installing Linsk SSH credentials"
+	sh -c '` + GetSSHKeysInstallScript() + `'
+	eend $?
+}
+`
+}
@@ -0,0 +1,78 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"io"
+)
+
+// Hypervisor is the backend which actually runs the VM. The VM type
+// drives the guest over SSH and does not care about what runs it, be it
+// QEMU, another hypervisor or an in-process fake.
+type Hypervisor interface {
+	// Prepare constructs everything needed to launch the VM (the command
+	// line in case of QEMU). It is called once, before Start.
+	Prepare(spec HypervisorSpec) error
+
+	// Start launches the VM. It does not wait for the VM to exit.
+	Start() error
+
+	// Wait blocks until the VM exits.
+	Wait() error
+
+	// Shutdown asks the guest OS to shut down (e.g. with an ACPI
+	// power button press). It does not wait for the VM to exit.
+	Shutdown(ctx context.Context) error
+
+	// Terminate asks the hypervisor to stop the VM without involving the guest OS.
+	Terminate() error
+
+	// Kill stops the VM immediately.
+	Kill() error
+
+	// Console returns the VM serial console streams.
+	// Both are nil if the hypervisor provides no console.
+	Console() (io.Reader, io.Writer)
+
+	// AgentAddr returns the host TCP address of the guest agent channel.
+	// ErrAgentUnavailable is returned if there is none.
+	AgentAddr() (string, error)
+
+	// SoftwareEmulated reports whether the VM is run without hardware
+	// acceleration, meaning that everything will be a lot slower.
+	SoftwareEmulated() bool
+
+	// Log returns the diagnostic output of the hypervisor, if any.
+	Log() string
+
+	// Close releases all resources held, including the console streams.
+	Close() error
+}
+
+type HypervisorSpec struct {
+	Config Config
+
+	// Includes the rule for the guest SSH server.
+	PortForwardingRules []PortForwardingRule
+
+	// The SSH credentials the guest is expected to use. The
+	// authorized key is in the authorized_keys file format,
+	// and the host key is a PEM-encoded private key.
+	SSHAuthorizedKey []byte
+	SSHHostKeyPEM    []byte
+}
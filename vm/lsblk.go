@@ -0,0 +1,200 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FSTypeLUKS      = "crypto_LUKS"
+	FSTypeBitLocker = "BitLocker"
+	FSTypeLVMPV     = "LVM2_member"
+	FSTypeZFSMember = "zfs_member"
+
+	FSTypeRAIDMember = "linux_raid_member"
+)
+
+// BlockDevice is a block device as seen by lsblk inside the VM.
+type BlockDevice struct {
+	Name       string `json:"name"`
+	ParentName string `json:"parent_name,omitempty"`
+	Type       string `json:"type"`
+	Size       uint64 `json:"size"`
+	FSType     string `json:"fs_type,omitempty"`
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	PartLabel  string `json:"part_label,omitempty"`
+	MountPoint string `json:"mount_point,omitempty"`
+	ReadOnly   bool   `json:"read_only"`
+
+	Children []BlockDevice `json:"children,omitempty"`
+}
+
+func (bd BlockDevice) IsLUKS() bool {
+	return bd.FSType == FSTypeLUKS
+}
+
+// DetectedEncryption returns the type of the encryption if it can be detected.
+// VeraCrypt and TrueCrypt volumes are indistinguishable from random data.
+func (bd BlockDevice) DetectedEncryption() EncryptionType {
+	switch bd.FSType {
+	case FSTypeLUKS:
+		return EncryptionLUKS
+	case FSTypeBitLocker:
+		return EncryptionBitLocker
+	default:
+		return EncryptionNone
+	}
+}
+
+func (bd BlockDevice) IsLVMPV() bool {
+	return bd.FSType == FSTypeLVMPV
+}
+
+func (bd BlockDevice) IsZFSMember() bool {
+	return bd.FSType == FSTypeZFSMember
+}
+
+func (bd BlockDevice) IsRAIDMember() bool {
+	return bd.FSType == FSTypeRAIDMember
+}
+
+// IsRAIDArray reports whether the device is an mdadm array, e.g. of the "raid1" type.
+func (bd BlockDevice) IsRAIDArray() bool {
+	return strings.HasPrefix(bd.Name, "md") && (strings.HasPrefix(bd.Type, "raid") || bd.Type == "linear")
+}
+
+const lsblkColumns = "NAME,SIZE,FSTYPE,LABEL,UUID,PARTLABEL,TYPE,MOUNTPOINT,RO,PKNAME"
+
+// The types of some of the fields differ between lsblk versions. Older ones
+// output everything as strings, hence the raw messages.
+type lsblkDevice struct {
+	Name       string          `json:"name"`
+	PKName     *string         `json:"pkname"`
+	Type       string          `json:"type"`
+	Size       json.RawMessage `json:"size"`
+	FSType     *string         `json:"fstype"`
+	Label      *string         `json:"label"`
+	UUID       *string         `json:"uuid"`
+	PartLabel  *string         `json:"partlabel"`
+	MountPoint *string         `json:"mountpoint"`
+	RO         json.RawMessage `json:"ro"`
+
+	Children []lsblkDevice `json:"children"`
+}
+
+type lsblkOutput struct {
+	BlockDevices []lsblkDevice `json:"blockdevices"`
+}
+
+func derefStr(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func parseLsblkUint(raw json.RawMessage) (uint64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+
+	s := string(bytes.Trim(raw, `"`))
+
+	ret, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse uint '%v'", s)
+	}
+
+	return ret, nil
+}
+
+func parseLsblkBool(raw json.RawMessage) (bool, error) {
+	switch string(raw) {
+	case "", "null", "false", `"0"`:
+		return false, nil
+	case "true", `"1"`:
+		return true, nil
+	default:
+		return false, fmt.Errorf("bad bool value '%v'", string(raw))
+	}
+}
+
+func (d lsblkDevice) toBlockDevice() (BlockDevice, error) {
+	size, err := parseLsblkUint(d.Size)
+	if err != nil {
+		return BlockDevice{}, errors.Wrapf(err, "parse size of '%v'", d.Name)
+	}
+
+	ro, err := parseLsblkBool(d.RO)
+	if err != nil {
+		return BlockDevice{}, errors.Wrapf(err, "parse ro of '%v'", d.Name)
+	}
+
+	ret := BlockDevice{
+		Name:       d.Name,
+		ParentName: derefStr(d.PKName),
+		Type:       d.Type,
+		Size:       size,
+		FSType:     derefStr(d.FSType),
+		Label:      derefStr(d.Label),
+		UUID:       derefStr(d.UUID),
+		PartLabel:  derefStr(d.PartLabel),
+		MountPoint: derefStr(d.MountPoint),
+		ReadOnly:   ro,
+	}
+
+	for _, child := range d.Children {
+		childBD, err := child.toBlockDevice()
+		if err != nil {
+			return BlockDevice{}, err
+		}
+
+		ret.Children = append(ret.Children, childBD)
+	}
+
+	return ret, nil
+}
+
+func parseLsblkOutput(data []byte) ([]BlockDevice, error) {
+	var out lsblkOutput
+
+	err := json.Unmarshal(data, &out)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal lsblk json")
+	}
+
+	ret := make([]BlockDevice, 0, len(out.BlockDevices))
+	for _, d := range out.BlockDevices {
+		bd, err := d.toBlockDevice()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, bd)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,185 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLsblkOutput(t *testing.T) {
+	// The same devices as printed by the different util-linux versions.
+	want := []BlockDevice{
+		{
+			Name: "vdb",
+			Type: "disk",
+			Size: 8589934592,
+			Children: []BlockDevice{
+				{
+					Name:       "vdb1",
+					ParentName: "vdb",
+					Type:       "part",
+					Size:       536870912,
+					FSType:     "vfat",
+					UUID:       "6E2B-1F4A",
+					PartLabel:  "EFI System Partition",
+				},
+				{
+					Name:       "vdb2",
+					ParentName: "vdb",
+					Type:       "part",
+					Size:       8051015680,
+					FSType:     "crypto_LUKS",
+					UUID:       "0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10",
+					Children: []BlockDevice{
+						{
+							Name:       "cryptcontainer",
+							ParentName: "vdb2",
+							Type:       "crypt",
+							Size:       8034238464,
+							FSType:     "ext4",
+							Label:      "root",
+							UUID:       "3c5bd7a8-2f0e-4d7e-8c6a-7d1f0b9e4a21",
+							MountPoint: "/mnt",
+							ReadOnly:   true,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{
+			// util-linux 2.37 and newer print numbers and booleans as such.
+			name: "typed",
+			data: `{
+   "blockdevices": [
+      {
+         "name": "vdb",
+         "size": 8589934592,
+         "fstype": null,
+         "label": null,
+         "uuid": null,
+         "partlabel": null,
+         "type": "disk",
+         "mountpoint": null,
+         "ro": false,
+         "pkname": null,
+         "children": [
+            {
+               "name": "vdb1",
+               "size": 536870912,
+               "fstype": "vfat",
+               "label": null,
+               "uuid": "6E2B-1F4A",
+               "partlabel": "EFI System Partition",
+               "type": "part",
+               "mountpoint": null,
+               "ro": false,
+               "pkname": "vdb"
+            },{
+               "name": "vdb2",
+               "size": 8051015680,
+               "fstype": "crypto_LUKS",
+               "label": null,
+               "uuid": "0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10",
+               "partlabel": null,
+               "type": "part",
+               "mountpoint": null,
+               "ro": false,
+               "pkname": "vdb",
+               "children": [
+                  {
+                     "name": "cryptcontainer",
+                     "size": 8034238464,
+                     "fstype": "ext4",
+                     "label": "root",
+                     "uuid": "3c5bd7a8-2f0e-4d7e-8c6a-7d1f0b9e4a21",
+                     "partlabel": null,
+                     "type": "crypt",
+                     "mountpoint": "/mnt",
+                     "ro": true,
+                     "pkname": "vdb2"
+                  }
+               ]
+            }
+         ]
+      }
+   ]
+}`,
+		},
+		{
+			// Older versions print everything as strings.
+			name: "strings",
+			data: `{
+   "blockdevices": [
+      {"name": "vdb", "size": "8589934592", "fstype": null, "label": null, "uuid": null, "partlabel": null, "type": "disk", "mountpoint": null, "ro": "0", "pkname": null,
+         "children": [
+            {"name": "vdb1", "size": "536870912", "fstype": "vfat", "label": null, "uuid": "6E2B-1F4A", "partlabel": "EFI System Partition", "type": "part", "mountpoint": null, "ro": "0", "pkname": "vdb"},
+            {"name": "vdb2", "size": "8051015680", "fstype": "crypto_LUKS", "label": null, "uuid": "0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10", "partlabel": null, "type": "part", "mountpoint": null, "ro": "0", "pkname": "vdb",
+               "children": [
+                  {"name": "cryptcontainer", "size": "8034238464", "fstype": "ext4", "label": "root", "uuid": "3c5bd7a8-2f0e-4d7e-8c6a-7d1f0b9e4a21", "partlabel": null, "type": "crypt", "mountpoint": "/mnt", "ro": "1", "pkname": "vdb2"}
+               ]
+            }
+         ]
+      }
+   ]
+}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := parseLsblkOutput([]byte(tc.data))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if !reflect.DeepEqual(want, have) {
+				t.Errorf("want %+v, have %+v", want, have)
+			}
+		})
+	}
+}
+
+func TestParseLsblkOutputErrors(t *testing.T) {
+	for _, data := range []string{
+		``,
+		`{"blockdevices": [{"name": "vdb", "size": "8G", "type": "disk"}]}`,
+		`{"blockdevices": [{"name": "vdb", "size": -1, "type": "disk"}]}`,
+		`{"blockdevices": [{"name": "vdb", "size": 1, "type": "disk", "ro": "yes"}]}`,
+		`{"blockdevices": [{"name": "vdb", "size": 1, "type": "disk", "children": [{"name": "vdb1", "size": "1.5"}]}]}`,
+	} {
+		_, err := parseLsblkOutput([]byte(data))
+		if err == nil {
+			t.Errorf("%q: want an error", data)
+		}
+	}
+}
+
+func TestParseLsblkOutputEmpty(t *testing.T) {
+	have, err := parseLsblkOutput([]byte(`{"blockdevices": []}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if len(have) != 0 {
+		t.Errorf("want no devices, have %+v", have)
+	}
+}
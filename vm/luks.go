@@ -0,0 +1,572 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Key derivation may take a while, especially with several keyslots to try.
+	luksCmdTimeout = time.Minute * 2
+
+	// LUKS2 headers are up to 16 MiB, which is slow to transfer on
+	// software-emulated VMs.
+	luksHeaderTransferTimeout = time.Minute * 5
+
+	// The memory needed by cryptsetup and the rest of the guest OS on top
+	// of the key derivation memory cost.
+	luksMemoryOverheadKiB = 128 * 1024
+
+	// How long to wait for the guest OS to take the memory from the balloon.
+	luksMemoryGrowTimeout = time.Second * 15
+)
+
+// LUKSAnyKeyslot lets cryptsetup pick the keyslot.
+const LUKSAnyKeyslot = -1
+
+type LUKSKeyslot struct {
+	ID     int    `json:"id"`
+	Type   string `json:"type"`
+	Cipher string `json:"cipher,omitempty"`
+	PBKDF  string `json:"pbkdf,omitempty"`
+
+	// The memory cost of Argon2 key derivation in KiB. Zero for PBKDF2.
+	Memory uint64 `json:"memory,omitempty"`
+}
+
+// LUKSHeaderInfo is the structured output of cryptsetup luksDump.
+type LUKSHeaderInfo struct {
+	Version  int           `json:"version"`
+	UUID     string        `json:"uuid"`
+	Label    string        `json:"label,omitempty"`
+	Cipher   string        `json:"cipher"`
+	Keyslots []LUKSKeyslot `json:"keyslots"`
+}
+
+// Splits "Key: value" lines. The indentation is reported
+// separately as it tells the sections of LUKS2 dumps apart.
+func splitLUKSDumpLine(line string) (string, string, bool) {
+	indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+
+	k, v, _ := strings.Cut(strings.TrimSpace(line), ":")
+
+	return strings.TrimSpace(k), strings.TrimSpace(v), indented
+}
+
+// parseLUKSDump parses the text output of cryptsetup luksDump. Both LUKS1 and LUKS2 are supported.
+func parseLUKSDump(out []byte) (*LUKSHeaderInfo, error) {
+	var info LUKSHeaderInfo
+
+	// LUKS1 only.
+	var cipherName, cipherMode string
+
+	// LUKS2 only.
+	var section string
+	var keyslot *LUKSKeyslot
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		k, v, indented := splitLUKSDumpLine(line)
+
+		if !indented {
+			keyslot = nil
+
+			switch {
+			case k == "Version":
+				version, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, errors.Wrap(err, "parse version")
+				}
+
+				info.Version = version
+			case k == "UUID":
+				info.UUID = v
+			case k == "Label":
+				if v != "(no label)" {
+					info.Label = v
+				}
+			case k == "Cipher name":
+				cipherName = v
+			case k == "Cipher mode":
+				cipherMode = v
+			case strings.HasPrefix(k, "Key Slot "):
+				if v != "ENABLED" {
+					continue
+				}
+
+				id, err := strconv.Atoi(strings.TrimPrefix(k, "Key Slot "))
+				if err != nil {
+					return nil, errors.Wrap(err, "parse luks1 keyslot id")
+				}
+
+				info.Keyslots = append(info.Keyslots, LUKSKeyslot{
+					ID:    id,
+					Type:  "luks1",
+					PBKDF: "pbkdf2",
+				})
+			case v == "":
+				section = k
+			}
+
+			continue
+		}
+
+		switch section {
+		case "Data segments":
+			if k == "cipher" && info.Cipher == "" {
+				info.Cipher = v
+			}
+		case "Keyslots":
+			// "  0: luks2" starts a new keyslot, the rest are its properties.
+			id, err := strconv.Atoi(k)
+			if err == nil {
+				info.Keyslots = append(info.Keyslots, LUKSKeyslot{
+					ID:   id,
+					Type: v,
+				})
+				keyslot = &info.Keyslots[len(info.Keyslots)-1]
+
+				continue
+			}
+
+			if keyslot == nil {
+				continue
+			}
+
+			switch k {
+			case "Cipher":
+				keyslot.Cipher = v
+			case "PBKDF":
+				keyslot.PBKDF = v
+			case "Memory":
+				memory, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					return nil, errors.Wrap(err, "parse luks2 keyslot memory cost")
+				}
+
+				keyslot.Memory = memory
+			}
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "scan luks dump output")
+	}
+
+	if info.Version == 0 {
+		return nil, fmt.Errorf("no luks version found")
+	}
+
+	if cipherName != "" {
+		info.Cipher = cipherName + "-" + cipherMode
+	}
+
+	for i := range info.Keyslots {
+		if info.Keyslots[i].Cipher == "" {
+			info.Keyslots[i].Cipher = info.Cipher
+		}
+	}
+
+	return &info, nil
+}
+
+// withLUKSDevice resolves the device name and makes sure it is a LUKS device.
+func (fm *FileManager) withLUKSDevice(devName string, fn func(sc *ssh.Client, fullDevPath string) error) error {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	devName, err = fm.resolveDevName(sc, devName)
+	if err != nil {
+		return errors.Wrap(err, "resolve device name")
+	}
+
+	fullDevPath := "/dev/" + devName
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "cryptsetup isLuks "+shellescape.Quote(fullDevPath)+" && echo yes || true")
+	if err != nil {
+		return errors.Wrap(err, "run cryptsetup isLuks")
+	}
+
+	if strings.TrimSpace(string(out)) != "yes" {
+		return fmt.Errorf("'%v' is not a luks device", fullDevPath)
+	}
+
+	return fn(sc, fullDevPath)
+}
+
+// runLUKSKeyCmd runs a cryptsetup command which needs an existing secret. The
+// secret is passed as a keyfile, the path to which is given to buildCmd.
+func (fm *FileManager) runLUKSKeyCmd(sc *ssh.Client, fullDevPath string, src LUKSSecretSource, buildCmd func(keyfilePath string) string) error {
+	restoreMemory, err := fm.ensureLUKSMemory(sc, fullDevPath)
+	if err != nil {
+		return errors.Wrap(err, "ensure luks memory")
+	}
+
+	defer restoreMemory()
+
+	return fm.withLUKSSecret(fullDevPath, src, func(secret *LUKSSecret) error {
+		keyfilePath, err := fm.uploadLUKSSecretFile(sc, secret.asKeyfile())
+		if err != nil {
+			return errors.Wrap(err, "upload luks keyfile")
+		}
+
+		defer fm.wipeLUKSSecretFile(sc, keyfilePath)
+
+		_, err = sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, buildCmd(keyfilePath))
+		if err != nil {
+			if isCryptWrongPassphraseErr(err) {
+				return ErrLUKSWrongPassphrase
+			}
+
+			return err
+		}
+
+		return nil
+	})
+}
+
+func getKeyslotArg(slot int) string {
+	if slot == LUKSAnyKeyslot {
+		return ""
+	}
+
+	return "--key-slot " + strconv.Itoa(slot) + " "
+}
+
+// LUKSDump returns the information from the header of a LUKS device.
+func (fm *FileManager) LUKSDump(devName string) (*LUKSHeaderInfo, error) {
+	var info *LUKSHeaderInfo
+
+	err := fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "cryptsetup luksDump "+shellescape.Quote(fullDevPath))
+		if err != nil {
+			return errors.Wrap(err, "run cryptsetup luksDump")
+		}
+
+		info, err = parseLUKSDump(out)
+		if err != nil {
+			return errors.Wrap(err, "parse luks dump")
+		}
+
+		return nil
+	})
+
+	return info, err
+}
+
+// LUKSAddKey adds a new secret to the device. An existing secret is taken
+// from src. Use LUKSAnyKeyslot to let cryptsetup pick the keyslot.
+func (fm *FileManager) LUKSAddKey(devName string, newSecret *LUKSSecret, slot int, src LUKSSecretSource) error {
+	return fm.changeLUKSKey("luksAddKey", devName, newSecret, slot, src)
+}
+
+// LUKSChangeKey replaces the secret taken from src with the new one. If slot
+// is not LUKSAnyKeyslot, only the secret in that keyslot is matched.
+func (fm *FileManager) LUKSChangeKey(devName string, newSecret *LUKSSecret, slot int, src LUKSSecretSource) error {
+	return fm.changeLUKSKey("luksChangeKey", devName, newSecret, slot, src)
+}
+
+func (fm *FileManager) changeLUKSKey(action string, devName string, newSecret *LUKSSecret, slot int, src LUKSSecretSource) error {
+	if fm.vm.originalCfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		newKeyfilePath, err := fm.uploadLUKSSecretFile(sc, newSecret.asKeyfile())
+		if err != nil {
+			return errors.Wrap(err, "upload new luks keyfile")
+		}
+
+		defer fm.wipeLUKSSecretFile(sc, newKeyfilePath)
+
+		err = fm.runLUKSKeyCmd(sc, fullDevPath, src, func(keyfilePath string) string {
+			return "cryptsetup " + action + " -q " + getKeyslotArg(slot) + "--key-file " + keyfilePath + " " + shellescape.Quote(fullDevPath) + " " + newKeyfilePath
+		})
+		if err != nil {
+			return errors.Wrapf(err, "run cryptsetup %v", action)
+		}
+
+		fm.logger.Info("Changed LUKS keys", "vm-path", fullDevPath, "action", action)
+
+		return nil
+	})
+}
+
+// LUKSRemoveKey removes the secret taken from src from the device.
+func (fm *FileManager) LUKSRemoveKey(devName string, src LUKSSecretSource) error {
+	if fm.vm.originalCfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		err := fm.runLUKSKeyCmd(sc, fullDevPath, src, func(keyfilePath string) string {
+			return "cryptsetup luksRemoveKey -q --key-file " + keyfilePath + " " + shellescape.Quote(fullDevPath)
+		})
+		if err != nil {
+			return errors.Wrap(err, "run cryptsetup luksRemoveKey")
+		}
+
+		fm.logger.Info("Removed LUKS key", "vm-path", fullDevPath)
+
+		return nil
+	})
+}
+
+// LUKSKillSlot wipes the keyslot. The secret taken from src must
+// unlock any other keyslot, so that the device stays accessible.
+func (fm *FileManager) LUKSKillSlot(devName string, slot int, src LUKSSecretSource) error {
+	if fm.vm.originalCfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if slot < 0 {
+		return fmt.Errorf("bad keyslot %v", slot)
+	}
+
+	return fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		err := fm.runLUKSKeyCmd(sc, fullDevPath, src, func(keyfilePath string) string {
+			return "cryptsetup luksKillSlot --key-file " + keyfilePath + " " + shellescape.Quote(fullDevPath) + " " + strconv.Itoa(slot)
+		})
+		if err != nil {
+			return errors.Wrap(err, "run cryptsetup luksKillSlot")
+		}
+
+		fm.logger.Info("Wiped LUKS keyslot", "vm-path", fullDevPath, "slot", slot)
+
+		return nil
+	})
+}
+
+// LUKSHeaderBackup writes the backup of the LUKS header to w. The backup
+// unlocks the device with the secrets present at the time of the backup,
+// and is to be kept as safe as the secrets themselves.
+func (fm *FileManager) LUKSHeaderBackup(devName string, w io.Writer) error {
+	return fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		backupPath, err := fm.getLUKSSecretFilePath(sc)
+		if err != nil {
+			return errors.Wrap(err, "get header backup path")
+		}
+
+		defer fm.wipeLUKSSecretFile(sc, backupPath)
+
+		_, err = sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, "cryptsetup luksHeaderBackup "+shellescape.Quote(fullDevPath)+" --header-backup-file "+backupPath)
+		if err != nil {
+			return errors.Wrap(err, "run cryptsetup luksHeaderBackup")
+		}
+
+		scpCtx, scpCtxCancel := context.WithTimeout(fm.vm.ctx, luksHeaderTransferTimeout)
+		defer scpCtxCancel()
+
+		scpClient, err := fm.vm.DialSCP()
+		if err != nil {
+			return errors.Wrap(err, "dial scp")
+		}
+
+		defer scpClient.Close()
+
+		err = scpClient.CopyFromRemotePassThru(scpCtx, w, backupPath, nil)
+		if err != nil {
+			return errors.Wrap(err, "copy header backup from vm")
+		}
+
+		fm.logger.Info("Backed up LUKS header", "vm-path", fullDevPath)
+
+		return nil
+	})
+}
+
+// LUKSHeaderRestore replaces the LUKS header of the device with the
+// backup read from r. The secrets present in the current header are lost.
+func (fm *FileManager) LUKSHeaderRestore(devName string, r io.Reader) error {
+	if fm.vm.originalCfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		backupPath, err := fm.uploadLUKSSecretFileFrom(sc, r, luksHeaderTransferTimeout)
+		if err != nil {
+			return errors.Wrap(err, "upload header backup")
+		}
+
+		defer fm.wipeLUKSSecretFile(sc, backupPath)
+
+		_, err = sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, "cryptsetup luksHeaderRestore -q "+shellescape.Quote(fullDevPath)+" --header-backup-file "+backupPath)
+		if err != nil {
+			return errors.Wrap(err, "run cryptsetup luksHeaderRestore")
+		}
+
+		fm.logger.Info("Restored LUKS header", "vm-path", fullDevPath)
+
+		return nil
+	})
+}
+
+// LUKSConvert converts the device to the LUKS version given (1 or 2). Converting to
+// LUKS1 fails if the header uses LUKS2-only features, such as the Argon2 PBKDF.
+func (fm *FileManager) LUKSConvert(devName string, version int) error {
+	if fm.vm.originalCfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if version != 1 && version != 2 {
+		return fmt.Errorf("unsupported luks version %v", version)
+	}
+
+	return fm.withLUKSDevice(devName, func(sc *ssh.Client, fullDevPath string) error {
+		_, err := sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, "cryptsetup convert -q --type luks"+strconv.Itoa(version)+" "+shellescape.Quote(fullDevPath))
+		if err != nil {
+			return errors.Wrap(err, "run cryptsetup convert")
+		}
+
+		fm.logger.Info("Converted LUKS header", "vm-path", fullDevPath, "version", version)
+
+		return nil
+	})
+}
+
+func (fm *FileManager) getGuestMemAvailable(sc *ssh.Client) (uint64, error) {
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "awk '/^MemAvailable:/ {print $2}' /proc/meminfo")
+	if err != nil {
+		return 0, errors.Wrap(err, "read meminfo")
+	}
+
+	kib, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse available memory")
+	}
+
+	return kib, nil
+}
+
+// ensureLUKSMemory makes sure that the VM has enough memory for the key
+// derivation of the device's keyslots, growing the VM with the balloon if
+// needed. The returned function shrinks the VM back and is always non-nil.
+func (fm *FileManager) ensureLUKSMemory(sc *ssh.Client, fullDevPath string) (func(), error) {
+	noop := func() {}
+
+	lg := fm.logger.With("vm-path", fullDevPath)
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "cryptsetup luksDump "+shellescape.Quote(fullDevPath))
+	if err != nil {
+		// Not a LUKS device, or one cryptsetup will complain about later.
+		lg.Debug("Failed to dump the LUKS header to check the memory requirements", "error", err.Error())
+		return noop, nil
+	}
+
+	info, err := parseLUKSDump(out)
+	if err != nil {
+		return noop, errors.Wrap(err, "parse luks dump")
+	}
+
+	// We don't know which keyslot the secret will unlock.
+	var costKiB uint64
+	for _, ks := range info.Keyslots {
+		if ks.Memory > costKiB {
+			costKiB = ks.Memory
+		}
+	}
+
+	if costKiB == 0 {
+		return noop, nil
+	}
+
+	requiredKiB := costKiB + luksMemoryOverheadKiB
+
+	availableKiB, err := fm.getGuestMemAvailable(sc)
+	if err != nil {
+		return noop, errors.Wrap(err, "get guest available memory")
+	}
+
+	if availableKiB >= requiredKiB {
+		return noop, nil
+	}
+
+	prevTarget := fm.vm.MemoryTarget()
+	target := prevTarget + uint32((requiredKiB-availableKiB+1023)/1024)
+
+	if target > fm.vm.MemoryMax() {
+		if fm.vm.MemoryMax() == prevTarget {
+			lg.Warn("The VM may not have enough memory for the LUKS key derivation, please allocate more memory using --vm-mem-alloc flag", "required-mib", requiredKiB/1024, "available-mib", availableKiB/1024)
+			return noop, nil
+		}
+
+		lg.Warn("The LUKS key derivation needs more memory than the VM can be grown to, please increase the limit using --vm-mem-max flag", "target-mib", target, "max-mib", fm.vm.MemoryMax())
+		target = fm.vm.MemoryMax()
+	}
+
+	lg.Info("Growing the VM memory for the LUKS key derivation", "from-mib", prevTarget, "to-mib", target)
+
+	err = fm.vm.SetMemoryTarget(fm.vm.ctx, target)
+	if err != nil {
+		return noop, errors.Wrap(err, "grow vm memory")
+	}
+
+	restore := func() {
+		err := fm.vm.SetMemoryTarget(context.Background(), prevTarget)
+		if err != nil {
+			lg.Warn("Failed to shrink the VM memory back", "to-mib", prevTarget, "error", err.Error())
+		}
+	}
+
+	// The guest OS takes the memory from the balloon gradually.
+	deadline := time.Now().Add(luksMemoryGrowTimeout)
+	for time.Now().Before(deadline) {
+		availableKiB, err = fm.getGuestMemAvailable(sc)
+		if err != nil {
+			restore()
+			return noop, errors.Wrap(err, "get guest available memory")
+		}
+
+		if availableKiB >= requiredKiB {
+			return restore, nil
+		}
+
+		select {
+		case <-fm.vm.ctx.Done():
+			restore()
+			return noop, fm.vm.ctx.Err()
+		case <-time.After(time.Millisecond * 250):
+		}
+	}
+
+	lg.Warn("The guest OS did not take the added memory in time, proceeding anyway", "required-mib", requiredKiB/1024, "available-mib", availableKiB/1024)
+
+	return restore, nil
+}
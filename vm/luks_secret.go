@@ -0,0 +1,225 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// LUKSSecret unlocks a LUKS device. Exactly one of the fields is to be set.
+type LUKSSecret struct {
+	Passphrase []byte
+
+	// Keyfiles are copied to a tmpfs in the VM and
+	// removed right after the device is opened.
+	Keyfile []byte
+}
+
+// Wipe clears the secret up from the memory.
+func (s *LUKSSecret) Wipe() {
+	for _, b := range [][]byte{s.Passphrase, s.Keyfile} {
+		for i := range b {
+			b[i] = 0
+		}
+
+		// This is my paranoia.
+		_, _ = rand.Read(b)
+		_, _ = rand.Read(b)
+	}
+}
+
+// Passphrases are the same as keyfiles to cryptsetup as long as there
+// is no trailing newline. This lets us pass any secret as a keyfile.
+func (s *LUKSSecret) asKeyfile() []byte {
+	if s.Keyfile != nil {
+		return s.Keyfile
+	}
+
+	return s.Passphrase
+}
+
+// The default number of attempts to open a LUKS device.
+const defaultLUKSMaxAttempts = 3
+
+type LUKSSecretRequest struct {
+	// The path to the LUKS device inside the VM.
+	DevPath string
+
+	// Starts from 1. Greater values mean that the previous secret was wrong.
+	Attempt int
+}
+
+// LUKSSecretSource provides the secrets to open LUKS devices with. It is asked
+// for every attempt to open a device. Sources that cannot provide a different
+// secret on retries are expected to return ErrLUKSWrongPassphrase.
+type LUKSSecretSource interface {
+	GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error)
+}
+
+// LUKSSecretSourceFunc allows using ordinary functions as LUKS secret sources.
+type LUKSSecretSourceFunc func(req LUKSSecretRequest) (*LUKSSecret, error)
+
+func (f LUKSSecretSourceFunc) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	return f(req)
+}
+
+func trimTrailingNewline(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+// TerminalLUKSSecretSource prompts for the passphrase in the terminal. This is the default.
+type TerminalLUKSSecretSource struct {
+	// Defaults to "Enter Password: ".
+	Prompt string
+}
+
+func (s TerminalLUKSSecretSource) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	prompt := s.Prompt
+	if prompt == "" {
+		prompt = "Enter Password: "
+	}
+
+	_, err := os.Stderr.Write([]byte(prompt))
+	if err != nil {
+		return nil, errors.Wrap(err, "write prompt to stderr")
+	}
+
+	pwd, err := term.ReadPassword(int(syscall.Stdin)) //nolint:unconvert // On Windows it's a different non-int type.
+	if err != nil {
+		return nil, errors.Wrap(err, "read luks password")
+	}
+
+	fmt.Print("\n")
+
+	return &LUKSSecret{Passphrase: pwd}, nil
+}
+
+// PassphraseFileLUKSSecretSource reads the passphrase from a file. A trailing newline is ignored.
+type PassphraseFileLUKSSecretSource struct {
+	Path string
+}
+
+func (s PassphraseFileLUKSSecretSource) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	if req.Attempt > 1 {
+		return nil, ErrLUKSWrongPassphrase
+	}
+
+	data, err := os.ReadFile(filepath.Clean(s.Path))
+	if err != nil {
+		return nil, errors.Wrap(err, "read passphrase file")
+	}
+
+	return &LUKSSecret{Passphrase: trimTrailingNewline(data)}, nil
+}
+
+// KeyfileLUKSSecretSource uses a file on the host as a LUKS keyfile.
+type KeyfileLUKSSecretSource struct {
+	Path string
+}
+
+func (s KeyfileLUKSSecretSource) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	if req.Attempt > 1 {
+		return nil, ErrLUKSWrongPassphrase
+	}
+
+	data, err := os.ReadFile(filepath.Clean(s.Path))
+	if err != nil {
+		return nil, errors.Wrap(err, "read keyfile")
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("keyfile is empty")
+	}
+
+	return &LUKSSecret{Keyfile: data}, nil
+}
+
+// EnvLUKSSecretSource reads the passphrase from an environment variable.
+type EnvLUKSSecretSource struct {
+	Name string
+}
+
+func (s EnvLUKSSecretSource) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	if req.Attempt > 1 {
+		return nil, ErrLUKSWrongPassphrase
+	}
+
+	pwd, ok := os.LookupEnv(s.Name)
+	if !ok || pwd == "" {
+		return nil, fmt.Errorf("environment variable '%v' is not set or empty", s.Name)
+	}
+
+	return &LUKSSecret{Passphrase: []byte(pwd)}, nil
+}
+
+// ReaderLUKSSecretSource reads passphrases from a reader (e.g. piped stdin), one per line.
+type ReaderLUKSSecretSource struct {
+	r  *bufio.Reader
+	mu sync.Mutex
+}
+
+func NewReaderLUKSSecretSource(r io.Reader) *ReaderLUKSSecretSource {
+	return &ReaderLUKSSecretSource{
+		r: bufio.NewReader(r),
+	}
+}
+
+func (s *ReaderLUKSSecretSource) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := s.r.ReadBytes('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || len(line) == 0) {
+		return nil, errors.Wrap(err, "read passphrase line")
+	}
+
+	return &LUKSSecret{Passphrase: trimTrailingNewline(line)}, nil
+}
+
+// AskpassLUKSSecretSource runs an external program to get the passphrase, similar to SSH_ASKPASS.
+// The program gets the prompt as the first argument and is expected to print the passphrase to stdout.
+type AskpassLUKSSecretSource struct {
+	Program string
+}
+
+func (s AskpassLUKSSecretSource) GetLUKSSecret(req LUKSSecretRequest) (*LUKSSecret, error) {
+	stdout := bytes.NewBuffer(nil)
+
+	cmd := exec.Command(s.Program, "Enter the LUKS password for "+req.DevPath+": ") //#nosec G204 // The program is specified by the user.
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.Wrap(err, "run askpass program")
+	}
+
+	return &LUKSSecret{Passphrase: trimTrailingNewline(stdout.Bytes())}, nil
+}
@@ -0,0 +1,367 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const testLUKS2Dump = `LUKS header information
+Version:       	2
+Epoch:         	5
+Metadata area: 	16384 [bytes]
+Keyslots area: 	16744448 [bytes]
+UUID:          	0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10
+Label:         	(no label)
+Subsystem:     	(no subsystem)
+Flags:       	(no flags)
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	length: (whole device)
+	cipher: aes-xts-plain64
+	sector: 512 [bytes]
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+	Priority:   normal
+	Cipher:     aes-xts-plain64
+	Cipher key: 512 bits
+	PBKDF:      argon2id
+	Time cost:  4
+	Memory:     1048576
+	Threads:    4
+	Salt:       8b 1f 3a 55 c2 90 7e 41 0d 6a 2b 9c 44 e1 f0 13 
+	            5d 7a 62 0e 9f 11 c4 83 27 b6 0a 5e d9 33 70 28 
+	AF stripes: 4000
+	AF hash:    sha256
+	Area offset:32768 [bytes]
+	Area length:258048 [bytes]
+	Digest ID:  0
+  2: luks2
+	Key:        512 bits
+	Priority:   normal
+	Cipher:     aes-xts-plain64
+	Cipher key: 512 bits
+	PBKDF:      pbkdf2
+	Hash:       sha256
+	Iterations: 1000
+	Salt:       12 34 56 78 9a bc de f0 12 34 56 78 9a bc de f0 
+	            12 34 56 78 9a bc de f0 12 34 56 78 9a bc de f0 
+	AF stripes: 4000
+	AF hash:    sha256
+	Area offset:290816 [bytes]
+	Area length:258048 [bytes]
+	Digest ID:  0
+Tokens:
+Digests:
+  0: pbkdf2
+	Hash:       sha256
+	Iterations: 120249
+	Salt:       a1 b2 c3 d4 e5 f6 07 18 29 3a 4b 5c 6d 7e 8f 90 
+	            a1 b2 c3 d4 e5 f6 07 18 29 3a 4b 5c 6d 7e 8f 90 
+	Digest:     0f 1e 2d 3c 4b 5a 69 78 87 96 a5 b4 c3 d2 e1 f0 
+	            0f 1e 2d 3c 4b 5a 69 78 87 96 a5 b4 c3 d2 e1 f0 
+`
+
+const testLUKS1Dump = `LUKS header information for /dev/vdb2
+
+Version:       	1
+Cipher name:   	aes
+Cipher mode:   	xts-plain64
+Hash spec:     	sha256
+Payload offset:	4096
+MK bits:       	512
+MK digest:     	5c 9e 13 77 a0 2b 4f 81 c6 d2 90 3e 11 0a 6b 58 2f 7d 44 e9 
+MK salt:       	a4 1b 62 9d 0e 7f 35 c8 29 f1 b0 4a 86 d3 57 0c 
+               	19 e2 7b 46 a8 3d 50 f6 c1 0f 92 6e 28 b5 d4 73 
+MK iterations: 	98413
+UUID:          	7f0a2c4e-1b3d-4e5f-8a9b-0c1d2e3f4a5b
+
+Key Slot 0: ENABLED
+	Iterations:         	1552325
+	Salt:               	3e 8c 51 a7 0d 92 f4 16 6b c0 2e 79 d5 48 b3 0a 
+	                      	c7 21 9f 64 e0 3b 85 1d 7a f2 4c 90 2b d6 58 e3 
+	Key material offset:	8
+	AF stripes:            	4000
+Key Slot 1: DISABLED
+Key Slot 2: ENABLED
+	Iterations:         	1498113
+	Salt:               	00 11 22 33 44 55 66 77 88 99 aa bb cc dd ee ff 
+	                      	00 11 22 33 44 55 66 77 88 99 aa bb cc dd ee ff 
+	Key material offset:	1032
+	AF stripes:            	4000
+Key Slot 3: DISABLED
+Key Slot 4: DISABLED
+Key Slot 5: DISABLED
+Key Slot 6: DISABLED
+Key Slot 7: DISABLED
+`
+
+func TestParseLUKSDump(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want LUKSHeaderInfo
+	}{
+		{
+			name: "luks2",
+			out:  testLUKS2Dump,
+			want: LUKSHeaderInfo{
+				Version: 2,
+				UUID:    "0d3a6f2e-5c1b-4f57-9d0e-1e8b2a7c4f10",
+				Cipher:  "aes-xts-plain64",
+				Keyslots: []LUKSKeyslot{
+					{ID: 0, Type: "luks2", Cipher: "aes-xts-plain64", PBKDF: "argon2id", Memory: 1048576},
+					{ID: 2, Type: "luks2", Cipher: "aes-xts-plain64", PBKDF: "pbkdf2"},
+				},
+			},
+		},
+		{
+			name: "luks1",
+			out:  testLUKS1Dump,
+			want: LUKSHeaderInfo{
+				Version: 1,
+				UUID:    "7f0a2c4e-1b3d-4e5f-8a9b-0c1d2e3f4a5b",
+				Cipher:  "aes-xts-plain64",
+				Keyslots: []LUKSKeyslot{
+					{ID: 0, Type: "luks1", Cipher: "aes-xts-plain64", PBKDF: "pbkdf2"},
+					{ID: 2, Type: "luks1", Cipher: "aes-xts-plain64", PBKDF: "pbkdf2"},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := parseLUKSDump([]byte(tc.out))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.want, *have) {
+				t.Errorf("want %+v, have %+v", tc.want, *have)
+			}
+		})
+	}
+}
+
+func TestParseLUKSDumpLabel(t *testing.T) {
+	have, err := parseLUKSDump([]byte("LUKS header information\nVersion:       \t2\nLabel:         \tbackup: 2023\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if want := "backup: 2023"; have.Label != want {
+		t.Errorf("want label %q, have %q", want, have.Label)
+	}
+}
+
+func TestParseLUKSDumpErrors(t *testing.T) {
+	for _, out := range []string{
+		"",
+		"Device /dev/vdb2 is not a valid LUKS device.\n",
+		"LUKS header information\nVersion:       \ttwo\n",
+		"LUKS header information\nVersion:       \t2\n\nKeyslots:\n  0: luks2\n\tMemory:     1G\n",
+	} {
+		_, err := parseLUKSDump([]byte(out))
+		if err == nil {
+			t.Errorf("%q: want an error", out)
+		}
+	}
+}
+
+// Failures of the cryptsetup commands which take an existing secret.
+var cryptWrongPassphraseTestCases = []struct {
+	name     string
+	exitCode int
+	stderr   string
+	wrong    bool
+}{
+	{
+		name:     "wrong passphrase",
+		exitCode: cryptWrongPassphraseExitCode,
+		stderr:   "No key available with this passphrase.\n",
+		wrong:    true,
+	},
+	{
+		// The messages are translated in other locales.
+		name:     "wrong passphrase translated",
+		exitCode: cryptWrongPassphraseExitCode,
+		stderr:   "Kein Schlüssel mit dieser Passphrase verfügbar.\n",
+		wrong:    true,
+	},
+	{
+		name:     "other failure",
+		exitCode: 1,
+		stderr:   "Device /dev/vdb is in use. No key available with this passphrase.\n",
+		wrong:    false,
+	},
+}
+
+func TestLUKSRemoveKeyWrongPassphrase(t *testing.T) {
+	for _, tc := range cryptWrongPassphraseTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vi, _ := startFakeVM(t, Config{}, func(_ context.Context, cmd string, _ io.Reader, stdout io.Writer, stderr io.Writer) int {
+				switch {
+				case strings.HasPrefix(cmd, "cryptsetup isLuks "):
+					_, _ = io.WriteString(stdout, "yes\n")
+				case strings.HasPrefix(cmd, "cryptsetup luksDump "):
+					// Skips growing the memory.
+					return 1
+				case strings.HasPrefix(cmd, "cryptsetup luksRemoveKey "):
+					_, _ = io.WriteString(stderr, tc.stderr)
+					return tc.exitCode
+				}
+
+				return 0
+			})
+
+			fm := NewFileManager(newTestLogger(), vi)
+			fm.SetLUKSMaxAttempts(2)
+
+			var attempts int
+			err := fm.LUKSRemoveKey("vdb", LUKSSecretSourceFunc(func(req LUKSSecretRequest) (*LUKSSecret, error) {
+				attempts = req.Attempt
+				return &LUKSSecret{Passphrase: []byte("secret")}, nil
+			}))
+			if err == nil {
+				t.Fatalf("want an error")
+			}
+
+			if wrong := errors.Is(err, ErrLUKSWrongPassphrase); wrong != tc.wrong {
+				t.Errorf("want wrong passphrase %v, have error %v", tc.wrong, err)
+			}
+
+			// Only the wrong secrets are asked for again.
+			wantAttempts := 1
+			if tc.wrong {
+				wantAttempts = 2
+			}
+
+			if attempts != wantAttempts {
+				t.Errorf("want %v attempts, have %v", wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestCryptOpenWrongPassphrase(t *testing.T) {
+	for _, tc := range cryptWrongPassphraseTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vi, _ := startFakeVM(t, Config{}, func(_ context.Context, cmd string, _ io.Reader, _ io.Writer, stderr io.Writer) int {
+				switch {
+				case strings.HasPrefix(cmd, "cryptsetup luksDump "):
+					return 1
+				case strings.HasPrefix(cmd, "cryptsetup luksOpen "):
+					_, _ = io.WriteString(stderr, tc.stderr)
+					return tc.exitCode
+				}
+
+				return 0
+			})
+
+			fm := NewFileManager(newTestLogger(), vi)
+			fm.SetLUKSMaxAttempts(2)
+
+			var attempts int
+			err := fm.Mount("vdb", MountConfig{
+				LUKS: true,
+				LUKSSecretSource: LUKSSecretSourceFunc(func(req LUKSSecretRequest) (*LUKSSecret, error) {
+					attempts = req.Attempt
+					return &LUKSSecret{Passphrase: []byte("secret")}, nil
+				}),
+			})
+			if err == nil {
+				t.Fatalf("want an error")
+			}
+
+			if wrong := errors.Is(err, ErrLUKSWrongPassphrase); wrong != tc.wrong {
+				t.Errorf("want wrong passphrase %v, have error %v", tc.wrong, err)
+			}
+
+			wantAttempts := 1
+			if tc.wrong {
+				wantAttempts = 2
+			}
+
+			if attempts != wantAttempts {
+				t.Errorf("want %v attempts, have %v", wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestMountLUKSCleanup(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		openExit   int
+		mountExit  int
+		wantClosed bool
+	}{
+		{name: "mounted", wantClosed: false},
+		{name: "mount failed", mountExit: 32, wantClosed: true},
+		{name: "open failed", openExit: 1, wantClosed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vi, hv := startFakeVM(t, Config{}, func(_ context.Context, cmd string, stdin io.Reader, _ io.Writer, stderr io.Writer) int {
+				switch {
+				case strings.HasPrefix(cmd, "cryptsetup luksDump "):
+					return 1
+				case strings.HasPrefix(cmd, "cryptsetup luksOpen "):
+					if tc.openExit != 0 {
+						// Fails before reading the passphrase.
+						_, _ = io.WriteString(stderr, "Device /dev/vdb is in use.\n")
+						return tc.openExit
+					}
+
+					_, _ = bufio.NewReader(stdin).ReadString('\n')
+				case strings.Contains(cmd, "mount "):
+					if tc.mountExit != 0 {
+						_, _ = io.WriteString(stderr, "mount: /mnt: wrong fs type, bad option, bad superblock on /dev/mapper/cryptmnt.\n")
+						return tc.mountExit
+					}
+				}
+
+				return 0
+			})
+
+			fm := NewFileManager(newTestLogger(), vi)
+
+			err := fm.Mount("vdb", MountConfig{
+				LUKS: true,
+				LUKSSecretSource: LUKSSecretSourceFunc(func(_ LUKSSecretRequest) (*LUKSSecret, error) {
+					return &LUKSSecret{Passphrase: []byte("secret")}, nil
+				}),
+			})
+			if wantErr := tc.mountExit != 0 || tc.openExit != 0; (err != nil) != wantErr {
+				t.Fatalf("want error %v, have %v", wantErr, err)
+			}
+
+			if closed := hasCommand(hv.Commands(), "cryptsetup close cryptmnt"); closed != tc.wantClosed {
+				t.Errorf("want mapping closed %v, have commands %q", tc.wantClosed, hv.Commands())
+			}
+		})
+	}
+}
@@ -0,0 +1,659 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/ssh"
+)
+
+// Activating thin pools runs thin_check, which reads the whole pool metadata.
+const lvmCmdTimeout = time.Minute * 2
+
+// The prefix of the volume group references in LVMConfig.Activate which
+// refer to the volume groups by UUID rather than by name.
+const lvmUUIDRefPrefix = "uuid="
+
+type LVMConfig struct {
+	// The volume groups ("<vg>") and the logical volumes ("<vg>/<lv>")
+	// to activate. All volume groups are activated if empty. The volume
+	// groups can also be referred to by UUID ("uuid=<vg uuid>"), which
+	// tells the volume groups with the same name apart.
+	Activate []string
+
+	// Activates the volume groups with the same name as another one
+	// under a different name, which is the old one with a number appended.
+	// Only the device-mapper devices in the VM are renamed, the volume
+	// group itself is left as it is on the devices.
+	RenameDuplicates bool
+}
+
+// LVMVolumeRef is a reference to a volume group or a logical volume in it.
+type LVMVolumeRef struct {
+	// Either VGName or VGUUID is set.
+	VGName string
+	VGUUID string
+
+	// Empty if the reference is to the whole volume group.
+	LVName string
+}
+
+// The key of the volume group in the activation map.
+func (r LVMVolumeRef) vgKey() string {
+	if r.VGUUID != "" {
+		return lvmUUIDRefPrefix + r.VGUUID
+	}
+
+	return r.VGName
+}
+
+// ParseLVMVolume parses a "<vg>", "<vg>/<lv>", "uuid=<vg uuid>" or "uuid=<vg uuid>/<lv>" reference.
+func ParseLVMVolume(s string) (LVMVolumeRef, error) {
+	vg, lv, hasLV := strings.Cut(s, "/")
+
+	var ret LVMVolumeRef
+
+	if uuid, ok := strings.CutPrefix(vg, lvmUUIDRefPrefix); ok {
+		if !utils.ValidateLVMUUID(uuid) {
+			return LVMVolumeRef{}, fmt.Errorf("bad volume group uuid '%v'", uuid)
+		}
+
+		ret.VGUUID = uuid
+	} else {
+		if !utils.ValidateLVMName(vg) {
+			return LVMVolumeRef{}, fmt.Errorf("bad volume group name '%v'", vg)
+		}
+
+		ret.VGName = vg
+	}
+
+	if hasLV {
+		if !utils.ValidateLVMName(lv) {
+			return LVMVolumeRef{}, fmt.Errorf("bad logical volume name '%v'", lv)
+		}
+
+		ret.LVName = lv
+	}
+
+	return ret, nil
+}
+
+func (c LVMConfig) validate() error {
+	for _, v := range c.Activate {
+		_, err := ParseLVMVolume(v)
+		if err != nil {
+			return errors.Wrapf(err, "parse lvm volume to activate '%v'", v)
+		}
+	}
+
+	return nil
+}
+
+// The volume groups, referred to by name or by "uuid=<vg uuid>", mapped to
+// the logical volumes to activate in them. A nil slice means that the whole
+// group is activated. A nil map means that everything is activated.
+func (c LVMConfig) getActivationMap() map[string][]string {
+	if len(c.Activate) == 0 {
+		return nil
+	}
+
+	ret := make(map[string][]string)
+
+	for _, v := range c.Activate {
+		// Validated already.
+		ref, _ := ParseLVMVolume(v)
+		key := ref.vgKey()
+
+		lvs, seen := ret[key]
+
+		switch {
+		case ref.LVName == "" || (seen && lvs == nil):
+			ret[key] = nil
+		default:
+			ret[key] = append(lvs, ref.LVName)
+		}
+	}
+
+	return ret
+}
+
+// Returns the logical volumes of the volume group to activate, nil meaning
+// all of them, and whether the volume group is to be activated at all.
+func getLVMActivationLVs(activationMap map[string][]string, vg LVMVolumeGroup) ([]string, bool) {
+	if activationMap == nil {
+		return nil, true
+	}
+
+	byName, nameSelected := activationMap[vg.Name]
+	byUUID, uuidSelected := activationMap[lvmUUIDRefPrefix+vg.UUID]
+
+	switch {
+	case !nameSelected && !uuidSelected:
+		return nil, false
+	case (nameSelected && byName == nil) || (uuidSelected && byUUID == nil):
+		return nil, true
+	default:
+		return append(append([]string(nil), byName...), byUUID...), true
+	}
+}
+
+type LVMLogicalVolume struct {
+	Name string `json:"name"`
+	UUID string `json:"uuid"`
+	Size uint64 `json:"size"`
+
+	// The segment type, e.g. "linear", "striped", "raid1", "thin", "thin-pool" or "cache".
+	Type string `json:"type"`
+
+	// The thin pool or the cache pool the volume uses.
+	Pool string `json:"pool,omitempty"`
+
+	// The volume the snapshot was taken of.
+	Origin string `json:"origin,omitempty"`
+
+	Active bool `json:"active"`
+
+	// The device name relative to /dev. The device exists only if the volume is active.
+	DevName string `json:"dev_name"`
+}
+
+type LVMVolumeGroup struct {
+	Name string `json:"name"`
+	UUID string `json:"uuid"`
+	Size uint64 `json:"size"`
+	Free uint64 `json:"free"`
+
+	// The device names of the physical volumes, relative to /dev.
+	PhysicalVolumes []string `json:"physical_volumes"`
+
+	LogicalVolumes []LVMLogicalVolume `json:"logical_volumes"`
+
+	// Set if there is another volume group with the same name. The volume groups
+	// with the same name are activated under different names, see LVMConfig.
+	DuplicateName bool `json:"duplicate_name"`
+
+	// The name the logical volumes are activated under in the VM, which is
+	// different from Name if the volume group was renamed for being a duplicate.
+	// Empty if none of the logical volumes are active.
+	ActiveName string `json:"active_name,omitempty"`
+}
+
+// Device mapper escapes dashes in the names by doubling them.
+func escapeLVMDMName(name string) string {
+	return strings.ReplaceAll(name, "-", "--")
+}
+
+func getLVMDevName(vg string, lv string) string {
+	return "mapper/" + escapeLVMDMName(vg) + "-" + escapeLVMDMName(lv)
+}
+
+// Splits the device-mapper name of a logical volume, which is "<vg>-<lv>"
+// with the dashes in the names doubled, into the escaped volume group name
+// and the rest. Hidden logical volumes, like the thin pool data, have their
+// own suffixes after the logical volume name.
+func splitLVMDMName(name string) (string, string, bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '-' {
+			continue
+		}
+
+		if i+1 < len(name) && name[i+1] == '-' {
+			i++
+			continue
+		}
+
+		return name[:i], name[i+1:], true
+	}
+
+	return "", "", false
+}
+
+// The device-mapper UUIDs of the logical volumes start with this, followed by
+// the logical volume UUID. LVM finds the devices of the logical volumes by these
+// UUIDs rather than by the names, so the devices can be renamed.
+func getLVMDMUUIDPrefix(vgUUID string) string {
+	return "LVM-" + strings.ReplaceAll(vgUUID, "-", "")
+}
+
+type dmDevice struct {
+	UUID string
+	Name string
+}
+
+// Lists the device-mapper devices which have an UUID, taken from sysfs the same way as in the teardown.
+const listDMDevicesCmd = `for d in /sys/block/dm-*; do
+	[ -e "$d/dm/uuid" ] || continue
+	printf '%s\t%s\n' "$(cat "$d/dm/uuid")" "$(cat "$d/dm/name")"
+done`
+
+func parseDMDevices(out string) ([]dmDevice, error) {
+	var ret []dmDevice
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		uuid, name, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("bad dm device line '%v'", line)
+		}
+
+		if uuid == "" {
+			// Devices created without an UUID.
+			continue
+		}
+
+		ret = append(ret, dmDevice{UUID: uuid, Name: name})
+	}
+
+	return ret, nil
+}
+
+func (fm *FileManager) getDMDevices(sc *ssh.Client) ([]dmDevice, error) {
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, listDMDevicesCmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "run list dm devices cmd")
+	}
+
+	return parseDMDevices(string(out))
+}
+
+// All values in LVM JSON reports are strings.
+type lvmReport struct {
+	Report []map[string][]map[string]string `json:"report"`
+}
+
+func (fm *FileManager) runLVMReport(sc *ssh.Client, cmd string, kind string) ([]map[string]string, error) {
+	cmd += " --reportformat json"
+	if fm.vm.originalCfg.ReadOnly {
+		// Makes sure that the metadata is not written, even to repair it.
+		cmd += " --readonly"
+	}
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "run %v", strings.Fields(cmd)[0])
+	}
+
+	return parseLVMReport(out, kind)
+}
+
+// Returns the rows of the kind ("vg", "pv" or "lv") from the JSON report.
+func parseLVMReport(out []byte, kind string) ([]map[string]string, error) {
+	var report lvmReport
+
+	err := json.Unmarshal(out, &report)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v report", kind)
+	}
+
+	var ret []map[string]string
+	for _, r := range report.Report {
+		ret = append(ret, r[kind]...)
+	}
+
+	return ret, nil
+}
+
+func parseLVMSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	ret, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse size '%v'", s)
+	}
+
+	return ret, nil
+}
+
+// LVMVolumeGroups returns the volume groups found, with their logical volumes.
+func (fm *FileManager) LVMVolumeGroups() ([]LVMVolumeGroup, error) {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	return fm.getLVMVolumeGroups(sc)
+}
+
+func (fm *FileManager) getLVMVolumeGroups(sc *ssh.Client) ([]LVMVolumeGroup, error) {
+	vgRows, err := fm.runLVMReport(sc, "vgs --units b --nosuffix -o vg_name,vg_uuid,vg_size,vg_free", "vg")
+	if err != nil {
+		return nil, err
+	}
+
+	pvRows, err := fm.runLVMReport(sc, "pvs -o pv_name,vg_uuid", "pv")
+	if err != nil {
+		return nil, err
+	}
+
+	// Hidden volumes, like the data and the metadata of thin pools, are not listed.
+	lvRows, err := fm.runLVMReport(sc, "lvs --units b --nosuffix -o lv_name,lv_uuid,vg_uuid,lv_size,segtype,pool_lv,origin,lv_active", "lv")
+	if err != nil {
+		return nil, err
+	}
+
+	dmDevs, err := fm.getDMDevices(sc)
+	if err != nil {
+		return nil, errors.Wrap(err, "get dm devices")
+	}
+
+	return buildLVMVolumeGroups(vgRows, pvRows, lvRows, dmDevs)
+}
+
+// Assembles the volume groups from the vgs, pvs and lvs reports. The
+// device-mapper devices tell the names the volume groups are active under.
+func buildLVMVolumeGroups(vgRows []map[string]string, pvRows []map[string]string, lvRows []map[string]string, dmDevs []dmDevice) ([]LVMVolumeGroup, error) {
+	ret := make([]LVMVolumeGroup, 0, len(vgRows))
+	nameCount := make(map[string]int)
+
+	for _, row := range vgRows {
+		size, err := parseLVMSize(row["vg_size"])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse size of volume group '%v'", row["vg_name"])
+		}
+
+		free, err := parseLVMSize(row["vg_free"])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse free space of volume group '%v'", row["vg_name"])
+		}
+
+		vg := LVMVolumeGroup{
+			Name: row["vg_name"],
+			UUID: row["vg_uuid"],
+			Size: size,
+			Free: free,
+		}
+
+		dmUUIDPrefix := getLVMDMUUIDPrefix(vg.UUID)
+		for _, dev := range dmDevs {
+			if !strings.HasPrefix(dev.UUID, dmUUIDPrefix) {
+				continue
+			}
+
+			if escapedName, _, ok := splitLVMDMName(dev.Name); ok {
+				vg.ActiveName = strings.ReplaceAll(escapedName, "--", "-")
+				break
+			}
+		}
+
+		devVGName := vg.Name
+		if vg.ActiveName != "" {
+			devVGName = vg.ActiveName
+		}
+
+		for _, pvRow := range pvRows {
+			if pvRow["vg_uuid"] == vg.UUID {
+				vg.PhysicalVolumes = append(vg.PhysicalVolumes, strings.TrimPrefix(pvRow["pv_name"], "/dev/"))
+			}
+		}
+
+		for _, lvRow := range lvRows {
+			if lvRow["vg_uuid"] != vg.UUID {
+				continue
+			}
+
+			size, err := parseLVMSize(lvRow["lv_size"])
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse size of logical volume '%v'", lvRow["lv_name"])
+			}
+
+			vg.LogicalVolumes = append(vg.LogicalVolumes, LVMLogicalVolume{
+				Name:    lvRow["lv_name"],
+				UUID:    lvRow["lv_uuid"],
+				Size:    size,
+				Type:    lvRow["segtype"],
+				Pool:    lvRow["pool_lv"],
+				Origin:  lvRow["origin"],
+				Active:  lvRow["lv_active"] != "",
+				DevName: getLVMDevName(devVGName, lvRow["lv_name"]),
+			})
+		}
+
+		nameCount[vg.Name]++
+
+		ret = append(ret, vg)
+	}
+
+	for i := range ret {
+		ret[i].DuplicateName = nameCount[ret[i].Name] > 1
+	}
+
+	return ret, nil
+}
+
+// Returns the UUIDs of the volume groups which clash by name with another one
+// from vgs, except for one of them which can be activated under its own name.
+// The one which is already active under its own name is preferred.
+func getLVMDuplicateVGs(vgs []LVMVolumeGroup) map[string]bool {
+	nameCount := make(map[string]int)
+	kept := make(map[string]string)
+
+	for _, vg := range vgs {
+		nameCount[vg.Name]++
+
+		if vg.ActiveName == vg.Name {
+			kept[vg.Name] = vg.UUID
+		}
+	}
+
+	ret := make(map[string]bool)
+
+	for _, vg := range vgs {
+		if nameCount[vg.Name] < 2 {
+			continue
+		}
+
+		if _, ok := kept[vg.Name]; !ok {
+			kept[vg.Name] = vg.UUID
+		}
+
+		if kept[vg.Name] != vg.UUID {
+			ret[vg.UUID] = true
+		}
+	}
+
+	return ret
+}
+
+// Returns the old name with the lowest number appended which is not in taken.
+func getLVMDuplicateVGName(name string, taken map[string]bool) string {
+	for i := 1; ; i++ {
+		ret := name + strconv.Itoa(i)
+		if !taken[ret] {
+			return ret
+		}
+	}
+}
+
+// Renames the device-mapper devices of the active logical volumes of the volume
+// group as if the volume group was named newName. Nothing is written to the devices.
+func (fm *FileManager) renameLVMDMDevices(sc *ssh.Client, vg LVMVolumeGroup, newName string) error {
+	dmDevs, err := fm.getDMDevices(sc)
+	if err != nil {
+		return errors.Wrap(err, "get dm devices")
+	}
+
+	dmUUIDPrefix := getLVMDMUUIDPrefix(vg.UUID)
+
+	for _, dev := range dmDevs {
+		if !strings.HasPrefix(dev.UUID, dmUUIDPrefix) {
+			continue
+		}
+
+		escapedName, rest, ok := splitLVMDMName(dev.Name)
+		if !ok || escapedName != escapeLVMDMName(vg.Name) {
+			continue
+		}
+
+		_, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "dmsetup rename "+shellescape.Quote(dev.Name)+" "+shellescape.Quote(escapeLVMDMName(newName)+"-"+rest))
+		if err != nil {
+			return errors.Wrapf(err, "rename dm device '%v'", dev.Name)
+		}
+	}
+
+	return nil
+}
+
+// The devices of the volume groups with the same name would clash, so the volume
+// group is activated and its devices are renamed before the next one is activated.
+func (fm *FileManager) activateLVMVolumeGroupRenamed(sc *ssh.Client, vg LVMVolumeGroup, lvs []string, newName string) error {
+	fm.logger.Info("Activating a volume group with a duplicate name under a different name", "vg", vg.Name, "uuid", vg.UUID, "new-name", newName)
+
+	err := fm.activateLVMVolumeGroup(sc, vg, lvs)
+	if err != nil {
+		return err
+	}
+
+	err = fm.renameLVMDMDevices(sc, vg, newName)
+	if err != nil {
+		return errors.Wrapf(err, "rename devices of volume group '%v' to '%v'", vg.Name, newName)
+	}
+
+	return nil
+}
+
+// Logical volumes are activated as read-only in the read-only mode.
+func (fm *FileManager) getLVMActivationConfigArg(vgName string) string {
+	if !fm.vm.originalCfg.ReadOnly {
+		return ""
+	}
+
+	return " --config " + shellescape.Quote(`activation { read_only_volume_list = [ "`+vgName+`" ] }`)
+}
+
+func (fm *FileManager) activateLVMVolumeGroup(sc *ssh.Client, vg LVMVolumeGroup, lvs []string) error {
+	if lvs == nil {
+		_, err := sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, lvmCmdTimeout, sc, "vgchange -ay"+fm.getLVMActivationConfigArg(vg.Name)+" --select "+shellescape.Quote(`vg_uuid="`+vg.UUID+`"`))
+		if err != nil {
+			return errors.Wrapf(err, "activate volume group '%v'", vg.Name)
+		}
+
+		return nil
+	}
+
+	for _, lv := range lvs {
+		// Pools of thin and cached volumes are activated along with them.
+		_, err := sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, lvmCmdTimeout, sc, "lvchange -ay"+fm.getLVMActivationConfigArg(vg.Name)+" --select "+shellescape.Quote(`vg_uuid="`+vg.UUID+`" && lv_name="`+lv+`"`))
+		if err != nil {
+			return errors.Wrapf(err, "activate logical volume '%v/%v'", vg.Name, lv)
+		}
+	}
+
+	return nil
+}
+
+// InitLVM activates the LVM volume groups and logical volumes as configured in
+// LVMConfig. Volume groups are activated one by one, so that a broken one does not
+// prevent the others from being activated, unless they were selected explicitly.
+// It is safe to call multiple times.
+func (fm *FileManager) InitLVM() error {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	lvmCfg := fm.vm.originalCfg.LVM
+
+	vgs, err := fm.getLVMVolumeGroups(sc)
+	if err != nil {
+		return errors.Wrap(err, "get volume groups")
+	}
+
+	activationMap := lvmCfg.getActivationMap()
+
+	var selected []LVMVolumeGroup
+	selectedLVs := make(map[string][]string)
+
+	for _, vg := range vgs {
+		lvs, ok := getLVMActivationLVs(activationMap, vg)
+		if !ok {
+			continue
+		}
+
+		selected = append(selected, vg)
+		selectedLVs[vg.UUID] = lvs
+	}
+
+	// Only the selected ones can clash, so that a duplicate can be picked by UUID.
+	duplicates := getLVMDuplicateVGs(selected)
+
+	// The duplicates are activated and renamed first, as the
+	// one keeping the name would otherwise clash with them.
+	sort.SliceStable(selected, func(i, j int) bool {
+		return duplicates[selected[i].UUID] && !duplicates[selected[j].UUID]
+	})
+
+	takenNames := make(map[string]bool)
+	for _, vg := range vgs {
+		takenNames[vg.Name] = true
+		takenNames[vg.ActiveName] = true
+	}
+
+	var errs []error
+
+	for _, vg := range selected {
+		lvs := selectedLVs[vg.UUID]
+
+		var err error
+
+		switch {
+		case !duplicates[vg.UUID]:
+			err = fm.activateLVMVolumeGroup(sc, vg, lvs)
+		case vg.ActiveName != "":
+			// Activated and renamed already.
+			continue
+		case !lvmCfg.RenameDuplicates:
+			fm.logger.Warn("Not activating a volume group with the same name as another one, select it by UUID or activate it under a different name with --lvm-rename-duplicates", "vg", vg.Name, "uuid", vg.UUID, "pvs", vg.PhysicalVolumes)
+			continue
+		default:
+			newName := getLVMDuplicateVGName(vg.Name, takenNames)
+			takenNames[newName] = true
+
+			err = fm.activateLVMVolumeGroupRenamed(sc, vg, lvs, newName)
+		}
+
+		if err != nil {
+			if activationMap != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			fm.logger.Warn("Failed to activate volume group", "vg", vg.Name, "uuid", vg.UUID, "error", err.Error())
+		}
+	}
+
+	return multierr.Combine(errs...)
+}
@@ -0,0 +1,315 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	testLVMRootUUID  = "pJbF3N-2h4L-Yk1Q-Xe6f-Zz0M-aB3c-Qw9Ert"
+	testLVMData1UUID = "Hk2L9a-Mn3P-Qr4S-Tu5V-Wx6Y-Za7B-Cd8EfG"
+	testLVMData2UUID = "Zc8Qn1-Ab2C-De3F-Gh4I-Jk5L-Mn6O-Pq7RsT"
+)
+
+const testVGsReport = `  {
+      "report": [
+          {
+              "vg": [
+                  {"vg_name":"data", "vg_uuid":"Hk2L9a-Mn3P-Qr4S-Tu5V-Wx6Y-Za7B-Cd8EfG", "vg_size":"10733223936", "vg_free":"2143289344"},
+                  {"vg_name":"data", "vg_uuid":"Zc8Qn1-Ab2C-De3F-Gh4I-Jk5L-Mn6O-Pq7RsT", "vg_size":"10733223936", "vg_free":"10733223936"},
+                  {"vg_name":"ubuntu-vg", "vg_uuid":"pJbF3N-2h4L-Yk1Q-Xe6f-Zz0M-aB3c-Qw9Ert", "vg_size":"21470642176", "vg_free":"0"}
+              ]
+          }
+      ]
+  }
+`
+
+const testPVsReport = `  {
+      "report": [
+          {
+              "pv": [
+                  {"pv_name":"/dev/vdb", "vg_uuid":"Hk2L9a-Mn3P-Qr4S-Tu5V-Wx6Y-Za7B-Cd8EfG"},
+                  {"pv_name":"/dev/vdc1", "vg_uuid":"Zc8Qn1-Ab2C-De3F-Gh4I-Jk5L-Mn6O-Pq7RsT"},
+                  {"pv_name":"/dev/vdd3", "vg_uuid":"pJbF3N-2h4L-Yk1Q-Xe6f-Zz0M-aB3c-Qw9Ert"},
+                  {"pv_name":"/dev/vde", "vg_uuid":""}
+              ]
+          }
+      ]
+  }
+`
+
+const testLVsReport = `  {
+      "report": [
+          {
+              "lv": [
+                  {"lv_name":"media", "lv_uuid":"Gh1Ij2-Kl3M-No4P-Qr5S-Tu6V-Wx7Y-Za8BcD", "vg_uuid":"Hk2L9a-Mn3P-Qr4S-Tu5V-Wx6Y-Za7B-Cd8EfG", "lv_size":"8589934592", "segtype":"linear", "pool_lv":"", "origin":"", "lv_active":"active"},
+                  {"lv_name":"media", "lv_uuid":"Uv1Wx2-Yz3A-Bc4D-Ef5G-Hi6J-Kl7M-No8PqR", "vg_uuid":"Zc8Qn1-Ab2C-De3F-Gh4I-Jk5L-Mn6O-Pq7RsT", "lv_size":"0", "segtype":"linear", "pool_lv":"", "origin":"", "lv_active":"active"},
+                  {"lv_name":"root", "lv_uuid":"e3Rt5y-Ui8o-Pa1s-Df2g-Hj3k-Lz4x-Cv5bNm", "vg_uuid":"pJbF3N-2h4L-Yk1Q-Xe6f-Zz0M-aB3c-Qw9Ert", "lv_size":"21470642176", "segtype":"linear", "pool_lv":"", "origin":"", "lv_active":""}
+              ]
+          }
+      ]
+  }
+`
+
+// The second "data" volume group is active as "data1", the "ubuntu-vg" one is not active.
+const testDMDevices = "LVM-Hk2L9aMn3PQr4STu5VWx6YZa7BCd8EfGGh1Ij2Kl3MNo4PQr5STu6VWx7YZa8BcD\tdata-media\n" +
+	"LVM-Zc8Qn1Ab2CDe3FGh4IJk5LMn6OPq7RsTUv1Wx2Yz3ABc4DEf5GHi6JKl7MNo8PqR\tdata1-media\n" +
+	"CRYPT-LUKS2-0d3a6f2e5c1b4f579d0e1e8b2a7c4f10-luks-vdf\tluks-vdf\n" +
+	"\tplain\n"
+
+func TestParseLVMReport(t *testing.T) {
+	have, err := parseLVMReport([]byte(testPVsReport), "pv")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := []map[string]string{
+		{"pv_name": "/dev/vdb", "vg_uuid": testLVMData1UUID},
+		{"pv_name": "/dev/vdc1", "vg_uuid": testLVMData2UUID},
+		{"pv_name": "/dev/vdd3", "vg_uuid": testLVMRootUUID},
+		{"pv_name": "/dev/vde", "vg_uuid": ""},
+	}
+
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// No physical volumes at all.
+	have, err = parseLVMReport([]byte(`{"report": [{"pv": []}]}`), "pv")
+	if err != nil {
+		t.Fatalf("parse empty: %v", err)
+	}
+
+	if len(have) != 0 {
+		t.Errorf("want no rows, have %v", have)
+	}
+
+	_, err = parseLVMReport([]byte("  WARNING: Not using device /dev/vdc1 for PV.\n"), "pv")
+	if err == nil {
+		t.Errorf("want an error for a non-JSON report")
+	}
+}
+
+func TestParseLVMSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint64
+		err  bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "21470642176", want: 21470642176},
+		{in: "20.00g", err: true},
+		{in: "-1", err: true},
+	} {
+		have, err := parseLVMSize(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: want error %v, have %v", tc.in, tc.err, err)
+			continue
+		}
+
+		if have != tc.want {
+			t.Errorf("%q: want %v, have %v", tc.in, tc.want, have)
+		}
+	}
+}
+
+func TestSplitLVMDMName(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		vg   string
+		rest string
+		ok   bool
+	}{
+		{in: "data-media", vg: "data", rest: "media", ok: true},
+		{in: "ubuntu--vg-root", vg: "ubuntu--vg", rest: "root", ok: true},
+		{in: "vg-thin--pool_tdata", vg: "vg", rest: "thin--pool_tdata", ok: true},
+		{in: "a--b--c-d--e", vg: "a--b--c", rest: "d--e", ok: true},
+		{in: "ubuntu--vg", ok: false},
+		{in: "plain", ok: false},
+	} {
+		vg, rest, ok := splitLVMDMName(tc.in)
+		if vg != tc.vg || rest != tc.rest || ok != tc.ok {
+			t.Errorf("%q: want (%q, %q, %v), have (%q, %q, %v)", tc.in, tc.vg, tc.rest, tc.ok, vg, rest, ok)
+		}
+	}
+}
+
+func TestParseDMDevices(t *testing.T) {
+	have, err := parseDMDevices(testDMDevices)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := []dmDevice{
+		{UUID: "LVM-Hk2L9aMn3PQr4STu5VWx6YZa7BCd8EfGGh1Ij2Kl3MNo4PQr5STu6VWx7YZa8BcD", Name: "data-media"},
+		{UUID: "LVM-Zc8Qn1Ab2CDe3FGh4IJk5LMn6OPq7RsTUv1Wx2Yz3ABc4DEf5GHi6JKl7MNo8PqR", Name: "data1-media"},
+		{UUID: "CRYPT-LUKS2-0d3a6f2e5c1b4f579d0e1e8b2a7c4f10-luks-vdf", Name: "luks-vdf"},
+	}
+
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	_, err = parseDMDevices("LVM-Hk2L9a data-media\n")
+	if err == nil {
+		t.Errorf("want an error for a line without a tab")
+	}
+}
+
+func TestBuildLVMVolumeGroups(t *testing.T) {
+	var rows [3][]map[string]string
+	for i, report := range []struct {
+		out  string
+		kind string
+	}{
+		{testVGsReport, "vg"},
+		{testPVsReport, "pv"},
+		{testLVsReport, "lv"},
+	} {
+		var err error
+		rows[i], err = parseLVMReport([]byte(report.out), report.kind)
+		if err != nil {
+			t.Fatalf("parse %v report: %v", report.kind, err)
+		}
+	}
+
+	dmDevs, err := parseDMDevices(testDMDevices)
+	if err != nil {
+		t.Fatalf("parse dm devices: %v", err)
+	}
+
+	have, err := buildLVMVolumeGroups(rows[0], rows[1], rows[2], dmDevs)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	want := []LVMVolumeGroup{
+		{
+			Name:            "data",
+			UUID:            testLVMData1UUID,
+			Size:            10733223936,
+			Free:            2143289344,
+			PhysicalVolumes: []string{"vdb"},
+			LogicalVolumes: []LVMLogicalVolume{
+				{Name: "media", UUID: "Gh1Ij2-Kl3M-No4P-Qr5S-Tu6V-Wx7Y-Za8BcD", Size: 8589934592, Type: "linear", Active: true, DevName: "mapper/data-media"},
+			},
+			DuplicateName: true,
+			ActiveName:    "data",
+		},
+		{
+			Name:            "data",
+			UUID:            testLVMData2UUID,
+			Size:            10733223936,
+			Free:            10733223936,
+			PhysicalVolumes: []string{"vdc1"},
+			LogicalVolumes: []LVMLogicalVolume{
+				{Name: "media", UUID: "Uv1Wx2-Yz3A-Bc4D-Ef5G-Hi6J-Kl7M-No8PqR", Type: "linear", Active: true, DevName: "mapper/data1-media"},
+			},
+			DuplicateName: true,
+			ActiveName:    "data1",
+		},
+		{
+			Name:            "ubuntu-vg",
+			UUID:            testLVMRootUUID,
+			Size:            21470642176,
+			PhysicalVolumes: []string{"vdd3"},
+			LogicalVolumes: []LVMLogicalVolume{
+				{Name: "root", UUID: "e3Rt5y-Ui8o-Pa1s-Df2g-Hj3k-Lz4x-Cv5bNm", Size: 21470642176, Type: "linear", DevName: "mapper/ubuntu--vg-root"},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	// The volume group already active under its own name keeps it, whatever the order.
+	dups := getLVMDuplicateVGs([]LVMVolumeGroup{have[1], have[0], have[2]})
+	if want := map[string]bool{testLVMData2UUID: true}; !reflect.DeepEqual(want, dups) {
+		t.Errorf("want duplicates %v, have %v", want, dups)
+	}
+}
+
+func TestGetLVMDuplicateVGs(t *testing.T) {
+	vgs := []LVMVolumeGroup{
+		{Name: "data", UUID: testLVMData1UUID},
+		{Name: "data", UUID: testLVMData2UUID},
+		{Name: "ubuntu-vg", UUID: testLVMRootUUID},
+	}
+
+	// The first one keeps the name if none are active.
+	have := getLVMDuplicateVGs(vgs)
+	if want := map[string]bool{testLVMData2UUID: true}; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Only the volume groups given are compared.
+	have = getLVMDuplicateVGs(vgs[1:])
+	if len(have) != 0 {
+		t.Errorf("want no duplicates, have %v", have)
+	}
+
+	name := getLVMDuplicateVGName("data", map[string]bool{"data": true, "data1": true, "data3": true})
+	if want := "data2"; name != want {
+		t.Errorf("want duplicate name %q, have %q", want, name)
+	}
+}
+
+func TestLVMActivationMap(t *testing.T) {
+	cfg := LVMConfig{
+		Activate: []string{
+			"ubuntu-vg/root",
+			"ubuntu-vg/home",
+			"uuid=" + testLVMData2UUID,
+			"data/media",
+		},
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	am := cfg.getActivationMap()
+
+	for _, tc := range []struct {
+		vg       LVMVolumeGroup
+		lvs      []string
+		activate bool
+	}{
+		{vg: LVMVolumeGroup{Name: "ubuntu-vg", UUID: testLVMRootUUID}, lvs: []string{"root", "home"}, activate: true},
+		{vg: LVMVolumeGroup{Name: "data", UUID: testLVMData1UUID}, lvs: []string{"media"}, activate: true},
+		// Selected as a whole by UUID.
+		{vg: LVMVolumeGroup{Name: "data", UUID: testLVMData2UUID}, activate: true},
+		{vg: LVMVolumeGroup{Name: "other", UUID: "Aa1Bb2-Cc3D-Dd4E-Ee5F-Ff6G-Gg7H-Hh8IiJ"}, activate: false},
+	} {
+		lvs, activate := getLVMActivationLVs(am, tc.vg)
+		if !reflect.DeepEqual(tc.lvs, lvs) || activate != tc.activate {
+			t.Errorf("%v (%v): want (%q, %v), have (%q, %v)", tc.vg.Name, tc.vg.UUID, tc.lvs, tc.activate, lvs, activate)
+		}
+	}
+
+	for _, v := range []string{"uuid=not-an-uuid", "bad name", "vg/bad/lv"} {
+		err := LVMConfig{Activate: []string{v}}.validate()
+		if err == nil {
+			t.Errorf("%q: want a validation error", v)
+		}
+	}
+}
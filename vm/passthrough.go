@@ -16,6 +16,16 @@
 
 package vm
 
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/pkg/errors"
+)
+
 type USBDevicePassthroughConfig struct {
 	VendorID  uint16
 	ProductID uint16
@@ -24,9 +34,112 @@ type USBDevicePassthroughConfig struct {
 type BlockDevicePassthroughConfig struct {
 	Path      string
 	BlockSize uint64
+
+	// If set, the device is attached through this qcow2 overlay, which
+	// has the device as its backing file. All writes land in the overlay.
+	OverlayPath string
+}
+
+type ImagePassthroughConfig struct {
+	Path     string
+	Format   string
+	ReadOnly bool
+
+	// Same as for BlockDevicePassthroughConfig.
+	OverlayPath string
 }
 
 type PassthroughConfig struct {
 	USB   []USBDevicePassthroughConfig
 	Block []BlockDevicePassthroughConfig
+	Image []ImagePassthroughConfig
+}
+
+// Disk image formats that can be passed through. There are more formats
+// QEMU supports, but these are the ones people actually come across.
+var imagePassthroughFormats = []string{"raw", "qcow2", "vhdx", "vmdk", "vdi"}
+
+func CheckImagePassthroughFormat(format string) error {
+	for _, f := range imagePassthroughFormats {
+		if f == format {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported disk image format '%v' (supported are %v)", format, strings.Join(imagePassthroughFormats, ", "))
+}
+
+// Passed-through block devices are tagged with virtio-blk serial numbers
+// so that we can tell which in-VM device corresponds to which host device.
+const (
+	blockPassthroughSerialPrefix = "linsk"
+	imagePassthroughSerialPrefix = "linskimg"
+)
+
+func getBlockPassthroughSerial(i int) string {
+	return blockPassthroughSerialPrefix + strconv.Itoa(i)
+}
+
+func getImagePassthroughSerial(i int) string {
+	return imagePassthroughSerialPrefix + strconv.Itoa(i)
+}
+
+type BlockDevicePassthroughMapping struct {
+	HostPath  string
+	VMDevName string
+}
+
+// GetBlockPassthroughMap returns which in-VM device (e.g. "vdb") each of
+// the passed-through block devices and disk images became. Block devices
+// come first, and the order is the same as in the passthrough config.
+func (vm *VM) GetBlockPassthroughMap(ctx context.Context) ([]BlockDevicePassthroughMapping, error) {
+	sc, err := vm.DialSSH()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	out, err := sshutil.RunSSHCmd(ctx, sc, `for d in /sys/block/vd*; do [ -e "$d/serial" ] && echo "$(basename "$d") $(cat "$d/serial")"; done; true`)
+	if err != nil {
+		return nil, errors.Wrap(err, "list virtio block device serials")
+	}
+
+	serialToDev := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		split := strings.Fields(line)
+		if len(split) != 2 {
+			continue
+		}
+
+		serialToDev[split[1]] = split[0]
+	}
+
+	var ret []BlockDevicePassthroughMapping
+
+	for i, dev := range vm.originalCfg.PassthroughConfig.Block {
+		devName, ok := serialToDev[getBlockPassthroughSerial(i)]
+		if !ok {
+			return nil, fmt.Errorf("passed-through device '%v' not found in the vm", dev.Path)
+		}
+
+		ret = append(ret, BlockDevicePassthroughMapping{
+			HostPath:  dev.Path,
+			VMDevName: devName,
+		})
+	}
+
+	for i, img := range vm.originalCfg.PassthroughConfig.Image {
+		devName, ok := serialToDev[getImagePassthroughSerial(i)]
+		if !ok {
+			return nil, fmt.Errorf("passed-through disk image '%v' not found in the vm", img.Path)
+		}
+
+		ret = append(ret, BlockDevicePassthroughMapping{
+			HostPath:  img.Path,
+			VMDevName: devName,
+		})
+	}
+
+	return ret, nil
 }
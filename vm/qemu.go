@@ -0,0 +1,345 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/AlexSSD7/linsk/osspecifics"
+	"github.com/AlexSSD7/linsk/qemucli"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/phayes/freeport"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+// QEMUHypervisor runs the VM with QEMU. This is the default hypervisor.
+type QEMUHypervisor struct {
+	logger *slog.Logger
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	cmd       *exec.Cmd
+	stderrBuf *bytes.Buffer
+
+	serialRead  *io.PipeReader
+	serialWrite *io.PipeWriter
+
+	accel    accelerator
+	fwCfgDir string
+
+	qmpPort uint16
+	qmp     *QMPClient
+	qmpMu   sync.RWMutex
+
+	agentPort uint16
+}
+
+func NewQEMUHypervisor(logger *slog.Logger) *QEMUHypervisor {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	return &QEMUHypervisor{
+		logger: logger,
+
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+}
+
+func (q *QEMUHypervisor) Prepare(spec HypervisorSpec) error {
+	if q.cmd != nil {
+		return fmt.Errorf("already prepared")
+	}
+
+	cfg := spec.Config
+
+	qmpPort, err := freeport.GetFreePort()
+	if err != nil {
+		return errors.Wrap(err, "get free port for qmp")
+	}
+
+	qemuCmd, err := getQEMUSystemCmd()
+	if err != nil {
+		return errors.Wrap(err, "get qemu system cmd")
+	}
+
+	accel := detectAccelerator(q.logger, qemuCmd)
+
+	baseCmd, cmdArgs, err := configureBaseVMCmd(q.logger, cfg, uint16(qmpPort), accel)
+	if err != nil {
+		return errors.Wrap(err, "configure base vm cmd")
+	}
+
+	netCmdArgs, err := configureVMCmdNetworking(q.logger, cfg, spec.PortForwardingRules)
+	if err != nil {
+		return errors.Wrap(err, "configure vm cmd networking")
+	}
+
+	cmdArgs = append(cmdArgs, netCmdArgs...)
+
+	driveCmdArgs, err := configureVMCmdDrives(cfg)
+	if err != nil {
+		return errors.Wrap(err, "configure vm cmd drives")
+	}
+
+	cmdArgs = append(cmdArgs, driveCmdArgs...)
+
+	usbCmdArgs := configureVMCmdUSBPassthrough(cfg)
+
+	cmdArgs = append(cmdArgs, usbCmdArgs...)
+
+	blockDevArgs, err := configureVMCmdBlockDevicePassthrough(q.logger, cfg)
+	if err != nil {
+		return errors.Wrap(err, "configure vm cmd block device passthrough")
+	}
+
+	cmdArgs = append(cmdArgs, blockDevArgs...)
+
+	imageArgs, err := configureVMCmdImagePassthrough(cfg)
+	if err != nil {
+		return errors.Wrap(err, "configure vm cmd image passthrough")
+	}
+
+	cmdArgs = append(cmdArgs, imageArgs...)
+
+	var agentPort int
+	if cfg.GuestAgent {
+		agentPort, err = freeport.GetFreePort()
+		if err != nil {
+			return errors.Wrap(err, "get free port for guest agent")
+		}
+
+		cmdArgs = append(cmdArgs, configureVMCmdGuestAgent(uint16(agentPort))...)
+	}
+
+	fwCfgDir, fwCfgArgs, err := writeFwCfgFiles([]fwCfgFile{
+		{Name: fwCfgAuthorizedKeysName, Data: spec.SSHAuthorizedKey},
+		{Name: fwCfgSSHHostKeyName, Data: spec.SSHHostKeyPEM},
+	})
+	if err != nil {
+		return errors.Wrap(err, "write fw_cfg files")
+	}
+
+	cmdArgs = append(cmdArgs, fwCfgArgs...)
+
+	encodedCmdArgs, err := qemucli.EncodeArgs(cmdArgs)
+	if err != nil {
+		_ = os.RemoveAll(fwCfgDir)
+		return errors.Wrap(err, "encode qemu cli args")
+	}
+
+	// No errors beyond this point.
+
+	sysRead, userWrite := io.Pipe()
+	userRead, sysWrite := io.Pipe()
+
+	cmd := exec.Command(baseCmd, encodedCmdArgs...) //#nosec G204 // I know, it's generally a bad idea to include variables into shell commands, but QEMU unfortunately does not accept anything else.
+
+	cmd.Stdin = sysRead
+	cmd.Stdout = sysWrite
+	stderrBuf := bytes.NewBuffer(nil)
+	cmd.Stderr = stderrBuf
+
+	if cfg.Debug {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, os.Stderr)
+	}
+
+	// This function is OS-specific.
+	osspecifics.SetNewProcessGroupCmd(cmd)
+
+	q.cmd = cmd
+	q.stderrBuf = stderrBuf
+	q.serialRead = userRead
+	q.serialWrite = userWrite
+	q.accel = accel
+	q.fwCfgDir = fwCfgDir
+	q.qmpPort = uint16(qmpPort)
+	q.agentPort = uint16(agentPort)
+
+	return nil
+}
+
+func (q *QEMUHypervisor) Start() error {
+	if q.cmd == nil {
+		return fmt.Errorf("not prepared")
+	}
+
+	err := q.cmd.Start()
+	if err != nil {
+		return errors.Wrap(err, "start qemu cmd")
+	}
+
+	go func() {
+		err := q.connectQMP()
+		if err != nil {
+			q.logger.Warn("Failed to connect to QMP, VM control will be limited", "error", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (q *QEMUHypervisor) Wait() error {
+	if q.cmd == nil || q.cmd.Process == nil {
+		return fmt.Errorf("process is not started")
+	}
+
+	_, err := q.cmd.Process.Wait()
+	return err
+}
+
+func (q *QEMUHypervisor) Shutdown(ctx context.Context) error {
+	qmp, err := q.QMP()
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(qmp.SystemPowerdown(ctx), "qmp system powerdown")
+}
+
+func (q *QEMUHypervisor) Terminate() error {
+	if q.cmd == nil || q.cmd.Process == nil {
+		return fmt.Errorf("process is not started")
+	}
+
+	return osspecifics.TerminateProcess(q.cmd.Process.Pid)
+}
+
+func (q *QEMUHypervisor) Kill() error {
+	if q.cmd == nil || q.cmd.Process == nil {
+		return fmt.Errorf("process is not started")
+	}
+
+	return q.cmd.Process.Kill()
+}
+
+func (q *QEMUHypervisor) Console() (io.Reader, io.Writer) {
+	return q.serialRead, q.serialWrite
+}
+
+func (q *QEMUHypervisor) AgentAddr() (string, error) {
+	if q.agentPort == 0 {
+		return "", ErrAgentUnavailable
+	}
+
+	return "127.0.0.1:" + utils.UintToStr(q.agentPort), nil
+}
+
+func (q *QEMUHypervisor) SoftwareEmulated() bool {
+	return q.accel.Software
+}
+
+func (q *QEMUHypervisor) Log() string {
+	if q.stderrBuf == nil {
+		return ""
+	}
+
+	return q.stderrBuf.String()
+}
+
+func (q *QEMUHypervisor) Close() error {
+	q.ctxCancel()
+
+	var errs []error
+
+	errs = append(errs, errors.Wrap(q.closeQMP(), "close qmp"))
+
+	if q.fwCfgDir != "" {
+		errs = append(errs, errors.Wrap(os.RemoveAll(q.fwCfgDir), "remove fw_cfg dir"))
+	}
+
+	if q.serialRead != nil {
+		errs = append(errs,
+			errors.Wrap(q.serialRead.Close(), "close serial read pipe"),
+			errors.Wrap(q.serialWrite.Close(), "close serial write pipe"),
+		)
+	}
+
+	return multierr.Combine(errs...)
+}
+
+func (q *QEMUHypervisor) connectQMP() error {
+	addr := "127.0.0.1:" + utils.UintToStr(q.qmpPort)
+
+	// QEMU may take a moment to start listening on the QMP socket.
+	for i := 0; ; i++ {
+		ctx, ctxCancel := context.WithTimeout(q.ctx, time.Second*5)
+		qmp, err := DialQMP(ctx, q.logger.With("subcaller", "qmp"), addr)
+		ctxCancel()
+		if err == nil {
+			q.qmpMu.Lock()
+			defer q.qmpMu.Unlock()
+
+			select {
+			case <-q.ctx.Done():
+				_ = qmp.Close()
+				return q.ctx.Err()
+			default:
+			}
+
+			q.qmp = qmp
+			q.logger.Debug("Connected to QMP")
+
+			return nil
+		}
+
+		if i >= 50 {
+			return errors.Wrap(err, "dial qmp")
+		}
+
+		select {
+		case <-q.ctx.Done():
+			return q.ctx.Err()
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+func (q *QEMUHypervisor) closeQMP() error {
+	q.qmpMu.Lock()
+	defer q.qmpMu.Unlock()
+
+	if q.qmp == nil {
+		return nil
+	}
+
+	err := q.qmp.Close()
+	q.qmp = nil
+
+	return err
+}
+
+// QMP returns the QEMU Machine Protocol client connected to the running VM.
+func (q *QEMUHypervisor) QMP() (*QMPClient, error) {
+	q.qmpMu.RLock()
+	defer q.qmpMu.RUnlock()
+
+	if q.qmp == nil {
+		return nil, ErrQMPUnavailable
+	}
+
+	return q.qmp, nil
+}
@@ -0,0 +1,225 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// QMPClient is a minimal client for the QEMU Machine Protocol. It is used
+// to query and control a running VM without relying on the guest OS.
+type QMPClient struct {
+	logger *slog.Logger
+
+	conn net.Conn
+	dec  *json.Decoder
+
+	// Only one command can be in flight at a time as QMP
+	// responses do not carry any command identifiers.
+	mu sync.Mutex
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+type qmpMessage struct {
+	// Greeting.
+	QMP json.RawMessage `json:"QMP"`
+
+	// Command response.
+	Return json.RawMessage `json:"return"`
+	Error  *qmpError       `json:"error"`
+
+	// Asynchronous event.
+	Event string `json:"event"`
+}
+
+type QMPStatusInfo struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+type QMPBlockInserted struct {
+	File      string `json:"file"`
+	Driver    string `json:"drv"`
+	ReadOnly  bool   `json:"ro"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+type QMPBlockInfo struct {
+	Device    string            `json:"device"`
+	QDev      string            `json:"qdev"`
+	Type      string            `json:"type"`
+	Removable bool              `json:"removable"`
+	Locked    bool              `json:"locked"`
+	Inserted  *QMPBlockInserted `json:"inserted"`
+}
+
+func DialQMP(ctx context.Context, logger *slog.Logger, addr string) (*QMPClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial qmp socket")
+	}
+
+	c := &QMPClient{
+		logger: logger,
+
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+	}
+
+	err = c.handshake(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "qmp handshake")
+	}
+
+	return c, nil
+}
+
+func (c *QMPClient) handshake(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setDeadline(ctx)
+
+	var greeting qmpMessage
+	err := c.dec.Decode(&greeting)
+	if err != nil {
+		return errors.Wrap(err, "read greeting")
+	}
+
+	if greeting.QMP == nil {
+		return fmt.Errorf("unexpected first qmp message (no greeting)")
+	}
+
+	return errors.Wrap(c.executeLocked(ctx, "qmp_capabilities", nil, nil), "negotiate capabilities")
+}
+
+func (c *QMPClient) setDeadline(ctx context.Context) {
+	// We don't want to hang forever if QEMU stops responding.
+	deadline := time.Now().Add(time.Second * 10)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	_ = c.conn.SetDeadline(deadline)
+}
+
+func (c *QMPClient) execute(ctx context.Context, cmd string, args interface{}, ret interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.executeLocked(ctx, cmd, args, ret)
+}
+
+func (c *QMPClient) executeLocked(ctx context.Context, cmd string, args interface{}, ret interface{}) error {
+	c.setDeadline(ctx)
+
+	err := json.NewEncoder(c.conn).Encode(qmpCommand{
+		Execute:   cmd,
+		Arguments: args,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "write qmp command '%v'", cmd)
+	}
+
+	for {
+		var msg qmpMessage
+		err := c.dec.Decode(&msg)
+		if err != nil {
+			return errors.Wrapf(err, "read qmp response to '%v'", cmd)
+		}
+
+		if msg.Event != "" {
+			// We are not subscribing to any events, but QEMU
+			// sends them regardless. These can come in between
+			// the command and its response.
+			c.logger.Debug("Received QMP event", "event", msg.Event)
+			continue
+		}
+
+		if msg.Error != nil {
+			return fmt.Errorf("qmp command '%v' failed: %v (class '%v')", cmd, msg.Error.Desc, msg.Error.Class)
+		}
+
+		if ret != nil && msg.Return != nil {
+			err = json.Unmarshal(msg.Return, ret)
+			if err != nil {
+				return errors.Wrapf(err, "unmarshal qmp response to '%v'", cmd)
+			}
+		}
+
+		return nil
+	}
+}
+
+func (c *QMPClient) QueryStatus(ctx context.Context) (QMPStatusInfo, error) {
+	var ret QMPStatusInfo
+	err := c.execute(ctx, "query-status", nil, &ret)
+	return ret, err
+}
+
+func (c *QMPClient) QueryBlock(ctx context.Context) ([]QMPBlockInfo, error) {
+	var ret []QMPBlockInfo
+	err := c.execute(ctx, "query-block", nil, &ret)
+	return ret, err
+}
+
+// Balloon sets the memory size the guest OS is to be left with, in bytes.
+// The guest OS gives the memory up (or takes it back) asynchronously.
+func (c *QMPClient) Balloon(ctx context.Context, size uint64) error {
+	return c.execute(ctx, "balloon", map[string]interface{}{"value": size}, nil)
+}
+
+// SystemPowerdown requests an ACPI shutdown. It returns as soon as the
+// request is delivered, the guest OS may take a while to actually shut down.
+func (c *QMPClient) SystemPowerdown(ctx context.Context) error {
+	return c.execute(ctx, "system_powerdown", nil, nil)
+}
+
+// Quit terminates QEMU immediately without waiting for the guest OS.
+func (c *QMPClient) Quit(ctx context.Context) error {
+	err := c.execute(ctx, "quit", nil, nil)
+	if err != nil && errors.Is(err, io.EOF) {
+		// QEMU may close the connection before the response is received.
+		return nil
+	}
+
+	return err
+}
+
+func (c *QMPClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,176 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Assembling may take a while with many members or slow disks.
+const raidAssembleTimeout = time.Minute
+
+// RAIDArray is an mdadm software RAID array known to the kernel.
+type RAIDArray struct {
+	// The device name relative to /dev, e.g. "md127".
+	Name  string `json:"name"`
+	Level string `json:"level"`
+
+	// The md array state, e.g. "clean", "active", "read-auto", "readonly" or "inactive".
+	State string `json:"state"`
+
+	Devices        int `json:"devices"`
+	MissingDevices int `json:"missing_devices"`
+}
+
+func (a RAIDArray) Degraded() bool {
+	return a.MissingDevices != 0
+}
+
+func (a RAIDArray) Active() bool {
+	return a.State != "inactive"
+}
+
+// Arrays are started read-only in the read-only mode. Otherwise, they are
+// started in auto-read-only mode, meaning that mdadm does not write anything
+// to the members (including resyncs) until the array itself is written to.
+//
+// mdadm exits with 1 if there is nothing to assemble, including when the arrays are already
+// assembled. Arrays which failed to assemble are found by checking their state afterwards.
+func getRAIDAssembleCmd(readOnly bool) string {
+	cmd := "modprobe md_mod || exit 1\n"
+
+	if readOnly {
+		cmd += "mdadm --assemble --scan --readonly 2>&1\n"
+	} else {
+		cmd += "echo 1 > /sys/module/md_mod/parameters/start_ro || exit 1\n" +
+			"mdadm --assemble --scan 2>&1\n"
+	}
+
+	return cmd + "[ $? -le 1 ]"
+}
+
+// InitRAID assembles the mdadm software RAID arrays found on the block devices.
+// Degraded arrays are started and reported. It is safe to call multiple times.
+func (fm *FileManager) InitRAID() error {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	out, err := sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, raidAssembleTimeout, sc, getRAIDAssembleCmd(fm.vm.originalCfg.ReadOnly))
+	if err != nil {
+		return errors.Wrap(err, "run mdadm assemble cmd")
+	}
+
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		fm.logger.Debug("mdadm assemble output", "output", msg)
+	}
+
+	arrays, err := fm.getRAIDArrays(sc)
+	if err != nil {
+		return errors.Wrap(err, "get raid arrays")
+	}
+
+	for _, a := range arrays {
+		switch {
+		case !a.Active():
+			fm.logger.Warn("RAID array could not be started, too many of its members may be missing", "array", a.Name)
+		case a.Degraded():
+			fm.logger.Warn("RAID array is degraded", "array", a.Name, "level", a.Level, "devices", a.Devices, "missing-devices", a.MissingDevices)
+		default:
+			fm.logger.Debug("RAID array is available", "array", a.Name, "level", a.Level, "devices", a.Devices, "state", a.State)
+		}
+	}
+
+	return nil
+}
+
+// RAIDArrays returns the md arrays known to the kernel, including the inactive ones.
+func (fm *FileManager) RAIDArrays() ([]RAIDArray, error) {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	return fm.getRAIDArrays(sc)
+}
+
+// The "degraded" attribute exists for redundant levels only.
+const listRAIDArraysCmd = `for d in /sys/block/md*; do
+	[ -e "$d/md" ] || continue
+	printf '%s\t%s\t%s\t%s\t%s\n' "${d##*/}" "$(cat "$d/md/level")" "$(cat "$d/md/array_state")" "$(cat "$d/md/raid_disks")" "$(cat "$d/md/degraded" 2> /dev/null || echo 0)"
+done`
+
+func (fm *FileManager) getRAIDArrays(sc *ssh.Client) ([]RAIDArray, error) {
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, listRAIDArraysCmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "run list raid arrays cmd")
+	}
+
+	return parseRAIDArrays(string(out))
+}
+
+func parseRAIDArrays(out string) ([]RAIDArray, error) {
+	var ret []RAIDArray
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+		if len(split) != 5 {
+			return nil, fmt.Errorf("bad raid array line '%v'", line)
+		}
+
+		// Inactive arrays may have no disks set.
+		var devices int
+		if split[3] != "" {
+			var err error
+			devices, err = strconv.Atoi(split[3])
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse device count of '%v'", split[0])
+			}
+		}
+
+		missing, err := strconv.Atoi(split[4])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse degraded count of '%v'", split[0])
+		}
+
+		ret = append(ret, RAIDArray{
+			Name:           split[0],
+			Level:          split[1],
+			State:          split[2],
+			Devices:        devices,
+			MissingDevices: missing,
+		})
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,90 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRAIDArrays(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []RAIDArray
+	}{
+		{
+			name: "none",
+			out:  "",
+		},
+		{
+			name: "healthy",
+			out:  "md127\traid1\tclean\t2\t0\n",
+			want: []RAIDArray{
+				{Name: "md127", Level: "raid1", State: "clean", Devices: 2},
+			},
+		},
+		{
+			name: "mixed",
+			out: "md125\traid5\tread-auto\t4\t1\n" +
+				"md126\traid0\treadonly\t2\t0\n" +
+				// Inactive arrays have neither the level nor the disks set.
+				"md127\t\tinactive\t\t0\n",
+			want: []RAIDArray{
+				{Name: "md125", Level: "raid5", State: "read-auto", Devices: 4, MissingDevices: 1},
+				{Name: "md126", Level: "raid0", State: "readonly", Devices: 2},
+				{Name: "md127", State: "inactive"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := parseRAIDArrays(tc.out)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Errorf("want %+v, have %+v", tc.want, have)
+			}
+		})
+	}
+}
+
+func TestParseRAIDArraysErrors(t *testing.T) {
+	for _, out := range []string{
+		"md127\traid1\tclean\t2\n",
+		"md127\traid1\tclean\ttwo\t0\n",
+		"md127\traid1\tclean\t2\t\n",
+	} {
+		_, err := parseRAIDArrays(out)
+		if err == nil {
+			t.Errorf("%q: want an error", out)
+		}
+	}
+}
+
+func TestRAIDArrayState(t *testing.T) {
+	a := RAIDArray{State: "inactive"}
+	if a.Active() || a.Degraded() {
+		t.Errorf("want an inactive non-degraded array, have %+v", a)
+	}
+
+	a = RAIDArray{State: "clean", Devices: 2, MissingDevices: 1}
+	if !a.Active() || !a.Degraded() {
+		t.Errorf("want an active degraded array, have %+v", a)
+	}
+}
@@ -0,0 +1,225 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"time"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// The default maximum time for the teardown, the poweroff
+	// request and the guest OS shutdown altogether.
+	defaultShutdownTimeout = time.Second * 15
+
+	// The time given to the hypervisor to exit after
+	// a termination request before it is killed.
+	terminateTimeout = time.Second * 5
+)
+
+type teardownStep struct {
+	Name string
+	Cmd  string
+
+	// Failures of best-effort steps are expected in some
+	// setups and are retried by one of the later steps.
+	BestEffort bool
+}
+
+// Closes all dm-crypt mappings. The mapping names are taken from sysfs
+// as we don't want to depend on what and how was opened.
+const closeCryptMappingsCmd = `failed=0
+for d in /sys/block/dm-*; do
+	[ -e "$d/dm/uuid" ] || continue
+	case "$(cat "$d/dm/uuid")" in
+	CRYPT-*) cryptsetup close "$(cat "$d/dm/name")" || failed=1 ;;
+	esac
+done
+exit $failed`
+
+// Deactivates the volume groups one by one by UUID, as the
+// ones with duplicate names cannot be referred to by name.
+const deactivateLVMCmd = `command -v vgs > /dev/null || exit 0
+failed=0
+for uuid in $(vgs --noheadings -o vg_uuid 2> /dev/null); do
+	vgchange -an --select "vg_uuid=\"$uuid\"" > /dev/null || failed=1
+done
+exit $failed`
+
+// Stops all md arrays, found the same way as the dm-crypt mappings above.
+const stopRAIDArraysCmd = `failed=0
+for d in /sys/block/md*; do
+	[ -e "$d/md" ] || continue
+	mdadm --stop "/dev/${d##*/}" || failed=1
+done
+exit $failed`
+
+// The teardown is done before powering off to make sure that everything
+// is flushed to passed-through devices. Shutting the guest OS down would
+// do mostly the same, but we would not know whether it succeeded.
+var teardownSteps = []teardownStep{
+	{
+		Name: "stop-shares",
+		Cmd:  `for s in vsftpd samba netatalk; do if [ -e "/etc/init.d/$s" ]; then rc-service --ifstarted "$s" stop || exit 1; fi; done`,
+	},
+	{
+		Name: "sync",
+		Cmd:  "sync",
+	},
+	{
+		// Unmounts everything under /mnt, the most nested mounts first.
+		// A busy mount does not stop the others from being unmounted.
+		Name: "unmount",
+		Cmd:  `failed=0; for m in $(awk '$2 ~ "^/mnt(/|$)" {print $2}' /proc/mounts | sort -r); do umount "$m" || failed=1; done; exit $failed`,
+	},
+	{
+		// ZFS pools may be on top of LUKS or LVM, so they go first.
+		Name: "export-zfs",
+		Cmd:  "if command -v zpool > /dev/null; then zpool export -a; fi",
+	},
+	{
+		// This will fail for LUKS containers holding LVM volumes which are still active.
+		Name:       "close-luks",
+		Cmd:        closeCryptMappingsCmd,
+		BestEffort: true,
+	},
+	{
+		// Deactivating the volumes before the disks go away keeps the LVM metadata clean.
+		Name: "deactivate-lvm",
+		Cmd:  deactivateLVMCmd,
+	},
+	{
+		// This will fail for arrays holding LUKS containers, which are closed only below.
+		Name:       "stop-raid",
+		Cmd:        stopRAIDArraysCmd,
+		BestEffort: true,
+	},
+	{
+		Name: "close-luks-remaining",
+		Cmd:  closeCryptMappingsCmd,
+	},
+	{
+		Name: "stop-raid-remaining",
+		Cmd:  stopRAIDArraysCmd,
+	},
+}
+
+// The steps share the deadline of ctx, so that a hung guest cannot hold the shutdown up.
+func (vm *VM) runTeardown(ctx context.Context, sc *ssh.Client) error {
+	var errs []error
+
+	for _, step := range teardownSteps {
+		if ctx.Err() != nil {
+			vm.logger.Warn("Ran out of time for the VM teardown, skipping the remaining steps", "step", step.Name)
+			errs = append(errs, errors.Wrapf(ctx.Err(), "run teardown step '%v'", step.Name))
+
+			break
+		}
+
+		_, err := sshutil.RunSSHCmdWithTimeout(ctx, vm.shutdownTimeout, sc, step.Cmd)
+		if err != nil {
+			if step.BestEffort {
+				vm.logger.Debug("Best-effort teardown step failed, will retry later", "step", step.Name, "error", err.Error())
+				continue
+			}
+
+			vm.logger.Warn("Teardown step failed", "step", step.Name, "error", err.Error())
+			errs = append(errs, errors.Wrapf(err, "run teardown step '%v'", step.Name))
+
+			continue
+		}
+
+		vm.logger.Info("Teardown step succeeded", "step", step.Name)
+	}
+
+	return multierr.Combine(errs...)
+}
+
+// Returns true if a shutdown request was delivered to the VM.
+// The teardown and the request are done within the deadline of ctx.
+func (vm *VM) requestShutdown(ctx context.Context) bool {
+	select {
+	case <-vm.exitedCh:
+		// Already exited, nothing to shut down.
+		return true
+	default:
+	}
+
+	sc, err := vm.DialSSH()
+	if err != nil {
+		if !errors.Is(err, ErrSSHUnavailable) {
+			vm.logger.Warn("Failed to dial VM SSH to do graceful shutdown", "error", err.Error())
+		}
+	} else {
+		vm.logger.Info("Tearing down the VM")
+
+		err = vm.runTeardown(ctx, sc)
+		if err != nil {
+			// The guest OS will still try to do the same on poweroff.
+			vm.logger.Warn("VM teardown did not complete cleanly, proceeding with poweroff", "error", err.Error())
+		}
+
+		vm.logger.Warn("Sending poweroff command to the VM")
+		_, err = sshutil.RunSSHCmd(ctx, sc, "poweroff")
+		_ = sc.Close()
+		if err == nil {
+			vm.logger.Info("Shutting the VM down safely")
+			return true
+		}
+
+		vm.logger.Warn("Could not power off the VM via SSH, falling back to hypervisor shutdown", "error", err.Error())
+	}
+
+	hvCtx, hvCtxCancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer hvCtxCancel()
+
+	err = vm.hv.Shutdown(hvCtx)
+	if err != nil {
+		if !errors.Is(err, ErrQMPUnavailable) {
+			vm.logger.Warn("Could not request VM shutdown from the hypervisor", "error", err.Error())
+		}
+
+		return false
+	}
+
+	vm.logger.Info("Requested VM shutdown from the hypervisor")
+
+	return true
+}
+
+// forceStop escalates from asking the hypervisor to terminate the VM to killing it.
+func (vm *VM) forceStop() error {
+	err := vm.hv.Terminate()
+	if err != nil {
+		vm.logger.Warn("Failed to terminate the VM, killing it", "error", err.Error())
+		return multierr.Combine(errors.Wrap(err, "terminate"), errors.Wrap(vm.hv.Kill(), "kill"))
+	}
+
+	select {
+	case <-vm.exitedCh:
+		vm.logger.Info("The VM has been terminated")
+		return nil
+	case <-time.After(terminateTimeout):
+		vm.logger.Warn("The VM did not terminate in time, killing it", "timeout", terminateTimeout)
+		return errors.Wrap(vm.hv.Kill(), "kill")
+	}
+}
@@ -18,6 +18,7 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -25,7 +26,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/AlexSSD7/linsk/sshutil"
 	"github.com/AlexSSD7/linsk/utils"
 	"github.com/alessio/shellescape"
 	"github.com/pkg/errors"
@@ -66,102 +66,81 @@ func ParseSSHKeyScan(knownHosts []byte) (ssh.HostKeyCallback, error) {
 	}, nil
 }
 
-func (vm *VM) scanSSHIdentity() ([]byte, error) {
+func (vm *VM) sshSetup() error {
 	vm.resetSerialStdout()
 
-	err := vm.writeSerial([]byte(`ssh-keyscan -H 127.0.0.1 && echo "SERIAL STATUS: $?" && rm /root/.ash_history` + "\n"))
+	// The SSH credentials are passed through fw_cfg, so the command
+	// we type into the serial console stays short.
+	cmd := `do_setup () { sh -c ` + shellescape.Quote(vm.getSSHSetupScript(true)) + `; echo "SERIAL"" ""STATUS: $?"; }; do_setup` + "\n"
+
+	err := vm.writeSerial([]byte(cmd))
 	if err != nil {
-		return nil, errors.Wrap(err, "write keyscan command to serial")
+		return errors.Wrap(err, "write ssh setup serial command")
 	}
 
-	deadline := time.Now().Add(time.Second * 5)
+	deadline := time.Now().Add(time.Second * 30)
 
 	stdOutErrBuf := bytes.NewBuffer(nil)
-	ret := bytes.NewBuffer(nil)
 
 	for {
 		select {
 		case <-vm.ctx.Done():
-			return nil, vm.ctx.Err()
+			return vm.ctx.Err()
 		case <-time.After(time.Until(deadline)):
-			return nil, fmt.Errorf("keyscan command timed out %v", utils.GetLogErrMsg(stdOutErrBuf.String(), "stdout/stderr log"))
+			return fmt.Errorf("setup command timed out %v", utils.GetLogErrMsg(stdOutErrBuf.String(), "stdout/stderr log"))
 		case data := <-vm.serialStdoutCh:
-			if len(data) == 0 {
-				continue
-			}
-
-			stdOutErrBuf.Write(data)
-
 			// This isn't clean at all, but there is no better
 			// way to achieve an exit status check like this.
 			prefix := []byte("SERIAL STATUS: ")
+			stdOutErrBuf.WriteString(utils.ClearUnprintableChars(string(data), true))
 			if bytes.HasPrefix(data, prefix) {
 				if len(data) == len(prefix) {
-					return nil, fmt.Errorf("keyscan command status code did not show up")
+					return fmt.Errorf("setup command status code did not show up")
 				}
 
 				if data[len(prefix)] != '0' {
-					return nil, fmt.Errorf("non-zero keyscan command status code: '%v' %v", string(data[len(prefix)]), utils.GetLogErrMsg(stdOutErrBuf.String(), "stdout/stderr log"))
+					// A non-pretty yet effective debug print to assist with debugging
+					// in case something ever goes wrong.
+					fmt.Fprintf(os.Stderr, "SSH SETUP FAILURE:\n%v", stdOutErrBuf.String())
+
+					return fmt.Errorf("non-zero setup command status code: '%v' %v", string(data[len(prefix)]), utils.GetLogErrMsg(stdOutErrBuf.String(), "stdout/stderr log"))
 				}
 
-				return ret.Bytes(), nil
-			} else if data[0] == '|' {
-				ret.Write(data)
+				return nil
 			}
 		}
 	}
 }
 
-func (vm *VM) sshSetup() (ssh.Signer, error) {
-	vm.resetSerialStdout()
-
-	sshSigner, sshPublicKey, err := sshutil.GenerateSSHKey()
-	if err != nil {
-		return nil, errors.Wrap(err, "generate ssh key")
-	}
-
+func (vm *VM) getSSHSetupScript(installKeys bool) string {
 	installSSHDCmd := ""
 	if vm.installSSH {
 		installSSHDCmd = "apk add openssh; "
 	}
 
-	cmd := `do_setup () { sh -c "set -ex; ifconfig eth0 up && ifconfig lo up && udhcpc; ` + installSSHDCmd + `mkdir -p ~/.ssh; echo ` + shellescape.Quote(string(sshPublicKey)) + ` > ~/.ssh/authorized_keys; rc-update add sshd; rc-service sshd start"; echo "SERIAL"" ""STATUS: $?"; }; do_setup` + "\n"
-
-	err = vm.writeSerial([]byte(cmd))
-	if err != nil {
-		return nil, errors.Wrap(err, "write ssh setup serial command")
+	installKeysCmd := ""
+	if installKeys {
+		installKeysCmd = GetSSHKeysInstallScript() + "; "
 	}
 
-	deadline := time.Now().Add(time.Second * 30)
-
-	stdOutErrBuf := bytes.NewBuffer(nil)
-
-	for {
-		select {
-		case <-vm.ctx.Done():
-			return nil, vm.ctx.Err()
-		case <-time.After(time.Until(deadline)):
-			return nil, fmt.Errorf("setup command timed out %v", utils.GetLogErrMsg(stdOutErrBuf.String(), "stdout/stderr log"))
-		case data := <-vm.serialStdoutCh:
-			// This isn't clean at all, but there is no better
-			// way to achieve an exit status check like this.
-			prefix := []byte("SERIAL STATUS: ")
-			stdOutErrBuf.WriteString(utils.ClearUnprintableChars(string(data), true))
-			if bytes.HasPrefix(data, prefix) {
-				if len(data) == len(prefix) {
-					return nil, fmt.Errorf("setup command status code did not show up")
-				}
+	return "set -ex; ifconfig eth0 up && ifconfig lo up && udhcpc; " + installSSHDCmd + installKeysCmd + "rc-update add sshd; rc-service sshd start"
+}
 
-				if data[len(prefix)] != '0' {
-					// A non-pretty yet effective debug print to assist with debugging
-					// in case something ever goes wrong.
-					fmt.Fprintf(os.Stderr, "SSH SETUP FAILURE:\n%v", stdOutErrBuf.String())
+func (vm *VM) sshSetupWithAgent() error {
+	agent, err := vm.Agent()
+	if err != nil {
+		return errors.Wrap(err, "get guest agent")
+	}
 
-					return nil, fmt.Errorf("non-zero setup command status code: '%v' %v", string(data[len(prefix)]), utils.GetLogErrMsg(stdOutErrBuf.String(), "stdout/stderr log"))
-				}
+	ctx, ctxCancel := context.WithTimeout(vm.ctx, time.Second*30)
+	defer ctxCancel()
 
-				return sshSigner, nil
-			}
-		}
+	// The SSH credentials are installed at boot by a service
+	// in the VM image, so we only need to start the server.
+	_, err = agent.ExecOK(ctx, vm.getSSHSetupScript(false))
+	if err != nil {
+		return errors.Wrap(err, "run ssh setup cmd")
 	}
+
+	return nil
 }
@@ -20,10 +20,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
-	"os"
-	"os/exec"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,7 +31,6 @@ import (
 	"log/slog"
 
 	"github.com/AlexSSD7/linsk/osspecifics"
-	"github.com/AlexSSD7/linsk/qemucli"
 	"github.com/AlexSSD7/linsk/sshutil"
 	"github.com/AlexSSD7/linsk/utils"
 	"github.com/bramvdbogaerde/go-scp"
@@ -47,21 +46,34 @@ type VM struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
-	cmd *exec.Cmd
+	hv Hypervisor
 
 	sshMappedPort uint16
 	sshConf       *ssh.ClientConfig
 	sshReadyCh    chan struct{}
 	installSSH    bool
 
-	serialRead    *io.PipeReader
+	// SSH credentials are generated on the host and handed
+	// over to the guest by the hypervisor before it boots.
+	sshSigner  ssh.Signer
+	sshHostKey ssh.PublicKey
+
+	// Closed once the hypervisor reports the VM has exited.
+	exitedCh chan struct{}
+
+	// Empty if the guest agent is not used.
+	agentAddr string
+	agent     *AgentClient
+	agentMu   sync.RWMutex
+
+	// Both are nil if the hypervisor has no serial console.
 	serialReader  *bufio.Reader
-	serialWrite   *io.PipeWriter
+	serialWrite   io.Writer
 	serialWriteMu sync.Mutex
-	qemuStderrBuf *bytes.Buffer
 
-	osUpTimeout  time.Duration
-	sshUpTimeout time.Duration
+	osUpTimeout     time.Duration
+	sshUpTimeout    time.Duration
+	shutdownTimeout time.Duration
 
 	serialStdoutCh chan []byte
 
@@ -69,6 +81,12 @@ type VM struct {
 	disposed uint32
 	canceled uint32
 
+	// The memory left to the guest OS by the balloon, in MiB.
+	memoryTarget atomic.Uint32
+
+	// Set if the balloon failed to be set up. The VM keeps the memory it was started with.
+	balloonFailed atomic.Bool
+
 	originalCfg Config
 }
 
@@ -86,11 +104,22 @@ type Config struct {
 	BIOSPath       string
 	Drives         []DriveConfig
 
-	MemoryAlloc uint32 // In KiB.
+	MemoryAlloc uint32 // In MiB.
+
+	// The memory the VM can be grown to at runtime with a virtio-balloon
+	// device, see VM.SetMemoryTarget. Not used if not greater than MemoryAlloc.
+	MemoryMax uint32 // In MiB.
 
 	PassthroughConfig        PassthroughConfig
 	ExtraPortForwardingRules []PortForwardingRule
 
+	// Guarantees that passed-through devices are never written to. Drives are
+	// attached as read-only, and FileManager mounts and shares everything as such.
+	ReadOnly bool
+
+	// Which LVM volume groups and logical volumes FileManager activates.
+	LVM LVMConfig
+
 	// Networking
 	UnrestrictedNetworking bool
 	Taps                   []TapConfig
@@ -99,6 +128,17 @@ type Config struct {
 	OSUpTimeout  time.Duration
 	SSHUpTimeout time.Duration
 
+	// The time given to the teardown and the guest OS shutdown altogether.
+	// The VM is terminated forcefully once it expires.
+	ShutdownTimeout time.Duration
+
+	// Use the virtio-serial guest agent for VM setup instead of the serial console.
+	// This requires a VM image built by Linsk.
+	GuestAgent bool
+
+	// The backend to run the VM with. QEMU is used if nil.
+	Hypervisor Hypervisor
+
 	// Mostly debug-related options.
 	Debug                bool // This will show the display and forward all QEMU warnings/errors to stderr.
 	InstallBaseUtilities bool
@@ -110,39 +150,59 @@ func NewVM(logger *slog.Logger, cfg Config) (*VM, error) {
 		return nil, errors.Wrap(err, "get free port for ssh server")
 	}
 
-	baseCmd, cmdArgs, err := configureBaseVMCmd(logger, cfg)
-	if err != nil {
-		return nil, errors.Wrap(err, "configure base vm cmd")
+	if cfg.InstallBaseUtilities && !cfg.UnrestrictedNetworking {
+		return nil, fmt.Errorf("installation of base utilities is impossible with unrestricted networking disabled")
+	}
+
+	if cfg.ReadOnly && len(cfg.PassthroughConfig.USB) != 0 {
+		return nil, fmt.Errorf("usb passthrough cannot be made read-only, please use raw block device passthrough instead")
 	}
 
-	netCmdArgs, err := configureVMCmdNetworking(logger, cfg, uint16(sshPort))
+	err = cfg.LVM.validate()
 	if err != nil {
-		return nil, errors.Wrap(err, "configure vm cmd networking")
+		return nil, errors.Wrap(err, "validate lvm config")
 	}
 
-	cmdArgs = append(cmdArgs, netCmdArgs...)
+	sshSigner, sshPublicKey, err := sshutil.GenerateSSHKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate ssh key")
+	}
 
-	driveCmdArgs, err := configureVMCmdDrives(cfg)
+	sshHostKeyPEM, sshHostKey, err := sshutil.GenerateSSHHostKey()
 	if err != nil {
-		return nil, errors.Wrap(err, "configure vm cmd drives")
+		return nil, errors.Wrap(err, "generate ssh host key")
 	}
 
-	cmdArgs = append(cmdArgs, driveCmdArgs...)
+	// SSH port config.
+	ports := []PortForwardingRule{{
+		HostIP:   net.ParseIP("127.0.0.1"),
+		HostPort: uint16(sshPort),
+		VMPort:   22,
+	}}
 
-	usbCmdArgs := configureVMCmdUSBPassthrough(cfg)
+	ports = append(ports, cfg.ExtraPortForwardingRules...)
 
-	cmdArgs = append(cmdArgs, usbCmdArgs...)
+	hv := cfg.Hypervisor
+	if hv == nil {
+		hv = NewQEMUHypervisor(logger.With("subcaller", "qemu"))
+	}
 
-	blockDevArgs, err := configureVMCmdBlockDevicePassthrough(logger, cfg)
+	err = hv.Prepare(HypervisorSpec{
+		Config:              cfg,
+		PortForwardingRules: ports,
+		SSHAuthorizedKey:    sshPublicKey,
+		SSHHostKeyPEM:       sshHostKeyPEM,
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "configure vm cmd block device passthrough")
+		return nil, errors.Wrap(err, "prepare hypervisor")
 	}
 
-	cmdArgs = append(cmdArgs, blockDevArgs...)
-
-	if cfg.InstallBaseUtilities && !cfg.UnrestrictedNetworking {
-		return nil, fmt.Errorf("installation of base utilities is impossible with unrestricted networking disabled")
-	}
+	var success bool
+	defer func() {
+		if !success {
+			_ = hv.Close()
+		}
+	}()
 
 	// NOTE: The default timeouts below have no relation to the default
 	// timeouts set by the CLI. These work only if no timeout was supplied
@@ -156,35 +216,32 @@ func NewVM(logger *slog.Logger, cfg Config) (*VM, error) {
 		sshUpTimeout = cfg.SSHUpTimeout
 	}
 
-	if sshUpTimeout < osUpTimeout {
-		return nil, fmt.Errorf("vm ssh setup timeout cannot be lower than os up timeout")
+	shutdownTimeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout != 0 {
+		shutdownTimeout = cfg.ShutdownTimeout
 	}
 
-	encodedCmdArgs, err := qemucli.EncodeArgs(cmdArgs)
-	if err != nil {
-		return nil, errors.Wrap(err, "encode qemu cli args")
+	if hv.SoftwareEmulated() {
+		osUpTimeout *= softwareEmulationTimeoutMultiplier
+		sshUpTimeout *= softwareEmulationTimeoutMultiplier
+		shutdownTimeout *= softwareEmulationTimeoutMultiplier
 	}
 
-	// No errors beyond this point.
-
-	sysRead, userWrite := io.Pipe()
-	userRead, sysWrite := io.Pipe()
-
-	cmd := exec.Command(baseCmd, encodedCmdArgs...) //#nosec G204 // I know, it's generally a bad idea to include variables into shell commands, but QEMU unfortunately does not accept anything else.
-
-	cmd.Stdin = sysRead
-	cmd.Stdout = sysWrite
-	stderrBuf := bytes.NewBuffer(nil)
-	cmd.Stderr = stderrBuf
-
-	if cfg.Debug {
-		cmd.Stderr = io.MultiWriter(cmd.Stderr, os.Stderr)
+	if sshUpTimeout < osUpTimeout {
+		return nil, fmt.Errorf("vm ssh setup timeout cannot be lower than os up timeout")
 	}
 
-	// This function is OS-specific.
-	osspecifics.SetNewProcessGroupCmd(cmd)
+	var agentAddr string
+	if cfg.GuestAgent {
+		agentAddr, err = hv.AgentAddr()
+		if err != nil {
+			if !errors.Is(err, ErrAgentUnavailable) {
+				return nil, errors.Wrap(err, "get guest agent addr")
+			}
 
-	userReader := bufio.NewReader(userRead)
+			logger.Warn("The hypervisor provides no guest agent channel, not using the guest agent")
+		}
+	}
 
 	ctx, ctxCancel := context.WithCancel(context.Background())
 
@@ -194,25 +251,38 @@ func NewVM(logger *slog.Logger, cfg Config) (*VM, error) {
 		ctx:       ctx,
 		ctxCancel: ctxCancel,
 
-		cmd: cmd,
+		hv: hv,
 
 		sshMappedPort: uint16(sshPort),
 		sshReadyCh:    make(chan struct{}),
 		installSSH:    cfg.InstallBaseUtilities,
 
-		serialRead:    userRead,
-		serialReader:  userReader,
-		serialWrite:   userWrite,
-		qemuStderrBuf: stderrBuf,
+		sshSigner:  sshSigner,
+		sshHostKey: sshHostKey,
 
-		osUpTimeout:  osUpTimeout,
-		sshUpTimeout: sshUpTimeout,
+		exitedCh: make(chan struct{}),
+
+		agentAddr: agentAddr,
+
+		osUpTimeout:     osUpTimeout,
+		sshUpTimeout:    sshUpTimeout,
+		shutdownTimeout: shutdownTimeout,
 
 		originalCfg: cfg,
 	}
 
+	serialRead, serialWrite := hv.Console()
+	if serialRead != nil && serialWrite != nil {
+		vm.serialReader = bufio.NewReader(serialRead)
+		vm.serialWrite = serialWrite
+	}
+
 	vm.resetSerialStdout()
 
+	vm.memoryTarget.Store(cfg.MemoryAlloc)
+
+	success = true
+
 	return vm, nil
 }
 
@@ -221,9 +291,9 @@ func (vm *VM) Run() error {
 		return fmt.Errorf("vm disposed")
 	}
 
-	err := vm.cmd.Start()
+	err := vm.hv.Start()
 	if err != nil {
-		return errors.Wrap(err, "start qemu cmd")
+		return errors.Wrap(err, "start hypervisor")
 	}
 
 	go vm.runPeriodicHostMountChecker()
@@ -261,72 +331,100 @@ func (vm *VM) Run() error {
 
 	vm.logger.Info("Booting the VM")
 
-	go func() {
-		_ = vm.runSerialReader()
-		_ = vm.Cancel()
-	}()
+	if vm.serialReader != nil {
+		go func() {
+			_ = vm.runSerialReader()
+			_ = vm.Cancel()
+		}()
+	}
 
 	go func() {
-		err = vm.runVMLoginHandler()
-		if err != nil {
-			globalErrFn(errors.Wrap(err, "run vm login handler"))
-			return
+		switch {
+		case vm.agentAddr != "":
+			err := vm.waitForAgent()
+			if err != nil {
+				globalErrFn(errors.Wrap(err, "wait for guest agent"))
+				return
+			}
+		case vm.serialReader != nil:
+			err := vm.runVMLoginHandler()
+			if err != nil {
+				globalErrFn(errors.Wrap(err, "run vm login handler"))
+				return
+			}
 		}
 
 		// This will disable the timeout-handling goroutine.
 		close(bootReadyCh)
 
-		sshSigner, err := vm.sshSetup()
-		if err != nil {
-			globalErrFn(errors.Wrap(err, "set up ssh"))
-			return
+		switch {
+		case vm.agentAddr != "":
+			err := vm.sshSetupWithAgent()
+			if err != nil {
+				globalErrFn(errors.Wrap(err, "set up ssh with guest agent"))
+				return
+			}
+		case vm.serialReader != nil:
+			err := vm.sshSetup()
+			if err != nil {
+				globalErrFn(errors.Wrap(err, "set up ssh"))
+				return
+			}
+		default:
+			// Without a console or an agent, we have no way to set up the
+			// guest ourselves. The hypervisor is expected to provide a guest
+			// with the SSH server already running with our credentials.
 		}
 
 		vm.logger.Debug("Set up SSH server successfully")
 
-		sshKeyScan, err := vm.scanSSHIdentity()
-		if err != nil {
-			globalErrFn(errors.Wrap(err, "scan ssh identity"))
-			return
-		}
-
-		vm.logger.Debug("Scanned SSH identity")
-
-		knownHosts, err := ParseSSHKeyScan(sshKeyScan)
+		// We know the host key upfront as we generated it ourselves.
+		knownHosts, err := ParseSSHKeyScan([]byte("127.0.0.1 " + vm.sshHostKey.Type() + " " + base64.StdEncoding.EncodeToString(vm.sshHostKey.Marshal())))
 		if err != nil {
 			globalErrFn(errors.Wrap(err, "parse ssh key scan"))
 			return
 		}
 
 		vm.sshConf = &ssh.ClientConfig{
-			User:            "root",
-			HostKeyCallback: knownHosts,
+			User:              "root",
+			HostKeyCallback:   knownHosts,
+			HostKeyAlgorithms: []string{vm.sshHostKey.Type()},
 			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(sshSigner),
+				ssh.PublicKeys(vm.sshSigner),
 			},
 			Timeout: time.Second * 5,
 		}
 
+		if vm.balloonEnabled() {
+			// Not fatal as the VM is still usable, just with more memory than asked for.
+			err := vm.initMemoryBalloon()
+			if err != nil {
+				vm.logger.Warn("Failed to set up the memory balloon, the VM will keep the maximum memory allocation", "max-mib", vm.originalCfg.MemoryMax, "error", err.Error())
+				vm.disableMemoryBalloon()
+			}
+		}
+
 		// This is to notify everyone waiting for SSH to be up that it's ready to go.
 		close(vm.sshReadyCh)
 	}()
 
-	_, err = vm.cmd.Process.Wait()
+	err = vm.hv.Wait()
+	close(vm.exitedCh)
 	cancelErr := vm.Cancel()
 	if err != nil {
 		combinedErr := multierr.Combine(
-			errors.Wrap(err, "wait for cmd to finish execution"),
+			errors.Wrap(err, "wait for vm to exit"),
 			errors.Wrap(cancelErr, "cancel"),
 		)
 
-		return fmt.Errorf("%w %v", combinedErr, utils.GetLogErrMsg(vm.qemuStderrBuf.String(), "qemu stderr log"))
+		return fmt.Errorf("%w %v", combinedErr, utils.GetLogErrMsg(vm.hv.Log(), "hypervisor log"))
 	}
 
 	combinedErr := multierr.Combine(
 		append(globalErrs, errors.Wrap(cancelErr, "cancel on exit"))...,
 	)
 	if combinedErr != nil {
-		return fmt.Errorf("%w %v", combinedErr, utils.GetLogErrMsg(vm.qemuStderrBuf.String(), "qemu stderr log"))
+		return fmt.Errorf("%w %v", combinedErr, utils.GetLogErrMsg(vm.hv.Log(), "hypervisor log"))
 	}
 
 	return nil
@@ -341,40 +439,50 @@ func (vm *VM) Cancel() error {
 
 	var gracefulOK bool
 
-	sc, err := vm.DialSSH()
-	if err != nil {
-		if !errors.Is(err, ErrSSHUnavailable) {
-			vm.logger.Warn("Failed to dial VM SSH to do graceful shutdown", "error", err.Error())
-		}
-	} else {
-		vm.logger.Warn("Sending poweroff command to the VM")
-		_, err = sshutil.RunSSHCmd(context.Background(), sc, "poweroff")
-		_ = sc.Close()
-		if err != nil {
-			vm.logger.Warn("Could not power off the VM safely", "error", err.Error())
-		} else {
-			vm.logger.Info("Shutting the VM down safely")
+	// A single deadline for the teardown, the poweroff and the guest OS shutdown.
+	shutdownCtx, shutdownCtxCancel := context.WithTimeout(context.Background(), vm.shutdownTimeout)
+	defer shutdownCtxCancel()
+
+	if vm.requestShutdown(shutdownCtx) {
+		select {
+		case <-vm.exitedCh:
+			gracefulOK = true
+			vm.logger.Info("The VM has shut down safely")
+		case <-shutdownCtx.Done():
+			vm.logger.Warn("The VM did not shut down in time, terminating", "timeout", vm.shutdownTimeout)
 		}
 	}
 
 	var interruptErr error
 
 	if !gracefulOK {
-		if vm.cmd.Process == nil {
-			interruptErr = fmt.Errorf("process is not started")
-		} else {
-			interruptErr = osspecifics.TerminateProcess(vm.cmd.Process.Pid)
-		}
+		interruptErr = vm.forceStop()
 	}
 
 	vm.ctxCancel()
 	return multierr.Combine(
-		errors.Wrap(interruptErr, "interrupt cmd"),
-		errors.Wrap(vm.serialRead.Close(), "close serial read pipe"),
-		errors.Wrap(vm.serialWrite.Close(), "close serial write pipe"),
+		errors.Wrap(interruptErr, "terminate vm"),
+		errors.Wrap(vm.closeAgent(), "close guest agent"),
+		errors.Wrap(vm.hv.Close(), "close hypervisor"),
 	)
 }
 
+// QMP returns the QEMU Machine Protocol client connected to the running VM.
+// ErrQMPUnavailable is returned if the VM is not run by QEMU.
+func (vm *VM) QMP() (*QMPClient, error) {
+	q, ok := vm.hv.(*QEMUHypervisor)
+	if !ok {
+		return nil, ErrQMPUnavailable
+	}
+
+	return q.QMP()
+}
+
+// Hypervisor returns the backend the VM is run with.
+func (vm *VM) Hypervisor() Hypervisor {
+	return vm.hv
+}
+
 func (vm *VM) runSerialReader() error {
 	for {
 		raw, err := vm.serialReader.ReadBytes('\n')
@@ -433,6 +541,74 @@ func (vm *VM) runVMLoginHandler() error {
 	}
 }
 
+func (vm *VM) waitForAgent() error {
+	for {
+		err := vm.tryConnectAgent(vm.agentAddr)
+		if err == nil {
+			vm.logger.Debug("Connected to the guest agent")
+			return nil
+		}
+
+		vm.logger.Debug("Guest agent is not ready yet", "error", err.Error())
+
+		select {
+		case <-vm.ctx.Done():
+			return vm.ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (vm *VM) tryConnectAgent(addr string) error {
+	ctx, ctxCancel := context.WithTimeout(vm.ctx, time.Second)
+	defer ctxCancel()
+
+	agent, err := DialAgent(ctx, addr)
+	if err != nil {
+		return errors.Wrap(err, "dial agent")
+	}
+
+	err = agent.Ping(ctx)
+	if err != nil {
+		_ = agent.Close()
+		return errors.Wrap(err, "ping agent")
+	}
+
+	vm.agentMu.Lock()
+	defer vm.agentMu.Unlock()
+
+	vm.agent = agent
+
+	return nil
+}
+
+func (vm *VM) closeAgent() error {
+	vm.agentMu.Lock()
+	defer vm.agentMu.Unlock()
+
+	if vm.agent == nil {
+		return nil
+	}
+
+	err := vm.agent.Close()
+	vm.agent = nil
+
+	return err
+}
+
+// Agent returns the guest agent client. The guest agent is available only
+// if it was enabled in the VM config and is supported by the hypervisor.
+func (vm *VM) Agent() (*AgentClient, error) {
+	vm.agentMu.RLock()
+	defer vm.agentMu.RUnlock()
+
+	if vm.agent == nil {
+		return nil, ErrAgentUnavailable
+	}
+
+	return vm.agent, nil
+}
+
 func (vm *VM) resetSerialStdout() {
 	vm.serialStdoutCh = make(chan []byte, 32)
 }
@@ -496,7 +672,7 @@ func (vm *VM) runPeriodicHostMountChecker() {
 				}
 
 				if seemsMounted {
-					_ = vm.cmd.Process.Kill()
+					_ = vm.hv.Kill()
 					panic(fmt.Sprintf("CRITICAL: Passed-through device '%v' appears to have been mounted on the host OS. Forcefully exiting now to prevent data corruption.", dev.Path))
 				}
 			}
@@ -0,0 +1,384 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AlexSSD7/linsk/sshutil"
+	"github.com/AlexSSD7/linsk/utils"
+	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+type ZFSDataset struct {
+	Name      string `json:"name"`
+	Used      uint64 `json:"used"`
+	Available uint64 `json:"available"`
+
+	// The mountpoint property. It is not where Linsk mounts the dataset.
+	MountPoint string `json:"mount_point"`
+	CanMount   string `json:"can_mount"`
+
+	// "off" if the dataset is not encrypted.
+	Encryption string `json:"encryption"`
+
+	// "available", "unavailable", or "-" if the dataset is not encrypted.
+	KeyStatus string `json:"key_status"`
+}
+
+type ZFSMountConfig struct {
+	// Mounts the descendant datasets too, following the dataset hierarchy.
+	Recursive bool
+
+	// Pools are imported read-only unless this is set. This
+	// has no effect if the VM is in the read-only mode.
+	Writable bool
+
+	// Imports the pool even if it appears to be in use by another
+	// system, which is the case for pools not exported cleanly.
+	Force bool
+
+	// The source of secrets for the native encryption keys.
+	// If nil, the one set with FileManager.SetLUKSSecretSource is used.
+	SecretSource LUKSSecretSource
+
+	// Same as MountConfig.Name.
+	Name string
+}
+
+// The ZFS kernel module is not loaded on boot as most sessions don't need it.
+func (fm *FileManager) loadZFS(sc *ssh.Client) error {
+	_, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "modprobe zfs")
+	if err != nil {
+		return errors.Wrap(err, "load zfs kernel module")
+	}
+
+	return nil
+}
+
+// ZFSImportablePools returns the names of the pools found on the devices that are not imported yet.
+func (fm *FileManager) ZFSImportablePools() ([]string, error) {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	err = fm.loadZFS(sc)
+	if err != nil {
+		return nil, err
+	}
+
+	// zpool import exits with a non-zero code if no pools are found.
+	out, err := sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, "zpool import 2> /dev/null || true")
+	if err != nil {
+		return nil, errors.Wrap(err, "run zpool import")
+	}
+
+	return parseZpoolImport(out), nil
+}
+
+// Returns the pool names from the human-readable output of zpool import,
+// which has no machine-readable mode.
+func parseZpoolImport(out []byte) []string {
+	var ret []string
+	for _, line := range strings.Split(string(out), "\n") {
+		name, ok := strings.CutPrefix(strings.TrimSpace(line), "pool:")
+		if ok {
+			ret = append(ret, strings.TrimSpace(name))
+		}
+	}
+
+	return ret
+}
+
+// ZFSImport imports the pool without mounting any of its datasets.
+func (fm *FileManager) ZFSImport(pool string, writable bool, force bool) error {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	return fm.importZFSPool(sc, pool, writable, force)
+}
+
+func (fm *FileManager) importZFSPool(sc *ssh.Client, pool string, writable bool, force bool) error {
+	if !utils.ValidateZFSName(pool) || strings.Contains(pool, "/") {
+		return fmt.Errorf("bad zfs pool name '%v'", pool)
+	}
+
+	err := fm.loadZFS(sc)
+	if err != nil {
+		return err
+	}
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "zpool list -H -o name "+shellescape.Quote(pool)+" 2> /dev/null || true")
+	if err != nil {
+		return errors.Wrap(err, "run zpool list")
+	}
+
+	if strings.TrimSpace(string(out)) == pool {
+		fm.logger.Debug("ZFS pool is already imported", "pool", pool)
+		return nil
+	}
+
+	readOnly := !writable || fm.vm.originalCfg.ReadOnly
+
+	cmd := "zpool import -N "
+	if readOnly {
+		cmd += "-o readonly=on "
+	}
+	if force {
+		cmd += "-f "
+	}
+	cmd += shellescape.Quote(pool)
+
+	fm.logger.Info("Importing ZFS pool", "pool", pool, "read-only", readOnly)
+
+	// Importing large pools may take a while.
+	_, err = sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, cmd)
+	if err != nil {
+		if strings.Contains(err.Error(), "may be in use from other system") || strings.Contains(err.Error(), "was previously in use from another system") {
+			fm.logger.Warn("The ZFS pool was not exported cleanly. If it is not in use elsewhere, you can force the import.", "pool", pool)
+		}
+
+		return errors.Wrap(err, "run zpool import")
+	}
+
+	return nil
+}
+
+// ZFSListDatasets returns the file system datasets of the imported pool.
+func (fm *FileManager) ZFSListDatasets(pool string) ([]ZFSDataset, error) {
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return nil, errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	return fm.listZFSDatasets(sc, pool, true)
+}
+
+func (fm *FileManager) listZFSDatasets(sc *ssh.Client, dataset string, recursive bool) ([]ZFSDataset, error) {
+	if !utils.ValidateZFSName(dataset) {
+		return nil, fmt.Errorf("bad zfs dataset name '%v'", dataset)
+	}
+
+	cmd := "zfs list -H -p -t filesystem -o name,used,avail,mountpoint,canmount,encryption,keystatus "
+	if recursive {
+		cmd += "-r "
+	}
+	cmd += shellescape.Quote(dataset)
+
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "run zfs list")
+	}
+
+	return parseZFSList(out)
+}
+
+func parseZFSList(out []byte) ([]ZFSDataset, error) {
+	var ret []ZFSDataset
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+
+		split := strings.Split(line, "\t")
+		if len(split) != 7 {
+			return nil, fmt.Errorf("bad zfs list line '%v'", line)
+		}
+
+		used, err := strconv.ParseUint(split[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse used space")
+		}
+
+		avail, err := strconv.ParseUint(split[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse available space")
+		}
+
+		ret = append(ret, ZFSDataset{
+			Name:       split[0],
+			Used:       used,
+			Available:  avail,
+			MountPoint: split[3],
+			CanMount:   split[4],
+			Encryption: split[5],
+			KeyStatus:  split[6],
+		})
+	}
+
+	return ret, nil
+}
+
+// Loads the key of the dataset's encryption root. Secrets are passed as
+// keyfiles, which works for all key formats, including passphrases.
+func (fm *FileManager) loadZFSKey(sc *ssh.Client, dataset string, src LUKSSecretSource) error {
+	out, err := sshutil.RunSSHCmd(fm.vm.ctx, sc, "zfs get -H -o value encryptionroot,keystatus "+shellescape.Quote(dataset))
+	if err != nil {
+		return errors.Wrap(err, "get zfs encryption root")
+	}
+
+	split := strings.Fields(string(out))
+	if len(split) != 2 {
+		return fmt.Errorf("bad zfs get output '%v'", strings.TrimSpace(string(out)))
+	}
+
+	encRoot, keyStatus := split[0], split[1]
+	if encRoot == "-" || keyStatus == "available" {
+		return nil
+	}
+
+	if !utils.ValidateZFSName(encRoot) {
+		return fmt.Errorf("bad zfs encryption root '%v'", encRoot)
+	}
+
+	lg := fm.logger.With("encryption-root", encRoot)
+
+	lg.Info("Loading ZFS encryption key")
+
+	err = fm.withLUKSSecret(encRoot, src, func(secret *LUKSSecret) error {
+		keyfilePath, err := fm.uploadLUKSSecretFile(sc, secret.asKeyfile())
+		if err != nil {
+			return errors.Wrap(err, "upload zfs keyfile")
+		}
+
+		defer fm.wipeLUKSSecretFile(sc, keyfilePath)
+
+		_, err = sshutil.RunSSHCmdWithTimeout(fm.vm.ctx, luksCmdTimeout, sc, "zfs load-key -L file://"+keyfilePath+" "+shellescape.Quote(encRoot))
+		if err != nil {
+			if strings.Contains(err.Error(), "Incorrect key provided") {
+				return ErrLUKSWrongPassphrase
+			}
+
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "load zfs key")
+	}
+
+	lg.Info("ZFS encryption key loaded successfully")
+
+	return nil
+}
+
+// MountZFS imports the pool of the dataset and mounts the dataset under /mnt
+// (or /mnt/<name>). The mountpoint properties of datasets are ignored, and
+// descendants are mounted at the paths matching their names.
+func (fm *FileManager) MountZFS(dataset string, zc ZFSMountConfig) error {
+	if !utils.ValidateZFSName(dataset) {
+		return fmt.Errorf("bad zfs dataset name '%v'", dataset)
+	}
+
+	pool, _, _ := strings.Cut(dataset, "/")
+
+	mountPoint := "/mnt"
+	if zc.Name != "" {
+		if !utils.ValidateMountName(zc.Name) {
+			return fmt.Errorf("bad mount name '%v'", zc.Name)
+		}
+
+		mountPoint += "/" + zc.Name
+	}
+
+	fm.mountsMu.Lock()
+	defer fm.mountsMu.Unlock()
+
+	err := fm.checkMountNameLocked(zc.Name)
+	if err != nil {
+		return err
+	}
+
+	sc, err := fm.vm.DialSSH()
+	if err != nil {
+		return errors.Wrap(err, "dial vm ssh")
+	}
+
+	defer func() { _ = sc.Close() }()
+
+	err = fm.importZFSPool(sc, pool, zc.Writable, zc.Force)
+	if err != nil {
+		return errors.Wrap(err, "import zfs pool")
+	}
+
+	datasets, err := fm.listZFSDatasets(sc, dataset, zc.Recursive)
+	if err != nil {
+		return errors.Wrap(err, "list zfs datasets")
+	}
+
+	mountOptions := "zfsutil"
+	if !zc.Writable || fm.vm.originalCfg.ReadOnly {
+		mountOptions += ",ro"
+	}
+
+	// Parents are listed before their descendants.
+	for _, ds := range datasets {
+		lg := fm.logger.With("dataset", ds.Name)
+
+		dsMountPoint := mountPoint + strings.TrimPrefix(ds.Name, dataset)
+
+		if ds.CanMount == "off" {
+			if !zc.Recursive {
+				return fmt.Errorf("dataset '%v' cannot be mounted as its canmount property is off", ds.Name)
+			}
+
+			lg.Debug("Skipping ZFS dataset which cannot be mounted")
+
+			continue
+		}
+
+		if ds.Encryption != "off" && ds.KeyStatus != "available" {
+			err = fm.loadZFSKey(sc, ds.Name, zc.SecretSource)
+			if err != nil {
+				return errors.Wrapf(err, "load key for dataset '%v'", ds.Name)
+			}
+		}
+
+		_, err = sshutil.RunSSHCmd(fm.vm.ctx, sc, "mkdir -p "+shellescape.Quote(dsMountPoint)+" && mount -t zfs -o "+mountOptions+" "+shellescape.Quote(ds.Name)+" "+shellescape.Quote(dsMountPoint))
+		if err != nil {
+			if ds.Name == dataset {
+				return errors.Wrap(err, "run mount cmd")
+			}
+
+			// The directory for a descendant may be missing in a read-only parent.
+			lg.Warn("Failed to mount ZFS dataset, skipping", "error", err.Error())
+
+			continue
+		}
+
+		lg.Info("Mounted ZFS dataset", "mountpoint", dsMountPoint)
+	}
+
+	fm.mounts = append(fm.mounts, zc.Name)
+
+	return nil
+}
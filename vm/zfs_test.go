@@ -0,0 +1,125 @@
+// Linsk - A utility to access Linux-native file systems on non-Linux operating systems.
+// Copyright (c) 2023 The Linsk Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseZpoolImport(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{
+			name: "none",
+			out:  "",
+		},
+		{
+			name: "one",
+			out: `   pool: tank
+     id: 15011618183813627823
+  state: ONLINE
+ action: The pool can be imported using its name or numeric identifier.
+ config:
+
+	tank        ONLINE
+	  mirror-0  ONLINE
+	    vdb     ONLINE
+	    vdc     ONLINE
+`,
+			want: []string{"tank"},
+		},
+		{
+			name: "several",
+			out: `   pool: tank
+     id: 15011618183813627823
+  state: ONLINE
+ action: The pool can be imported using its name or numeric identifier.
+ config:
+
+	tank        ONLINE
+	  vdb       ONLINE
+
+   pool: backup
+     id: 4417235180593412345
+  state: ONLINE
+ status: The pool was last accessed by another system.
+ action: The pool can be imported using its name or numeric identifier and
+	the '-f' flag.
+   see: https://openzfs.github.io/openzfs-docs/msg/ZFS-8000-EY
+ config:
+
+	backup      ONLINE
+	  vdc       ONLINE
+
+   pool: old-pool
+     id: 9876543210123456789
+  state: UNAVAIL
+ status: One or more devices are missing from the system.
+ action: The pool cannot be imported. Attach the missing
+	devices and try again.
+   see: https://openzfs.github.io/openzfs-docs/msg/ZFS-8000-3C
+ config:
+
+	old-pool    UNAVAIL  insufficient replicas
+	  vdd       UNAVAIL  cannot open
+`,
+			want: []string{"tank", "backup", "old-pool"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have := parseZpoolImport([]byte(tc.out))
+			if !reflect.DeepEqual(tc.want, have) {
+				t.Errorf("want %q, have %q", tc.want, have)
+			}
+		})
+	}
+}
+
+func TestParseZFSList(t *testing.T) {
+	out := "tank\t1245184\t9634263040\t/tank\ton\toff\t-\n" +
+		"tank/home\t98304\t9634263040\t/home\ton\taes-256-gcm\tunavailable\n" +
+		"tank/legacy\t24576\t9634263040\tlegacy\tnoauto\toff\t-\n"
+
+	want := []ZFSDataset{
+		{Name: "tank", Used: 1245184, Available: 9634263040, MountPoint: "/tank", CanMount: "on", Encryption: "off", KeyStatus: "-"},
+		{Name: "tank/home", Used: 98304, Available: 9634263040, MountPoint: "/home", CanMount: "on", Encryption: "aes-256-gcm", KeyStatus: "unavailable"},
+		{Name: "tank/legacy", Used: 24576, Available: 9634263040, MountPoint: "legacy", CanMount: "noauto", Encryption: "off", KeyStatus: "-"},
+	}
+
+	have, err := parseZFSList([]byte(out))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	for _, out := range []string{
+		"tank\t1245184\t9634263040\t/tank\n",
+		"tank\t1.2M\t9634263040\t/tank\ton\toff\t-\n",
+	} {
+		_, err := parseZFSList([]byte(out))
+		if err == nil {
+			t.Errorf("%q: want an error", out)
+		}
+	}
+}